@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+	"kope.io/build/pkg/docker"
+)
+
+type CatalogOptions struct {
+	Registry string
+}
+
+func BuildCatalogCommand(f Factory, out io.Writer) *cobra.Command {
+	options := &CatalogOptions{}
+
+	cmd := &cobra.Command{
+		Use: "catalog",
+		Run: func(cmd *cobra.Command, args []string) {
+			options.Registry = cmd.Flags().Arg(0)
+			if err := RunCatalogCommand(f, options, out); err != nil {
+				ExitWithError(err)
+			}
+		},
+	}
+
+	return cmd
+}
+
+func RunCatalogCommand(factory Factory, options *CatalogOptions, out io.Writer) error {
+	if options.Registry == "" {
+		return fmt.Errorf("registry is required, e.g. registry.example.com:5000")
+	}
+
+	registry, err := registryForHost(factory, options.Registry)
+	if err != nil {
+		return err
+	}
+	auth := &docker.Auth{HttpClient: registry.HttpClient}
+
+	repositories, err := registry.Catalog(auth)
+	if err != nil {
+		return err
+	}
+
+	for _, repository := range repositories {
+		fmt.Fprintf(out, "%s\n", repository)
+	}
+	return nil
+}
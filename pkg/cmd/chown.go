@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"kope.io/build/pkg/layers"
+)
+
+type ChownOptions struct {
+	// Owner is the new owner, as uid:gid
+	Owner string
+
+	// Paths are the paths to change, as <layer>:<path>
+	Paths []string
+
+	// Recursive changes directories along with their contents
+	Recursive bool
+}
+
+func BuildChownCommand(f Factory, out io.Writer) *cobra.Command {
+	options := &ChownOptions{}
+
+	cmd := &cobra.Command{
+		Use: "chown",
+		Run: func(cmd *cobra.Command, args []string) {
+			options.Owner = cmd.Flags().Arg(0)
+			options.Paths = cmd.Flags().Args()
+			if len(options.Paths) >= 1 {
+				options.Paths = options.Paths[1:]
+			}
+			if err := RunChownCommand(f, options, out); err != nil {
+				ExitWithError(err)
+			}
+		},
+	}
+
+	cmd.Flags().BoolVarP(&options.Recursive, "recursive", "R", false, "change directories and their contents")
+
+	return cmd
+}
+
+func RunChownCommand(factory Factory, options *ChownOptions, out io.Writer) error {
+	if options.Owner == "" {
+		return fmt.Errorf("owner is required, e.g. 1000:1000")
+	}
+	if len(options.Paths) == 0 {
+		return fmt.Errorf("path is required, e.g. <layer>:/app")
+	}
+
+	owner, err := layers.ParseOwner(options.Owner)
+	if err != nil {
+		return err
+	}
+
+	layerStore, err := factory.LayerStore()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range options.Paths {
+		tokens := strings.SplitN(p, ":", 2)
+		if len(tokens) != 2 {
+			return fmt.Errorf("unknown path %q - expected <layer>:<path>", p)
+		}
+
+		l, err := layerStore.FindLayer(tokens[0])
+		if err != nil {
+			return err
+		}
+
+		if l == nil {
+			return fmt.Errorf("layer %q does not exist", tokens[0])
+		}
+
+		if err := l.Chown([]string{tokens[1]}, owner, options.Recursive); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Changed owner of %s to %s\n", p, owner)
+	}
+
+	return nil
+}
@@ -16,6 +16,9 @@ import (
 type CopyOptions struct {
 	Source string
 	Dest   string
+
+	// Chown is the owner of the copied files in the image, as uid:gid; by default they are owned by root
+	Chown string
 }
 
 func BuildCopyCommand(f Factory, out io.Writer) *cobra.Command {
@@ -32,6 +35,8 @@ func BuildCopyCommand(f Factory, out io.Writer) *cobra.Command {
 		},
 	}
 
+	cmd.Flags().StringVar(&options.Chown, "chown", "", "owner of the copied files in the image, as uid:gid (default root)")
+
 	return cmd
 }
 
@@ -43,6 +48,16 @@ func RunCopyCommand(factory Factory, options *CopyOptions, out io.Writer) error
 		return fmt.Errorf("dest is required")
 	}
 
+	// Files we copy replace what was there, so they are owned by root unless --chown is given
+	owner := layers.Owner{Uname: "root", Gname: "root"}
+	if options.Chown != "" {
+		var err error
+		owner, err = layers.ParseOwner(options.Chown)
+		if err != nil {
+			return err
+		}
+	}
+
 	layerStore, err := factory.LayerStore()
 	if err != nil {
 		return err
@@ -62,14 +77,19 @@ func RunCopyCommand(factory Factory, options *CopyOptions, out io.Writer) error
 		return fmt.Errorf("layer %q does not exist", destTokens[0])
 	}
 
-	if err := putFile(options.Source, l, destTokens[1], 0); err != nil {
+	var copied []string
+	if err := putFile(options.Source, l, destTokens[1], 0, &copied); err != nil {
+		return err
+	}
+	if err := l.Chown(copied, owner, false); err != nil {
 		return err
 	}
 	fmt.Fprintf(out, "Copied %s -> %s\n", options.Source, options.Dest)
 	return nil
 }
 
-func putFile(src string, l layers.Layer, dest string, depth int) error {
+// putFile copies src to dest in the layer, appending the paths it writes to copied
+func putFile(src string, l layers.Layer, dest string, depth int, copied *[]string) error {
 	stat, err := os.Lstat(src)
 	if err != nil {
 		return fmt.Errorf("error reading %q: %v", src, err)
@@ -87,7 +107,7 @@ func putFile(src string, l layers.Layer, dest string, depth int) error {
 		}
 
 		for _, file := range files {
-			err := putFile(filepath.Join(src, file.Name()), l, filepath.Join(dest, file.Name()), depth+1)
+			err := putFile(filepath.Join(src, file.Name()), l, filepath.Join(dest, file.Name()), depth+1, copied)
 			if err != nil {
 				return err
 			}
@@ -101,6 +121,7 @@ func putFile(src string, l layers.Layer, dest string, depth int) error {
 			return err
 		}
 
+		*copied = append(*copied, dest)
 		return nil
 	}
 
@@ -116,6 +137,7 @@ func putFile(src string, l layers.Layer, dest string, depth int) error {
 			return err
 		}
 
+		*copied = append(*copied, dest)
 		return nil
 	}
 
@@ -132,5 +154,6 @@ func putFile(src string, l layers.Layer, dest string, depth int) error {
 		return err
 	}
 
+	*copied = append(*copied, dest)
 	return nil
 }
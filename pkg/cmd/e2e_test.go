@@ -0,0 +1,584 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"kope.io/build/pkg/docker"
+	"kope.io/build/pkg/layers"
+	"kope.io/build/pkg/registry"
+)
+
+// testEnvironment is an in-process registry, with a directory for the kcb stores and docker config
+type testEnvironment struct {
+	t      *testing.T
+	dir    string
+	server *registry.Server
+	http   *httptest.Server
+
+	oldDockerConfig string
+}
+
+func newTestEnvironment(t *testing.T) *testEnvironment {
+	dir, err := ioutil.TempDir("", "kcb")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+
+	e := &testEnvironment{t: t, dir: dir}
+	e.server = registry.NewServer(filepath.Join(dir, "registry"))
+	e.http = httptest.NewServer(e.server)
+
+	// Don't read or write the user's docker credentials
+	e.oldDockerConfig = os.Getenv("DOCKER_CONFIG")
+	os.Setenv("DOCKER_CONFIG", filepath.Join(dir, "docker"))
+
+	return e
+}
+
+func (e *testEnvironment) Close() {
+	os.Setenv("DOCKER_CONFIG", e.oldDockerConfig)
+	e.http.Close()
+	os.RemoveAll(e.dir)
+}
+
+// host is the host:port of the registry
+func (e *testEnvironment) host() string {
+	return strings.TrimPrefix(e.http.URL, "http://")
+}
+
+// newFactory returns a factory with its own store, configured to talk to the registry over plain http
+func (e *testEnvironment) newFactory(name string) Factory {
+	dir := filepath.Join(e.dir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		e.t.Fatalf("error creating dir: %v", err)
+	}
+	config := fmt.Sprintf(`{"registries": {%q: {"plainHTTP": true}}, "certsDirs": []}`, e.host())
+	if err := ioutil.WriteFile(filepath.Join(dir, "registries.json"), []byte(config), 0644); err != nil {
+		e.t.Fatalf("error writing registries config: %v", err)
+	}
+	return newFSFactory(dir)
+}
+
+// createLayerWithFile creates a layer containing a single file
+func (e *testEnvironment) createLayerWithFile(f Factory, layer string, dest string, contents string) {
+	var out bytes.Buffer
+	if err := RunCreateLayerCommand(f, &CreateLayerOptions{Name: layer}, &out); err != nil {
+		e.t.Fatalf("error creating layer: %v", err)
+	}
+	src := filepath.Join(e.dir, "src-"+layer)
+	if err := ioutil.WriteFile(src, []byte(contents), 0644); err != nil {
+		e.t.Fatalf("error writing file: %v", err)
+	}
+	if err := RunCopyCommand(f, &CopyOptions{Source: src, Dest: layer + ":" + dest}, &out); err != nil {
+		e.t.Fatalf("error copying file: %v", err)
+	}
+}
+
+func TestEndToEndPushAndFetch(t *testing.T) {
+	e := newTestEnvironment(t)
+	defer e.Close()
+
+	image := "docker://" + e.host() + "/team/app:v1"
+	var out bytes.Buffer
+
+	// Build and push an image with a single file
+	builder := e.newFactory("builder")
+	if err := RunCreateLayerCommand(builder, &CreateLayerOptions{Name: "app"}, &out); err != nil {
+		t.Fatalf("error creating layer: %v", err)
+	}
+	src := filepath.Join(e.dir, "hello.txt")
+	if err := ioutil.WriteFile(src, []byte("hello world\n"), 0644); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	if err := RunCopyCommand(builder, &CopyOptions{Source: src, Dest: "app:/hello.txt"}, &out); err != nil {
+		t.Fatalf("error copying file: %v", err)
+	}
+
+	digestFile := filepath.Join(e.dir, "digest")
+	push := &PushOptions{Source: "app", Dest: image, Jobs: 2, DigestFile: digestFile}
+	if err := RunPushCommand(builder, push, &out); err != nil {
+		t.Fatalf("error pushing image: %v\n%s", err, out.String())
+	}
+
+	b, err := ioutil.ReadFile(digestFile)
+	if err != nil {
+		t.Fatalf("error reading digest file: %v", err)
+	}
+	pinned := strings.TrimSpace(string(b))
+	if !strings.HasPrefix(pinned, e.host()+"/team/app@sha256:") {
+		t.Fatalf("unexpected pinned image %q", pinned)
+	}
+	if !strings.Contains(out.String(), "Digest "+pinned) {
+		t.Errorf("push did not report digest %s:\n%s", pinned, out.String())
+	}
+
+	// Fetch into an empty store, both by tag and by the pushed digest
+	consumer := e.newFactory("consumer")
+	if err := RunFetchCommand(consumer, &FetchOptions{Source: image, Jobs: 2}, &out); err != nil {
+		t.Fatalf("error fetching image: %v\n%s", err, out.String())
+	}
+	if err := RunFetchCommand(consumer, &FetchOptions{Source: "docker://" + pinned, Jobs: 2}, &out); err != nil {
+		t.Fatalf("error fetching image by digest: %v\n%s", err, out.String())
+	}
+
+	store, err := consumer.LayerStore()
+	if err != nil {
+		t.Fatalf("error getting layer store: %v", err)
+	}
+	manifest, err := store.FindImageManifest("team/app", "v1", nil)
+	if err != nil || manifest == nil {
+		t.Fatalf("fetched image not found in store: %v", err)
+	}
+	for _, layer := range append(manifest.Layers, manifest.Config) {
+		blob, err := store.FindBlob("team/app", layer.Digest)
+		if err != nil || blob == nil {
+			t.Errorf("fetched blob %s not found in store: %v", layer.Digest, err)
+		}
+	}
+
+	// List what we pushed
+	out.Reset()
+	if err := RunTagsCommand(consumer, &TagsOptions{Repository: image}, &out); err != nil {
+		t.Fatalf("error listing tags: %v", err)
+	}
+	if out.String() != "v1\n" {
+		t.Errorf("unexpected tags %q", out.String())
+	}
+
+	out.Reset()
+	if err := RunCatalogCommand(consumer, &CatalogOptions{Registry: e.host()}, &out); err != nil {
+		t.Fatalf("error listing repositories: %v", err)
+	}
+	if out.String() != "team/app\n" {
+		t.Errorf("unexpected repositories %q", out.String())
+	}
+}
+
+func TestEndToEndRegistryDelete(t *testing.T) {
+	e := newTestEnvironment(t)
+	defer e.Close()
+
+	image := "docker://" + e.host() + "/app:preview-1"
+	var out bytes.Buffer
+
+	f := e.newFactory("builder")
+	if err := RunCreateLayerCommand(f, &CreateLayerOptions{Name: "app"}, &out); err != nil {
+		t.Fatalf("error creating layer: %v", err)
+	}
+	if err := RunPushCommand(f, &PushOptions{Source: "app", Dest: image, Jobs: 1}, &out); err != nil {
+		t.Fatalf("error pushing image: %v\n%s", err, out.String())
+	}
+
+	// Deletes are disabled by default, as in docker distribution
+	err := RunRegistryDeleteCommand(f, &RegistryDeleteOptions{Images: []string{image}}, &out)
+	if err == nil || !strings.Contains(err.Error(), "does not allow deletes") {
+		t.Errorf("expected error reporting that deletes are disabled, got %v", err)
+	}
+
+	e.server.AllowDelete = true
+
+	out.Reset()
+	if err := RunRegistryDeleteCommand(f, &RegistryDeleteOptions{Images: []string{image}, DryRun: true}, &out); err != nil {
+		t.Fatalf("error in dry run: %v", err)
+	}
+	if !strings.HasPrefix(out.String(), "Would delete "+image) {
+		t.Errorf("unexpected dry run output %q", out.String())
+	}
+
+	out.Reset()
+	if err := RunRegistryDeleteCommand(f, &RegistryDeleteOptions{Images: []string{image}}, &out); err != nil {
+		t.Fatalf("error deleting image: %v", err)
+	}
+	if !strings.HasPrefix(out.String(), "Deleted "+image) {
+		t.Errorf("unexpected delete output %q", out.String())
+	}
+
+	out.Reset()
+	if err := RunTagsCommand(f, &TagsOptions{Repository: image}, &out); err != nil {
+		t.Fatalf("error listing tags: %v", err)
+	}
+	if out.String() != "" {
+		t.Errorf("expected no tags after delete, got %q", out.String())
+	}
+}
+
+// layerTarHeaders builds the tarball for a layer, returning the headers of its entries
+func layerTarHeaders(t *testing.T, f Factory, name string) []*tar.Header {
+	store, err := f.LayerStore()
+	if err != nil {
+		t.Fatalf("error getting layer store: %v", err)
+	}
+	l, err := store.FindLayer(name)
+	if err != nil || l == nil {
+		t.Fatalf("layer %q not found: %v", name, err)
+	}
+	blob, _, err := l.BuildTar(store, "test")
+	if err != nil {
+		t.Fatalf("error building tar: %v", err)
+	}
+	in, err := blob.Open()
+	if err != nil {
+		t.Fatalf("error opening blob: %v", err)
+	}
+	defer in.Close()
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		t.Fatalf("error reading gzip: %v", err)
+	}
+
+	var headers []*tar.Header
+	r := tar.NewReader(gz)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("error reading tar: %v", err)
+		}
+		headers = append(headers, hdr)
+	}
+	return headers
+}
+
+// layerTarEntries builds the tarball for a layer, returning the names of its entries
+func layerTarEntries(t *testing.T, f Factory, name string) []string {
+	var names []string
+	for _, hdr := range layerTarHeaders(t, f, name) {
+		names = append(names, hdr.Name)
+	}
+	return names
+}
+
+func TestRmWritesWhiteouts(t *testing.T) {
+	e := newTestEnvironment(t)
+	defer e.Close()
+
+	var out bytes.Buffer
+	f := e.newFactory("builder")
+	if err := RunCreateLayerCommand(f, &CreateLayerOptions{Name: "app"}, &out); err != nil {
+		t.Fatalf("error creating layer: %v", err)
+	}
+
+	src := filepath.Join(e.dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "cache"), 0755); err != nil {
+		t.Fatalf("error creating dir: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "cache", "index"), []byte("index"), 0644); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	if err := RunCopyCommand(f, &CopyOptions{Source: src, Dest: "app:/var"}, &out); err != nil {
+		t.Fatalf("error copying files: %v", err)
+	}
+
+	// A directory with content in this layer must be deleted recursively
+	err := RunRmCommand(f, &RmOptions{Paths: []string{"app:/var/cache"}}, &out)
+	if err == nil || !strings.Contains(err.Error(), "non-empty directory") {
+		t.Errorf("expected error deleting non-empty directory, got %v", err)
+	}
+
+	if err := RunRmCommand(f, &RmOptions{Paths: []string{"app:/etc/motd", "app:/var/cache"}, Recursive: true}, &out); err != nil {
+		t.Fatalf("error deleting paths: %v", err)
+	}
+	if err := RunRmCommand(f, &RmOptions{Paths: []string{"app:/var/lib/apt/lists"}, Opaque: true}, &out); err != nil {
+		t.Fatalf("error making directory opaque: %v", err)
+	}
+	if err := RunRmCommand(f, &RmOptions{Paths: []string{"app:/"}}, &out); err == nil {
+		t.Errorf("expected error deleting the root directory")
+	}
+
+	// Copying a file back in replaces the deletion of its parent with an opaque directory
+	if err := RunCopyCommand(f, &CopyOptions{Source: filepath.Join(src, "cache", "index"), Dest: "app:/var/cache/new"}, &out); err != nil {
+		t.Fatalf("error copying file: %v", err)
+	}
+
+	expected := []string{
+		"etc/.wh.motd",
+		"var/cache/.wh..wh..opq",
+		"var/lib/apt/lists/.wh..wh..opq",
+		"var/",
+		"var/cache/",
+		"var/cache/new",
+		"var/lib/",
+		"var/lib/apt/",
+		"var/lib/apt/lists/",
+	}
+	if names := layerTarEntries(t, f, "app"); !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected tar entries %v", names)
+	}
+}
+
+func TestCopyRejectsEscapingPaths(t *testing.T) {
+	e := newTestEnvironment(t)
+	defer e.Close()
+
+	var out bytes.Buffer
+	f := e.newFactory("builder")
+	if err := RunCreateLayerCommand(f, &CreateLayerOptions{Name: "app"}, &out); err != nil {
+		t.Fatalf("error creating layer: %v", err)
+	}
+
+	src := filepath.Join(e.dir, "passwd")
+	if err := ioutil.WriteFile(src, []byte("root::0:0::/:/bin/sh\n"), 0644); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+
+	err := RunCopyCommand(f, &CopyOptions{Source: src, Dest: "app:../../../../passwd"}, &out)
+	if err == nil || !strings.Contains(err.Error(), "outside the root directory") {
+		t.Errorf("expected error copying to a path outside the layer, got %v", err)
+	}
+
+	// Whiteout names would delete files from the layers below
+	for _, dest := range []string{"app:/etc/.wh.motd", "app:/etc/.wh..wh..opq"} {
+		err := RunCopyCommand(f, &CopyOptions{Source: src, Dest: dest}, &out)
+		if err == nil || !strings.Contains(err.Error(), "reserved for whiteouts") {
+			t.Errorf("expected error copying to %s, got %v", dest, err)
+		}
+	}
+	whiteoutLink := filepath.Join(e.dir, "whiteout-link")
+	if err := os.Symlink("motd", whiteoutLink); err != nil {
+		t.Fatalf("error creating symlink: %v", err)
+	}
+	err = RunCopyCommand(f, &CopyOptions{Source: whiteoutLink, Dest: "app:/etc/.wh.motd"}, &out)
+	if err == nil || !strings.Contains(err.Error(), "reserved for whiteouts") {
+		t.Errorf("expected error copying a symlink to a whiteout name, got %v", err)
+	}
+	for _, name := range layerTarEntries(t, f, "app") {
+		if strings.Contains(name, ".wh.") {
+			t.Errorf("unexpected whiteout entry %s", name)
+		}
+	}
+
+	// A symlink to a host directory is interpreted within the layer, as in the image
+	hostDir := filepath.Join(e.dir, "host")
+	if err := os.MkdirAll(hostDir, 0755); err != nil {
+		t.Fatalf("error creating dir: %v", err)
+	}
+	link := filepath.Join(e.dir, "link")
+	if err := os.Symlink(hostDir, link); err != nil {
+		t.Fatalf("error creating symlink: %v", err)
+	}
+	if err := RunCopyCommand(f, &CopyOptions{Source: link, Dest: "app:/host"}, &out); err != nil {
+		t.Fatalf("error copying symlink: %v", err)
+	}
+	if err := RunCopyCommand(f, &CopyOptions{Source: src, Dest: "app:/host/passwd"}, &out); err != nil {
+		t.Fatalf("error copying through symlink: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(hostDir, "passwd")); !os.IsNotExist(err) {
+		t.Errorf("copy through symlink wrote outside the layer: %v", err)
+	}
+	found := false
+	for _, name := range layerTarEntries(t, f, "app") {
+		if name == strings.TrimPrefix(hostDir, "/")+"/passwd" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected the file to be written to the symlink target within the layer")
+	}
+}
+
+func TestChown(t *testing.T) {
+	e := newTestEnvironment(t)
+	defer e.Close()
+
+	var out bytes.Buffer
+	f := e.newFactory("builder")
+	if err := RunCreateLayerCommand(f, &CreateLayerOptions{Name: "app"}, &out); err != nil {
+		t.Fatalf("error creating layer: %v", err)
+	}
+
+	src := filepath.Join(e.dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "data"), 0755); err != nil {
+		t.Fatalf("error creating dir: %v", err)
+	}
+	for _, name := range []string{"app.conf", "data/state"} {
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(name), 0644); err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+	}
+
+	if err := RunCopyCommand(f, &CopyOptions{Source: src, Dest: "app:/srv", Chown: "1000"}, &out); err != nil {
+		t.Fatalf("error copying files: %v", err)
+	}
+	if err := RunCopyCommand(f, &CopyOptions{Source: filepath.Join(src, "app.conf"), Dest: "app:/etc/app.conf"}, &out); err != nil {
+		t.Fatalf("error copying file: %v", err)
+	}
+	if err := RunChownCommand(f, &ChownOptions{Owner: "33:44", Paths: []string{"app:/srv/data"}, Recursive: true}, &out); err != nil {
+		t.Fatalf("error changing owner: %v", err)
+	}
+	// Copying over a file without --chown makes it owned by root again
+	if err := RunCopyCommand(f, &CopyOptions{Source: filepath.Join(src, "data", "state"), Dest: "app:/srv/data/state"}, &out); err != nil {
+		t.Fatalf("error copying file: %v", err)
+	}
+
+	if err := RunCopyCommand(f, &CopyOptions{Source: src, Dest: "app:/x", Chown: "app:app"}, &out); err == nil {
+		t.Errorf("expected error for non-numeric owner")
+	}
+	if err := RunChownCommand(f, &ChownOptions{Owner: "0:0", Paths: []string{"app:/missing"}}, &out); err == nil {
+		t.Errorf("expected error changing owner of a missing file")
+	}
+
+	expected := map[string]string{
+		"etc/":           "0:0 root:root",
+		"etc/app.conf":   "0:0 root:root",
+		"srv/":           "1000:1000 :",
+		"srv/app.conf":   "1000:1000 :",
+		"srv/data/":      "33:44 :",
+		"srv/data/state": "0:0 root:root",
+	}
+	actual := make(map[string]string)
+	for _, hdr := range layerTarHeaders(t, f, "app") {
+		actual[hdr.Name] = fmt.Sprintf("%d:%d %s:%s", hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected owners %v", actual)
+	}
+}
+
+func TestEndToEndFetchTwoPlatforms(t *testing.T) {
+	e := newTestEnvironment(t)
+	defer e.Close()
+
+	image := "docker://" + e.host() + "/team/base:v1"
+	var out bytes.Buffer
+
+	// Push a multi-arch image, with a different layer for each platform
+	builder := e.newFactory("builder")
+	for _, arch := range []string{"amd64", "arm64"} {
+		e.createLayerWithFile(builder, arch, "/arch", arch)
+	}
+	push := &PushOptions{Dest: image, Jobs: 2, Platforms: []string{"linux/amd64=amd64", "linux/arm64=arm64"}}
+	if err := RunPushCommand(builder, push, &out); err != nil {
+		t.Fatalf("error pushing image: %v\n%s", err, out.String())
+	}
+
+	// Fetching the second platform must not replace the first
+	consumer := e.newFactory("consumer")
+	for _, platform := range []string{"linux/amd64", "linux/arm64"} {
+		if err := RunFetchCommand(consumer, &FetchOptions{Source: image, Platform: platform, Jobs: 2}, &out); err != nil {
+			t.Fatalf("error fetching %s: %v\n%s", platform, err, out.String())
+		}
+	}
+
+	store, err := consumer.LayerStore()
+	if err != nil {
+		t.Fatalf("error getting layer store: %v", err)
+	}
+	digests := make(map[string]bool)
+	for _, arch := range []string{"amd64", "arm64"} {
+		manifest, err := store.FindImageManifest("team/base", "v1", &layers.Platform{OS: "linux", Architecture: arch})
+		if err != nil || manifest == nil {
+			t.Fatalf("image for %s not found in store: %v", arch, err)
+		}
+		if manifest.Platform == nil || manifest.Platform.Architecture != arch {
+			t.Errorf("expected image for %s, got %v", arch, manifest.Platform)
+		}
+		digests[manifest.Digest] = true
+
+		// The platform image is also recorded by its own digest
+		byDigest, err := store.FindImageManifest("team/base", manifest.Digest, nil)
+		if err != nil || byDigest == nil || byDigest.Platform.Architecture != arch {
+			t.Errorf("image for %s not found by digest %s: %v", arch, manifest.Digest, err)
+		}
+	}
+	if len(digests) != 2 {
+		t.Errorf("expected a different image for each platform, got %v", digests)
+	}
+
+	if _, err := store.FindImageManifest("team/base", "v1", nil); err == nil || !strings.Contains(err.Error(), "several platforms") {
+		t.Errorf("expected error looking up a multi-platform image without a platform, got %v", err)
+	}
+	if manifest, err := store.FindImageManifest("team/base", "v1", &layers.Platform{OS: "linux", Architecture: "s390x"}); err != nil || manifest != nil {
+		t.Errorf("expected no image for an unfetched platform, got %v, %v", manifest, err)
+	}
+}
+
+func TestEndToEndPushTwoPlatformsOnTaggedBase(t *testing.T) {
+	e := newTestEnvironment(t)
+	defer e.Close()
+
+	baseImage := "docker://" + e.host() + "/team/base:v1"
+	image := "docker://" + e.host() + "/team/app:v1"
+	var out bytes.Buffer
+
+	publisher := e.newFactory("publisher")
+	for _, arch := range []string{"amd64", "arm64"} {
+		e.createLayerWithFile(publisher, "base-"+arch, "/arch", arch)
+	}
+	push := &PushOptions{Dest: baseImage, Jobs: 2, Platforms: []string{"linux/amd64=base-amd64", "linux/arm64=base-arm64"}}
+	if err := RunPushCommand(publisher, push, &out); err != nil {
+		t.Fatalf("error pushing base image: %v\n%s", err, out.String())
+	}
+
+	// Build an image for each platform on the same tagged base
+	builder := e.newFactory("builder")
+	for _, arch := range []string{"amd64", "arm64"} {
+		if err := RunFetchCommand(builder, &FetchOptions{Source: baseImage, Platform: "linux/" + arch, Jobs: 2}, &out); err != nil {
+			t.Fatalf("error fetching base image: %v\n%s", err, out.String())
+		}
+		e.createLayerWithFile(builder, arch, "/app", "app for "+arch)
+		if err := RunSetCommand(builder, &SetOptions{Layer: arch, Key: "base", Value: []string{baseImage}}, &out); err != nil {
+			t.Fatalf("error setting base: %v", err)
+		}
+	}
+	push = &PushOptions{Dest: image, Jobs: 2, Platforms: []string{"linux/amd64=amd64", "linux/arm64=arm64"}}
+	if err := RunPushCommand(builder, push, &out); err != nil {
+		t.Fatalf("error pushing image: %v\n%s", err, out.String())
+	}
+
+	store, err := builder.LayerStore()
+	if err != nil {
+		t.Fatalf("error getting layer store: %v", err)
+	}
+	r := &docker.Registry{URL: e.http.URL}
+	auth := &docker.Auth{}
+	list, err := r.GetManifest(auth, "team/app", "v1")
+	if err != nil {
+		t.Fatalf("error reading manifest list: %v", err)
+	}
+	if !list.IsList() || len(list.Manifests) != 2 {
+		t.Fatalf("expected a manifest list with two platforms, got %s", list)
+	}
+
+	for _, arch := range []string{"amd64", "arm64"} {
+		platform := &layers.Platform{OS: "linux", Architecture: arch}
+		entry := list.FindPlatform(&docker.Platform{OS: "linux", Architecture: arch})
+		if entry == nil {
+			t.Fatalf("no entry for %s in %s", arch, list)
+		}
+		manifest, err := r.GetManifest(auth, "team/app", entry.Digest)
+		if err != nil {
+			t.Fatalf("error reading manifest for %s: %v", arch, err)
+		}
+
+		// Each image is built on the base for its own platform
+		base, err := store.FindImageManifest("team/base", "v1", platform)
+		if err != nil || base == nil {
+			t.Fatalf("base image for %s not found: %v", arch, err)
+		}
+		if len(manifest.Layers) != 2 || manifest.Layers[0].Digest != base.Layers[0].Digest {
+			t.Errorf("image for %s is not built on the %s base: %s", arch, arch, manifest)
+		}
+
+		var config bytes.Buffer
+		if _, err := r.DownloadBlob(auth, "team/app", manifest.Config.Digest, &config); err != nil {
+			t.Fatalf("error downloading config: %v", err)
+		}
+		if !strings.Contains(config.String(), `"architecture":"`+arch+`"`) {
+			t.Errorf("unexpected config for %s: %s", arch, config.String())
+		}
+	}
+}
@@ -2,17 +2,29 @@ package cmd
 
 import (
 	"path/filepath"
+	"sync"
 
+	"kope.io/build/pkg/docker"
 	"kope.io/build/pkg/layers"
 )
 
 type Factory interface {
 	LayerStore() (layers.Store, error)
+
+	// Registry returns a client for the registry host (e.g. DockerImageSpec.Host), configured with
+	// any TLS or plain-http settings for that registry.  An empty host means Docker Hub.
+	Registry(host string) (*docker.Registry, error)
+
+	// Mirrors returns the mirrors to try before the registry host when fetching, in order
+	Mirrors(host string) ([]*docker.Registry, error)
 }
 
 type fsFactory struct {
 	dir        string
 	layerStore layers.Store
+
+	mutex            sync.Mutex
+	registriesConfig *docker.RegistriesConfig
 }
 
 var _ Factory = &fsFactory{}
@@ -30,3 +42,34 @@ func newFSFactory(dir string) Factory {
 func (f *fsFactory) LayerStore() (layers.Store, error) {
 	return f.layerStore, nil
 }
+
+// Registry builds the registry using the configuration in registries.json in the store directory
+func (f *fsFactory) Registry(host string) (*docker.Registry, error) {
+	config, err := f.loadRegistriesConfig()
+	if err != nil {
+		return nil, err
+	}
+	return config.NewRegistry(host)
+}
+
+func (f *fsFactory) Mirrors(host string) ([]*docker.Registry, error) {
+	config, err := f.loadRegistriesConfig()
+	if err != nil {
+		return nil, err
+	}
+	return config.NewMirrors(host)
+}
+
+func (f *fsFactory) loadRegistriesConfig() (*docker.RegistriesConfig, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.registriesConfig == nil {
+		config, err := docker.LoadRegistriesConfig(filepath.Join(f.dir, "registries.json"))
+		if err != nil {
+			return nil, err
+		}
+		f.registriesConfig = config
+	}
+	return f.registriesConfig, nil
+}
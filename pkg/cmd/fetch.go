@@ -1,19 +1,28 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
+	"strings"
 
 	"github.com/golang/glog"
 	"github.com/spf13/cobra"
 	"kope.io/build/pkg/docker"
+	"kope.io/build/pkg/imageconfig"
 	"kope.io/build/pkg/layers"
+	"kope.io/build/pkg/verify"
 )
 
 type FetchOptions struct {
 	Source string
+
+	// Platform selects the image from a manifest list, in the form os/arch[/variant]
+	Platform string
+
+	// Jobs is the number of layers to download concurrently
+	Jobs int
 }
 
 func BuildFetchCommand(f Factory, out io.Writer) *cobra.Command {
@@ -29,6 +38,9 @@ func BuildFetchCommand(f Factory, out io.Writer) *cobra.Command {
 		},
 	}
 
+	cmd.Flags().StringVar(&options.Platform, "platform", "", "platform to fetch from a multi-arch image, as os/arch[/variant]; defaults to the host")
+	cmd.Flags().IntVar(&options.Jobs, "jobs", DefaultJobs, "number of layers to download concurrently")
+
 	return cmd
 }
 
@@ -47,48 +59,136 @@ func RunFetchCommand(factory Factory, options *FetchOptions, out io.Writer) erro
 		return err
 	}
 
+	platform := defaultPlatform()
+	if options.Platform != "" {
+		platform, err = ParsePlatform(options.Platform)
+		if err != nil {
+			return err
+		}
+	}
+
 	glog.Infof("Querying registry for image %s", spec)
 
-	registry := &docker.Registry{
-		URL: spec.Host,
+	sources, err := buildFetchSources(factory, spec.Host)
+	if err != nil {
+		return err
 	}
-	auth := &docker.Auth{}
 
 	{
-		dockerManifest, err := registry.GetManifest(auth, spec.Repository, spec.Tag)
+		// If the spec is pinned by digest, GetManifest verifies the manifest against it
+		dockerManifest, err := getManifest(sources, spec.Repository, spec.Reference())
 		if err != nil {
 			return fmt.Errorf("error getting manifest: %v", err)
 		}
 		glog.Infof("response: %s", dockerManifest)
 
-		blob, err := ensureBlob(out, registry, auth, spec.Repository, dockerManifest.Config.Digest, dockerManifest.Config.Size, layerStore)
+		var imagePlatform *layers.Platform
+		listDigest := ""
+		if dockerManifest.IsList() {
+			listDigest = dockerManifest.Digest()
+			entry := dockerManifest.FindPlatform(&docker.Platform{
+				OS:           platform.OS,
+				Architecture: platform.Architecture,
+				Variant:      platform.Variant,
+			})
+			if entry == nil {
+				var available []string
+				for _, m := range dockerManifest.Manifests {
+					if m.Platform != nil {
+						available = append(available, m.Platform.String())
+					}
+				}
+				return fmt.Errorf("image %s does not have an entry for platform %s (available: %s)", spec, platform, strings.Join(available, ", "))
+			}
+
+			glog.Infof("selected manifest %s for platform %s", entry.Digest, entry.Platform)
+			imagePlatform = &layers.Platform{
+				OS:           entry.Platform.OS,
+				Architecture: entry.Platform.Architecture,
+				Variant:      entry.Platform.Variant,
+			}
+
+			dockerManifest, err = getManifest(sources, spec.Repository, entry.Digest)
+			if err != nil {
+				return fmt.Errorf("error getting manifest for platform %s: %v", platform, err)
+			}
+			if dockerManifest.IsList() {
+				return fmt.Errorf("manifest list entry %s for %s was itself a manifest list", entry.Digest, spec)
+			}
+		}
+
+		blob, err := ensureBlob(out, sources, spec.Repository, dockerManifest.Config.Digest, dockerManifest.Config.Size, layerStore)
 		if err != nil {
 			return err
 		}
 
+		if imagePlatform == nil {
+			// Not a manifest list; the image config tells us the platform
+			imagePlatform, err = readImagePlatform(blob)
+			if err != nil {
+				return err
+			}
+			if options.Platform != "" && (imagePlatform.OS != platform.OS || imagePlatform.Architecture != platform.Architecture) {
+				glog.Warningf("image %s is for platform %s, not the requested %s", spec, imagePlatform, platform)
+			}
+		}
+
 		manifest := &layers.ImageManifest{
 			Repository: spec.Repository,
 			Tag:        spec.Tag,
+			Digest:     dockerManifest.Digest(),
+			Platform:   imagePlatform,
 			Config: layers.LayerManifest{
 				Digest: blob.Digest(),
 				Size:   blob.Length(),
 			},
 		}
 
-		for _, layer := range dockerManifest.Layers {
-			blob, err := ensureBlob(out, registry, auth, spec.Repository, layer.Digest, layer.Size, layerStore)
-			if err != nil {
-				return err
-			}
+		// Download the layers concurrently; the layer order comes from the manifest, not from completion order
+		manifest.Layers = make([]layers.LayerManifest, len(dockerManifest.Layers))
+		syncOut := &syncWriter{w: out}
+		var tasks []func() error
+		for i := range dockerManifest.Layers {
+			i := i
+			layer := dockerManifest.Layers[i]
+			tasks = append(tasks, func() error {
+				blob, err := ensureBlob(syncOut, sources, spec.Repository, layer.Digest, layer.Size, layerStore)
+				if err != nil {
+					return err
+				}
 
-			manifest.Layers = append(manifest.Layers, layers.LayerManifest{
-				Digest: blob.Digest(),
-				Size:   blob.Length(),
+				manifest.Layers[i] = layers.LayerManifest{
+					Digest: blob.Digest(),
+					Size:   blob.Length(),
+				}
+				return nil
 			})
 		}
+		if err := runJobs(options.Jobs, tasks); err != nil {
+			return err
+		}
+
+		if listDigest != "" {
+			// Keep the images we have for the list's other platforms; the tag (or list digest) resolves by platform
+			if err := layerStore.WritePlatformManifest(spec.Repository, spec.Reference(), listDigest, manifest); err != nil {
+				return fmt.Errorf("error storing image manifest: %v", err)
+			}
+			if listDigest != spec.Reference() {
+				if err := layerStore.WritePlatformManifest(spec.Repository, listDigest, listDigest, manifest); err != nil {
+					return fmt.Errorf("error storing image manifest: %v", err)
+				}
+			}
+		} else {
+			if err := layerStore.WriteImageManifest(spec.Repository, spec.Reference(), manifest); err != nil {
+				return fmt.Errorf("error storing image manifest: %v", err)
+			}
+		}
 
-		if err := layerStore.WriteImageManifest(spec.Repository, spec.Tag, manifest); err != nil {
-			return fmt.Errorf("error storing image manifest: %v", err)
+		// Also record the image by its own digest, so it can be used as a digest-pinned base
+		if manifest.Digest != spec.Reference() {
+			if err := layerStore.WriteImageManifest(spec.Repository, manifest.Digest, manifest); err != nil {
+				return fmt.Errorf("error storing image manifest: %v", err)
+			}
 		}
 	}
 
@@ -96,7 +196,83 @@ func RunFetchCommand(factory Factory, options *FetchOptions, out io.Writer) erro
 	return nil
 }
 
-func ensureBlob(out io.Writer, registry *docker.Registry, auth *docker.Auth, repository string, digest string, size int64, layerStore layers.Store) (layers.Blob, error) {
+// fetchSource is a registry we can fetch images from: either a mirror, or the upstream registry
+type fetchSource struct {
+	registry *docker.Registry
+	auth     *docker.Auth
+}
+
+// buildFetchSources returns the configured mirrors for the registry host, followed by the registry itself
+func buildFetchSources(factory Factory, host string) ([]*fetchSource, error) {
+	mirrors, err := factory.Mirrors(host)
+	if err != nil {
+		return nil, err
+	}
+	upstream, err := factory.Registry(host)
+	if err != nil {
+		return nil, err
+	}
+
+	var sources []*fetchSource
+	for _, registry := range append(mirrors, upstream) {
+		sources = append(sources, &fetchSource{
+			registry: registry,
+			auth:     &docker.Auth{HttpClient: registry.HttpClient},
+		})
+	}
+	return sources, nil
+}
+
+// getManifest gets the manifest from the first source that has it, falling back through the mirrors to the upstream registry
+func getManifest(sources []*fetchSource, repository string, reference string) (*docker.ManifestV2, error) {
+	for i, source := range sources {
+		manifest, err := source.registry.GetManifest(source.auth, repository, reference)
+		if err == nil {
+			return manifest, nil
+		}
+		if i == len(sources)-1 {
+			return nil, err
+		}
+		glog.Warningf("error getting manifest from mirror %s, trying next source: %v", source.registry.URL, err)
+	}
+	return nil, fmt.Errorf("no registries to fetch from")
+}
+
+// readImagePlatform reads the platform from an image config blob
+func readImagePlatform(configBlob layers.Blob) (*layers.Platform, error) {
+	r, err := configBlob.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config blob %s: %v", configBlob.Digest(), err)
+	}
+
+	config := &imageconfig.ImageConfig{}
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, fmt.Errorf("error parsing config blob %s: %v", configBlob.Digest(), err)
+	}
+
+	return &layers.Platform{
+		OS:           config.OS,
+		Architecture: config.Architecture,
+		Variant:      config.Variant,
+	}, nil
+}
+
+// maxDownloadResumes is the number of times we will resume an interrupted blob download, before giving up
+const maxDownloadResumes = 5
+
+// maxDownloadAttempts is the number of times we will download a blob from the upstream registry when it fails verification
+const maxDownloadAttempts = 2
+
+// ensureBlob downloads the blob into the store, unless we already have it.  The blob is recorded under repository,
+// whichever source it comes from.  If the downloaded data does not match the digest or size, we discard it and download
+// again from the next source, so that a mirror serving bad data doesn't stop us fetching from the upstream registry.
+func ensureBlob(out io.Writer, sources []*fetchSource, repository string, digest string, size int64, layerStore layers.Store) (layers.Blob, error) {
 	blob, err := layerStore.FindBlob(repository, digest)
 	if err != nil {
 		return nil, fmt.Errorf("error checking for blob: %v", err)
@@ -105,39 +281,100 @@ func ensureBlob(out io.Writer, registry *docker.Registry, auth *docker.Auth, rep
 		glog.Infof("already have blob %s", digest)
 		return blob, nil
 	}
-	mb := size / (1024 * 1024)
-	fmt.Fprintf(out, "Downloading layer %s (%d MB)\n", digest, mb)
 
-	tmpfile, err := ioutil.TempFile("", "blob")
+	attempt := 0
+	start := 0
+	for {
+		blob, sourceIndex, err := downloadBlob(out, sources, start, repository, digest, size, layerStore)
+		if err == nil {
+			return blob, nil
+		}
+
+		if !verify.IsDigestMismatch(err) && !verify.IsSizeMismatch(err) {
+			return nil, err
+		}
+		if sourceIndex+1 < len(sources) {
+			glog.Warningf("blob %s from mirror %s failed verification, trying next source: %v", digest, sources[sourceIndex].registry.URL, err)
+			start = sourceIndex + 1
+			continue
+		}
+
+		attempt++
+		if attempt >= maxDownloadAttempts {
+			return nil, fmt.Errorf("downloaded blob %s failed verification: %v", digest, err)
+		}
+		glog.Warningf("downloaded blob %s failed verification, downloading again: %v", digest, err)
+		start = sourceIndex
+	}
+}
+
+// downloadBlob downloads the blob into the store's staging area, and then verifies it and adds it to the store.
+// If the download is interrupted, we resume it with a range request, either here or on the next fetch.
+// Errors which resuming won't fix, such as a 404 for the blob, are returned without retrying.
+// We start with sources[start]; if a source fails without sending any data, we move on to the next source.
+// The index of the source we downloaded from is returned, so that if the blob fails verification we can try another.
+func downloadBlob(out io.Writer, sources []*fetchSource, start int, repository string, digest string, size int64, layerStore layers.Store) (layers.Blob, int, error) {
+	staged, err := layerStore.StageBlob(repository, digest, size)
 	if err != nil {
-		return nil, fmt.Errorf("error creating temp file: %v", err)
+		return nil, start, err
 	}
 	defer func() {
-		err := tmpfile.Close()
-		if err != nil {
-			glog.Warningf("error closing temp file %q: %v", tmpfile.Name(), err)
-		}
-		err = os.Remove(tmpfile.Name())
+		err := staged.Close()
 		if err != nil {
-			glog.Warningf("error removing temp file %q: %v", tmpfile.Name(), err)
+			glog.Warningf("error closing staged blob %s: %v", digest, err)
 		}
 	}()
 
-	n, err := registry.DownloadBlob(auth, repository, digest, tmpfile)
+	// Another job may have downloaded the same blob while we waited for the staging area
+	blob, err := layerStore.FindBlob(repository, digest)
 	if err != nil {
-		return nil, fmt.Errorf("error downloading blob %s: %v", digest, err)
+		return nil, start, fmt.Errorf("error checking for blob: %v", err)
+	}
+	if blob != nil {
+		glog.Infof("already have blob %s", digest)
+		return blob, start, nil
 	}
 
-	glog.V(2).Infof("Downloaded blob %s size=%d", digest, n)
-
-	_, err = tmpfile.Seek(0, 0)
-	if err != nil {
-		return nil, fmt.Errorf("error seeking to start of temp file: %v", err)
+	mb := size / (1024 * 1024)
+	if staged.Size() > 0 {
+		fmt.Fprintf(out, "Resuming download of layer %s at %d of %d MB\n", digest, staged.Size()/(1024*1024), mb)
+	} else {
+		fmt.Fprintf(out, "Downloading layer %s (%d MB)\n", digest, mb)
 	}
 
-	blob, err = layerStore.AddBlob(repository, digest, tmpfile)
-	if err != nil {
-		return nil, fmt.Errorf("error adding layer blob: %v", err)
+	resumes := 0
+	sourceIndex := start
+	for {
+		source := sources[sourceIndex]
+
+		// The download may have failed part way; the staged size tells us where to resume
+		offset := staged.Size()
+		n, err := source.registry.DownloadBlobFrom(source.auth, repository, digest, offset, staged)
+		glog.V(2).Infof("Downloaded %d bytes of blob %s from offset %d", n, digest, offset)
+		if err == nil || verify.IsSizeMismatch(err) {
+			// If the registry sent too much data, resuming won't help; Commit will reject the blob if needed
+			break
+		}
+
+		if n == 0 && sourceIndex+1 < len(sources) {
+			glog.Warningf("error downloading blob %s from mirror %s, trying next source: %v", digest, source.registry.URL, err)
+			sourceIndex++
+			continue
+		}
+
+		// Resuming only helps if the transfer was cut off; a missing blob or a permission error won't go away
+		if n == 0 && !docker.IsTransient(err) {
+			return nil, sourceIndex, fmt.Errorf("error downloading blob %s: %v", digest, err)
+		}
+
+		if resumes >= maxDownloadResumes {
+			return nil, sourceIndex, fmt.Errorf("error downloading blob %s (%d of %d bytes downloaded; fetch again to resume): %v", digest, staged.Size(), size, err)
+		}
+		resumes++
+		glog.Warningf("error downloading blob %s, resuming from offset %d: %v", digest, staged.Size(), err)
 	}
-	return blob, nil
+
+	// Commit returns the typed verification errors unwrapped, so ensureBlob can retry
+	blob, err = staged.Commit()
+	return blob, sourceIndex, err
 }
@@ -0,0 +1,342 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kope.io/build/pkg/docker"
+)
+
+// blobServer serves blobs for the repository app, recording the requests it receives
+type blobServer struct {
+	mutex    sync.Mutex
+	blobs    map[string][]byte
+	status   map[string]int
+	requests []string
+}
+
+func (s *blobServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.requests = append(s.requests, req.Method+" "+req.URL.Path)
+
+	digest := strings.TrimPrefix(req.URL.Path, "/v2/app/blobs/")
+	if status := s.status[digest]; status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+	data, found := s.blobs[digest]
+	if !found {
+		w.WriteHeader(404)
+		return
+	}
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+	w.Write(data)
+}
+
+// requested returns the number of requests for the blob
+func (s *blobServer) requested(digest string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	n := 0
+	for _, r := range s.requests {
+		if strings.HasSuffix(r, "/blobs/"+digest) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestFetchFallsBackFromMirrors(t *testing.T) {
+	e := newTestEnvironment(t)
+	defer e.Close()
+
+	cached := []byte("blob in the mirror")
+	missing := []byte("blob the mirror doesn't have")
+	broken := []byte("blob the mirror fails to serve")
+
+	mirror := &blobServer{
+		blobs:  map[string][]byte{sha256Bytes(cached): cached},
+		status: map[string]int{sha256Bytes(broken): 503},
+	}
+	upstream := &blobServer{
+		blobs: map[string][]byte{
+			sha256Bytes(cached):  cached,
+			sha256Bytes(missing): missing,
+			sha256Bytes(broken):  broken,
+		},
+	}
+	mirrorServer := httptest.NewServer(mirror)
+	defer mirrorServer.Close()
+	upstreamServer := httptest.NewServer(upstream)
+	defer upstreamServer.Close()
+
+	mirrorHost := strings.TrimPrefix(mirrorServer.URL, "http://")
+	upstreamHost := strings.TrimPrefix(upstreamServer.URL, "http://")
+
+	dir := filepath.Join(e.dir, "store")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("error creating dir: %v", err)
+	}
+	config := fmt.Sprintf(`{"registries": {%q: {"plainHTTP": true, "mirrors": [%q]}, %q: {"plainHTTP": true}}, "certsDirs": []}`,
+		upstreamHost, "http://"+mirrorHost, mirrorHost)
+	if err := ioutil.WriteFile(filepath.Join(dir, "registries.json"), []byte(config), 0644); err != nil {
+		t.Fatalf("error writing registries config: %v", err)
+	}
+	f := newFSFactory(dir)
+
+	sources, err := buildFetchSources(f, "https://"+upstreamHost)
+	if err != nil {
+		t.Fatalf("error building fetch sources: %v", err)
+	}
+	if len(sources) != 2 || sources[0].registry.URL != mirrorServer.URL || sources[1].registry.URL != upstreamServer.URL {
+		t.Fatalf("expected the mirror and then upstream, got %v", sources)
+	}
+	// Don't wait long before retrying the mirror's 5xx
+	sources[0].registry.RetryBackoff = time.Millisecond
+
+	store, err := f.LayerStore()
+	if err != nil {
+		t.Fatalf("error getting layer store: %v", err)
+	}
+
+	grid := []struct {
+		Name     string
+		Data     []byte
+		Upstream int
+	}{
+		{Name: "cached", Data: cached, Upstream: 0},
+		{Name: "missing", Data: missing, Upstream: 1},
+		{Name: "broken", Data: broken, Upstream: 1},
+	}
+	for _, g := range grid {
+		digest := sha256Bytes(g.Data)
+		var out bytes.Buffer
+		blob, err := ensureBlob(&out, sources, "app", digest, int64(len(g.Data)), store)
+		if err != nil {
+			t.Errorf("%s: error fetching blob: %v", g.Name, err)
+			continue
+		}
+
+		r, err := blob.Open()
+		if err != nil {
+			t.Fatalf("%s: error opening blob: %v", g.Name, err)
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(data, g.Data) {
+			t.Errorf("%s: fetched %q, expected %q (%v)", g.Name, data, g.Data, err)
+		}
+
+		// The mirror is always tried first
+		if mirror.requested(digest) == 0 {
+			t.Errorf("%s: mirror was not tried", g.Name)
+		}
+		if n := upstream.requested(digest); n != g.Upstream {
+			t.Errorf("%s: expected %d requests upstream, got %d", g.Name, g.Upstream, n)
+		}
+	}
+}
+
+func TestEndToEndFetchSkipsCorruptingMirror(t *testing.T) {
+	e := newTestEnvironment(t)
+	defer e.Close()
+
+	image := "docker://" + e.host() + "/team/app:v1"
+	var out bytes.Buffer
+
+	builder := e.newFactory("builder")
+	e.createLayerWithFile(builder, "app", "/hello.txt", "hello world\n")
+	if err := RunPushCommand(builder, &PushOptions{Source: "app", Dest: image, Jobs: 1}, &out); err != nil {
+		t.Fatalf("error pushing image: %v\n%s", err, out.String())
+	}
+
+	// The mirror proxies the registry, but flips a byte of every blob it serves
+	upstreamURL, err := url.Parse(e.http.URL)
+	if err != nil {
+		t.Fatalf("error parsing url: %v", err)
+	}
+	var mutex sync.Mutex
+	corrupted := 0
+	proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if !strings.Contains(resp.Request.URL.Path, "/blobs/") || resp.StatusCode != 200 {
+			return nil
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if len(data) != 0 {
+			data[0] ^= 0xff
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+		mutex.Lock()
+		corrupted++
+		mutex.Unlock()
+		return nil
+	}
+	mirrorServer := httptest.NewServer(proxy)
+	defer mirrorServer.Close()
+	mirrorHost := strings.TrimPrefix(mirrorServer.URL, "http://")
+
+	dir := filepath.Join(e.dir, "consumer")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("error creating dir: %v", err)
+	}
+	config := fmt.Sprintf(`{"registries": {%q: {"plainHTTP": true, "mirrors": [%q]}, %q: {"plainHTTP": true}}, "certsDirs": []}`,
+		e.host(), "http://"+mirrorHost, mirrorHost)
+	if err := ioutil.WriteFile(filepath.Join(dir, "registries.json"), []byte(config), 0644); err != nil {
+		t.Fatalf("error writing registries config: %v", err)
+	}
+	consumer := newFSFactory(dir)
+
+	if err := RunFetchCommand(consumer, &FetchOptions{Source: image, Jobs: 1}, &out); err != nil {
+		t.Fatalf("error fetching image: %v\n%s", err, out.String())
+	}
+
+	mutex.Lock()
+	if corrupted == 0 {
+		t.Errorf("expected blobs to be requested from the mirror first")
+	}
+	mutex.Unlock()
+
+	store, err := consumer.LayerStore()
+	if err != nil {
+		t.Fatalf("error getting layer store: %v", err)
+	}
+	manifest, err := store.FindImageManifest("team/app", "v1", nil)
+	if err != nil || manifest == nil {
+		t.Fatalf("fetched image not found in store: %v", err)
+	}
+	// The store verifies blobs as they are added, so these came from upstream
+	for _, layer := range append(manifest.Layers, manifest.Config) {
+		blob, err := store.FindBlob("team/app", layer.Digest)
+		if err != nil || blob == nil {
+			t.Errorf("fetched blob %s not found in store: %v", layer.Digest, err)
+		}
+	}
+}
+
+func TestDownloadBlobResumesOnlyTransientErrors(t *testing.T) {
+	e := newTestEnvironment(t)
+	defer e.Close()
+
+	forbidden := []byte("blob we may not read")
+	missing := []byte("blob the registry doesn't have")
+	unavailable := []byte("blob the registry fails to serve")
+
+	server := &blobServer{
+		status: map[string]int{
+			sha256Bytes(forbidden):   403,
+			sha256Bytes(unavailable): 503,
+		},
+	}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	// We count the resumes, not the retries within each request
+	sources := []*fetchSource{
+		{registry: &docker.Registry{URL: httpServer.URL, MaxRetries: -1}, auth: &docker.Auth{}},
+	}
+
+	store, err := e.newFactory("store").LayerStore()
+	if err != nil {
+		t.Fatalf("error getting layer store: %v", err)
+	}
+
+	grid := []struct {
+		Name     string
+		Data     []byte
+		Requests int
+		Resume   bool
+	}{
+		{Name: "forbidden", Data: forbidden, Requests: 1, Resume: false},
+		{Name: "missing", Data: missing, Requests: 1, Resume: false},
+		{Name: "unavailable", Data: unavailable, Requests: 1 + maxDownloadResumes, Resume: true},
+	}
+	for _, g := range grid {
+		digest := sha256Bytes(g.Data)
+		var out bytes.Buffer
+		_, err := ensureBlob(&out, sources, "app", digest, int64(len(g.Data)), store)
+		if err == nil {
+			t.Errorf("%s: expected error downloading blob", g.Name)
+			continue
+		}
+		if n := server.requested(digest); n != g.Requests {
+			t.Errorf("%s: expected %d requests, got %d", g.Name, g.Requests, n)
+		}
+		if strings.Contains(err.Error(), "fetch again to resume") != g.Resume {
+			t.Errorf("%s: unexpected error %v", g.Name, err)
+		}
+	}
+}
+
+func TestFetchRejectsManifestWithWrongDigest(t *testing.T) {
+	e := newTestEnvironment(t)
+	defer e.Close()
+
+	config := []byte(`{"os": "linux", "architecture": "amd64", "config": {}, "rootfs": {"type": "layers", "diff_ids": []}}`)
+	configDigest := sha256Bytes(config)
+	manifest := `{"schemaVersion": 2, "mediaType": "` + docker.MediaTypeDockerManifest + `", "config": {"mediaType": "application/vnd.docker.container.image.v1+json", "digest": "` + configDigest + `", "size": %d}, "layers": []}`
+	pinned := []byte(fmt.Sprintf(manifest, len(config)))
+	tampered := []byte(fmt.Sprintf(manifest, len(config)) + "\n")
+	digest := sha256Bytes(pinned)
+
+	// The server has the config blob, so nothing but the digest check stops the fetch
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v2/app/manifests/" + digest:
+			w.Header().Set("Content-Type", docker.MediaTypeDockerManifest)
+			w.Write(tampered)
+		case "/v2/app/blobs/" + configDigest:
+			w.Write(config)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	dir := filepath.Join(e.dir, "consumer")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("error creating dir: %v", err)
+	}
+	registries := fmt.Sprintf(`{"registries": {%q: {"plainHTTP": true}}, "certsDirs": []}`, host)
+	if err := ioutil.WriteFile(filepath.Join(dir, "registries.json"), []byte(registries), 0644); err != nil {
+		t.Fatalf("error writing registries config: %v", err)
+	}
+	f := newFSFactory(dir)
+
+	var out bytes.Buffer
+	err := RunFetchCommand(f, &FetchOptions{Source: "docker://" + host + "/app@" + digest, Jobs: 1}, &out)
+	if err == nil || !strings.Contains(err.Error(), "had digest "+sha256Bytes(tampered)) {
+		t.Fatalf("expected error fetching manifest with the wrong digest, got %v", err)
+	}
+
+	store, err := f.LayerStore()
+	if err != nil {
+		t.Fatalf("error getting layer store: %v", err)
+	}
+	if m, err := store.FindImageManifest("app", digest, nil); m != nil || err != nil {
+		t.Errorf("expected no image to be stored, found %v (%v)", m, err)
+	}
+	if blob, err := store.FindBlob("app", configDigest); blob != nil || err != nil {
+		t.Errorf("expected no blobs to be stored, found %v (%v)", blob, err)
+	}
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"io"
+	"sync"
+)
+
+// DefaultJobs is the default number of blobs we transfer concurrently
+const DefaultJobs = 4
+
+// runJobs runs the tasks, with at most jobs running at once.  Once a task fails, tasks after it which have not
+// yet started are skipped.  It returns the error from the first failing task in task order, so that the error
+// we report does not depend on scheduling.
+func runJobs(jobs int, tasks []func() error) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	errors := make([]error, len(tasks))
+
+	// firstFailure is the index of the earliest task to have failed; earlier tasks must still run
+	var mutex sync.Mutex
+	firstFailure := len(tasks)
+
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs && w < len(tasks); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				mutex.Lock()
+				skip := i > firstFailure
+				mutex.Unlock()
+				if skip {
+					continue
+				}
+
+				err := tasks[i]()
+				if err != nil {
+					errors[i] = err
+					mutex.Lock()
+					if i < firstFailure {
+						firstFailure = i
+					}
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+
+	for i := range tasks {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	for _, err := range errors {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncWriter serializes writes, so that progress messages from concurrent jobs are not interleaved
+type syncWriter struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.w.Write(p)
+}
@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunJobsConcurrencyLimit(t *testing.T) {
+	const jobs = 3
+
+	var mutex sync.Mutex
+	running := 0
+	maxRunning := 0
+	completed := 0
+
+	var tasks []func() error
+	for i := 0; i < 20; i++ {
+		tasks = append(tasks, func() error {
+			mutex.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mutex.Unlock()
+
+			// Wait until all the jobs are busy, so we know they really run concurrently
+			deadline := time.Now().Add(2 * time.Second)
+			for {
+				mutex.Lock()
+				busy := maxRunning >= jobs
+				mutex.Unlock()
+				if busy || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			mutex.Lock()
+			running--
+			completed++
+			mutex.Unlock()
+			return nil
+		})
+	}
+
+	if err := runJobs(jobs, tasks); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if maxRunning != jobs {
+		t.Errorf("expected %d tasks to run concurrently, max was %d", jobs, maxRunning)
+	}
+	if completed != len(tasks) {
+		t.Errorf("expected all %d tasks to run, ran %d", len(tasks), completed)
+	}
+}
+
+func TestRunJobsReturnsFirstError(t *testing.T) {
+	var tasks []func() error
+	for i := 0; i < 10; i++ {
+		i := i
+		tasks = append(tasks, func() error {
+			switch i {
+			case 3:
+				// Fails after task 7, but is earlier in task order
+				time.Sleep(20 * time.Millisecond)
+				return fmt.Errorf("task 3 failed")
+			case 7:
+				return fmt.Errorf("task 7 failed")
+			}
+			return nil
+		})
+	}
+
+	for _, jobs := range []int{1, 4, 10} {
+		err := runJobs(jobs, tasks)
+		if err == nil || err.Error() != "task 3 failed" {
+			t.Errorf("jobs=%d: expected error from task 3, got %v", jobs, err)
+		}
+	}
+}
+
+func TestRunJobsSkipsQueuedTasksAfterFailure(t *testing.T) {
+	var mutex sync.Mutex
+	var started []int
+
+	var tasks []func() error
+	for i := 0; i < 6; i++ {
+		i := i
+		tasks = append(tasks, func() error {
+			mutex.Lock()
+			started = append(started, i)
+			mutex.Unlock()
+			if i == 1 {
+				return fmt.Errorf("task 1 failed")
+			}
+			return nil
+		})
+	}
+
+	err := runJobs(1, tasks)
+	if err == nil || err.Error() != "task 1 failed" {
+		t.Errorf("expected error from task 1, got %v", err)
+	}
+	if fmt.Sprint(started) != "[0 1]" {
+		t.Errorf("expected tasks after the failure not to start, started %v", started)
+	}
+
+	// A zero job count still runs the tasks, one at a time
+	started = nil
+	if err := runJobs(0, tasks[2:]); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(started) != "[2 3 4 5]" {
+		t.Errorf("expected tasks to run in order, started %v", started)
+	}
+}
+
+func TestSyncWriter(t *testing.T) {
+	var buffer bytes.Buffer
+	w := &syncWriter{w: &buffer}
+
+	const writers = 10
+	const lines = 100
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < lines; j++ {
+				fmt.Fprintf(w, "writer %d line %d\n", i, j)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Each write must arrive whole, even though the writers are interleaved
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSuffix(buffer.String(), "\n"), "\n") {
+		var i, j int
+		if n, err := fmt.Sscanf(line, "writer %d line %d", &i, &j); n != 2 || err != nil {
+			t.Fatalf("garbled line %q", line)
+		}
+		seen[line] = true
+	}
+	if len(seen) != writers*lines {
+		t.Errorf("expected %d distinct lines, got %d", writers*lines, len(seen))
+	}
+}
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"kope.io/build/pkg/docker"
+)
+
+type LoginOptions struct {
+	Registry string
+
+	Username      string
+	Password      string
+	PasswordStdin bool
+}
+
+func BuildLoginCommand(f Factory, out io.Writer) *cobra.Command {
+	options := &LoginOptions{}
+
+	cmd := &cobra.Command{
+		Use: "login",
+		Run: func(cmd *cobra.Command, args []string) {
+			options.Registry = cmd.Flags().Arg(0)
+			if err := RunLoginCommand(f, options, os.Stdin, out); err != nil {
+				ExitWithError(err)
+			}
+		},
+	}
+
+	cmd.Flags().StringVarP(&options.Username, "username", "u", "", "username")
+	cmd.Flags().StringVarP(&options.Password, "password", "p", "", "password")
+	cmd.Flags().BoolVar(&options.PasswordStdin, "password-stdin", false, "read the password from stdin")
+
+	return cmd
+}
+
+func RunLoginCommand(factory Factory, options *LoginOptions, in io.Reader, out io.Writer) error {
+	if options.Username == "" {
+		return fmt.Errorf("username is required")
+	}
+
+	password := options.Password
+	if options.PasswordStdin {
+		if password != "" {
+			return fmt.Errorf("--password and --password-stdin are mutually exclusive")
+		}
+		line, err := bufio.NewReader(in).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("error reading password from stdin: %v", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if password == "" {
+		return fmt.Errorf("password is required (use --password or --password-stdin)")
+	}
+
+	registry, err := registryForHost(factory, options.Registry)
+	if err != nil {
+		return err
+	}
+
+	// Check the credentials before we save them
+	auth := &docker.Auth{
+		HttpClient: registry.HttpClient,
+		Username:   options.Username,
+		Password:   password,
+	}
+	if err := registry.CheckAuthentication(auth); err != nil {
+		return fmt.Errorf("login failed: %v", err)
+	}
+
+	if err := docker.SaveCredentials(registry, options.Username, password); err != nil {
+		return fmt.Errorf("error saving credentials: %v", err)
+	}
+
+	fmt.Fprintf(out, "Login Succeeded\n")
+	return nil
+}
+
+// registryForHost returns the registry for a hostname given on the command line; empty means Docker Hub
+func registryForHost(factory Factory, host string) (*docker.Registry, error) {
+	host = strings.TrimSuffix(host, "/")
+
+	switch strings.TrimPrefix(host, "https://") {
+	case "", "docker.io", "index.docker.io", "registry-1.docker.io":
+		return factory.Registry("")
+	}
+
+	return factory.Registry(host)
+}
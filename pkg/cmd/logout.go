@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+	"kope.io/build/pkg/docker"
+)
+
+type LogoutOptions struct {
+	Registry string
+}
+
+func BuildLogoutCommand(f Factory, out io.Writer) *cobra.Command {
+	options := &LogoutOptions{}
+
+	cmd := &cobra.Command{
+		Use: "logout",
+		Run: func(cmd *cobra.Command, args []string) {
+			options.Registry = cmd.Flags().Arg(0)
+			if err := RunLogoutCommand(f, options, out); err != nil {
+				ExitWithError(err)
+			}
+		},
+	}
+
+	return cmd
+}
+
+func RunLogoutCommand(factory Factory, options *LogoutOptions, out io.Writer) error {
+	registry, err := registryForHost(factory, options.Registry)
+	if err != nil {
+		return err
+	}
+
+	removed, err := docker.RemoveCredentials(registry)
+	if err != nil {
+		return fmt.Errorf("error removing credentials: %v", err)
+	}
+
+	name := options.Registry
+	if name == "" {
+		name = "docker.io"
+	}
+	if !removed {
+		fmt.Fprintf(out, "Not logged in to %s\n", name)
+		return nil
+	}
+
+	fmt.Fprintf(out, "Removed login credentials for %s\n", name)
+	return nil
+}
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	"kope.io/build/pkg/layers"
+)
+
+// ParsePlatform parses a platform of the form os/arch[/variant], e.g. linux/arm64 or linux/arm/v7
+func ParsePlatform(s string) (*layers.Platform, error) {
+	tokens := strings.Split(s, "/")
+	if len(tokens) < 2 || len(tokens) > 3 {
+		return nil, fmt.Errorf("unknown platform %q - expected os/arch[/variant], e.g. linux/amd64", s)
+	}
+	for _, token := range tokens {
+		if token == "" {
+			return nil, fmt.Errorf("unknown platform %q - expected os/arch[/variant], e.g. linux/amd64", s)
+		}
+	}
+
+	p := &layers.Platform{
+		OS:           tokens[0],
+		Architecture: tokens[1],
+	}
+	if len(tokens) == 3 {
+		p.Variant = tokens[2]
+	}
+	return p, nil
+}
+
+// defaultPlatform returns the platform matching the host.
+// Images are (almost) always linux, even when we are building on another OS.
+func defaultPlatform() *layers.Platform {
+	return &layers.Platform{
+		OS:           "linux",
+		Architecture: runtime.GOARCH,
+	}
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+
+	"kope.io/build/pkg/layers"
+)
+
+func TestParsePlatform(t *testing.T) {
+	grid := []struct {
+		Input    string
+		Expected *layers.Platform
+	}{
+		{Input: "linux/amd64", Expected: &layers.Platform{OS: "linux", Architecture: "amd64"}},
+		{Input: "linux/arm64", Expected: &layers.Platform{OS: "linux", Architecture: "arm64"}},
+		{Input: "linux/arm/v7", Expected: &layers.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{Input: "windows/amd64", Expected: &layers.Platform{OS: "windows", Architecture: "amd64"}},
+	}
+	for _, g := range grid {
+		actual, err := ParsePlatform(g.Input)
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %v", g.Input, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, g.Expected) {
+			t.Errorf("parsing %q: expected %v, got %v", g.Input, g.Expected, actual)
+		}
+		if actual.String() != g.Input {
+			t.Errorf("platform %q formatted as %q", g.Input, actual.String())
+		}
+	}
+
+	for _, s := range []string{"", "linux", "linux/", "/amd64", "linux/arm//", "linux/arm/v7/extra"} {
+		if _, err := ParsePlatform(s); err == nil {
+			t.Errorf("expected error parsing %q", s)
+		}
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/url"
 	"strings"
 
 	"github.com/golang/glog"
@@ -21,22 +20,53 @@ import (
 type PushOptions struct {
 	Source string
 	Dest   string
+
+	// ChunkSize is the size of each chunk when uploading blobs
+	ChunkSize int64
+
+	// Format is the manifest format to push: "docker" or "oci"
+	Format string
+
+	// Platforms are either os/arch=layer entries for a multi-arch image, or the os/arch of a single image
+	Platforms []string
+
+	// Jobs is the number of blobs to upload concurrently
+	Jobs int
+
+	// DigestFile, if set, is written with the pushed image pinned by digest, e.g. registry.example.com/app@sha256:...
+	DigestFile string
 }
 
+const (
+	ManifestFormatDocker = "docker"
+	ManifestFormatOCI    = "oci"
+)
+
 func BuildPushCommand(f Factory, out io.Writer) *cobra.Command {
 	options := &PushOptions{}
 
 	cmd := &cobra.Command{
 		Use: "push",
 		Run: func(cmd *cobra.Command, args []string) {
-			options.Source = cmd.Flags().Arg(0)
-			options.Dest = cmd.Flags().Arg(1)
+			if cmd.Flags().NArg() == 1 {
+				// Multi-platform push: the layers come from --platform
+				options.Dest = cmd.Flags().Arg(0)
+			} else {
+				options.Source = cmd.Flags().Arg(0)
+				options.Dest = cmd.Flags().Arg(1)
+			}
 			if err := RunPushCommand(f, options, out); err != nil {
 				ExitWithError(err)
 			}
 		},
 	}
 
+	cmd.Flags().Int64Var(&options.ChunkSize, "chunk-size", docker.DefaultChunkSize, "size in bytes of each chunk when uploading blobs")
+	cmd.Flags().StringVar(&options.Format, "format", ManifestFormatDocker, "manifest format to push: docker or oci")
+	cmd.Flags().StringSliceVar(&options.Platforms, "platform", nil, "platform of the image as os/arch[/variant]; repeat as os/arch=layer to push a multi-arch image")
+	cmd.Flags().IntVar(&options.Jobs, "jobs", DefaultJobs, "number of blobs to upload concurrently")
+	cmd.Flags().StringVar(&options.DigestFile, "digest-file", "", "file to write the pushed image reference, pinned by digest")
+
 	return cmd
 }
 
@@ -44,6 +74,9 @@ type DockerImageSpec struct {
 	Host       string
 	Repository string
 	Tag        string
+
+	// Digest pins the image to a specific manifest, e.g. sha256:...
+	Digest string
 }
 
 func (s *DockerImageSpec) String() string {
@@ -53,59 +86,107 @@ func (s *DockerImageSpec) String() string {
 		host = strings.TrimPrefix(host, "http://")
 		v += host + "/"
 	}
-	v += s.Repository + ":" + s.Tag
+	v += s.Repository
+	if s.Tag != "" {
+		v += ":" + s.Tag
+	}
+	if s.Digest != "" {
+		v += "@" + s.Digest
+	}
 	return v
 }
 
-func ParseDockerImageSpec(s string) (*DockerImageSpec, error) {
-	u, err := url.Parse(s)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing source name %s: %v", s, err)
+// PinnedName returns the image name with the digest, e.g. registry.example.com/app@sha256:..., as used by
+// docker and kubernetes.  Images on docker hub are qualified with docker.io.
+func (s *DockerImageSpec) PinnedName(digest string) string {
+	host := strings.TrimPrefix(s.Host, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	if host == "" {
+		host = "docker.io"
 	}
+	return host + "/" + s.Repository + "@" + digest
+}
 
-	if u.Scheme != "docker" {
-		return nil, fmt.Errorf("unknown scheme %q - try e.g. docker://ubuntu:14.04", s)
+// Reference returns the digest if the image is pinned by digest, otherwise the tag
+func (s *DockerImageSpec) Reference() string {
+	if s.Digest != "" {
+		return s.Digest
 	}
+	return s.Tag
+}
 
-	v := u.Host
-	if u.Path != "" {
-		v += u.Path
+func ParseDockerImageSpec(s string) (*DockerImageSpec, error) {
+	// We don't use url.Parse, because it would treat repo@digest as userinfo
+	if !strings.HasPrefix(s, "docker://") {
+		return nil, fmt.Errorf("unknown scheme %q - try e.g. docker://ubuntu:14.04", s)
 	}
 
-	spec := &DockerImageSpec{}
+	ref, err := docker.ParseReference(strings.TrimPrefix(s, "docker://"))
+	if err != nil {
+		return nil, err
+	}
 
-	tokens := strings.Split(v, ":")
-	if len(tokens) == 1 {
+	spec := &DockerImageSpec{
+		Repository: ref.Path,
+		Tag:        ref.Tag,
+		Digest:     ref.Digest,
+	}
+	if spec.Tag == "" && spec.Digest == "" {
 		spec.Tag = "latest"
-	} else if len(tokens) == 2 {
-		spec.Tag = tokens[1]
-	} else {
-		return nil, fmt.Errorf("unknown docker image format %q", s)
 	}
 
-	tokens = strings.Split(tokens[0], "/")
-	if len(tokens) == 1 {
-		spec.Repository = "library/" + tokens[0]
-	} else if len(tokens) == 2 {
-		spec.Repository = tokens[0] + "/" + tokens[1]
-	} else if len(tokens) == 3 {
-		spec.Host = "https://" + tokens[0]
-		spec.Repository = tokens[1] + "/" + tokens[2]
-	} else {
-		return nil, fmt.Errorf("unknown docker image format %q", s)
+	// The https scheme is only a default; the registry configuration can select plain http
+	if ref.Domain != "" {
+		spec.Host = "https://" + ref.Domain
 	}
 
 	return spec, nil
 }
 
 func RunPushCommand(factory Factory, flags *PushOptions, out io.Writer) error {
-	if flags.Source == "" {
-		return fmt.Errorf("source is required")
-	}
 	if flags.Dest == "" {
 		return fmt.Errorf("dest is required")
 	}
 
+	format := flags.Format
+	if format == "" {
+		format = ManifestFormatDocker
+	}
+	if format != ManifestFormatDocker && format != ManifestFormatOCI {
+		return fmt.Errorf("unknown format %q - expected %s or %s", flags.Format, ManifestFormatDocker, ManifestFormatOCI)
+	}
+
+	// Each --platform is either os/arch=layer (building a multi-arch image),
+	// or just os/arch (setting the platform of a single image)
+	var platformLayers []platformLayer
+	var singlePlatform *layers.Platform
+	for _, s := range flags.Platforms {
+		tokens := strings.SplitN(s, "=", 2)
+		platform, err := ParsePlatform(tokens[0])
+		if err != nil {
+			return err
+		}
+		if len(tokens) == 1 {
+			if singlePlatform != nil {
+				return fmt.Errorf("only one --platform may be specified without a layer")
+			}
+			singlePlatform = platform
+			continue
+		}
+		if tokens[1] == "" {
+			return fmt.Errorf("layer is required in --platform %q", s)
+		}
+		platformLayers = append(platformLayers, platformLayer{Platform: platform, Layer: tokens[1]})
+	}
+
+	if len(platformLayers) != 0 {
+		if flags.Source != "" || singlePlatform != nil {
+			return fmt.Errorf("cannot specify a source layer when pushing a multi-platform image; use --platform os/arch=layer")
+		}
+	} else if flags.Source == "" {
+		return fmt.Errorf("source is required")
+	}
+
 	layerStore, err := factory.LayerStore()
 	if err != nil {
 		return err
@@ -116,28 +197,91 @@ func RunPushCommand(factory Factory, flags *PushOptions, out io.Writer) error {
 		return err
 	}
 
-	targetRegistry := &docker.Registry{
-		URL: dest.Host,
+	targetRegistry, err := factory.Registry(dest.Host)
+	if err != nil {
+		return err
+	}
+	targetRegistry.ChunkSize = flags.ChunkSize
+	auth := &docker.Auth{HttpClient: targetRegistry.HttpClient}
+
+	if len(platformLayers) == 0 {
+		descriptor, err := pushImage(out, layerStore, targetRegistry, auth, dest, flags.Source, singlePlatform, format, flags.Jobs, dest.Reference(), dest.Tag)
+		if err != nil {
+			return err
+		}
+		if dest.Digest != "" && descriptor.Digest != dest.Digest {
+			return fmt.Errorf("pushed image has digest %s, not the requested %s", descriptor.Digest, dest.Digest)
+		}
+
+		return reportPushed(out, dest, descriptor.Digest, flags.DigestFile)
+	}
+
+	// Push each platform's image by digest, then tie them together with a manifest list under the tag
+	var descriptors []docker.ManifestV2Layer
+	for _, pl := range platformLayers {
+		descriptor, err := pushImage(out, layerStore, targetRegistry, auth, dest, pl.Layer, pl.Platform, format, flags.Jobs, "", "")
+		if err != nil {
+			return fmt.Errorf("error pushing image for %s: %v", pl.Platform, err)
+		}
+		descriptor.Platform = &docker.Platform{
+			OS:           pl.Platform.OS,
+			Architecture: pl.Platform.Architecture,
+			Variant:      pl.Platform.Variant,
+		}
+		fmt.Fprintf(out, "Pushed %s image %s\n", pl.Platform, descriptor.Digest)
+		descriptors = append(descriptors, *descriptor)
+	}
+
+	index := buildManifestList(descriptors, format)
+	indexDescriptor, err := targetRegistry.PutManifest(auth, dest.Repository, dest.Reference(), index)
+	if err != nil {
+		return fmt.Errorf("error writing manifest list: %v", err)
+	}
+	if dest.Digest != "" && indexDescriptor.Digest != dest.Digest {
+		return fmt.Errorf("pushed manifest list has digest %s, not the requested %s", indexDescriptor.Digest, dest.Digest)
 	}
-	auth := &docker.Auth{}
-	//auth := docker.Auth{Subject: dest.Host}
-	// token, err := auth.GetToken("repository:" + dest.Repository + ":pull,push")
-	//if err != nil {
-	//	return fmt.Errorf("error getting registry token: %v", err)
-	//}
 
+	return reportPushed(out, dest, indexDescriptor.Digest, flags.DigestFile)
+}
+
+// reportPushed prints the pushed image and its digest, and writes the image pinned by digest to digestFile if set
+func reportPushed(out io.Writer, dest *DockerImageSpec, digest string, digestFile string) error {
+	pinned := dest.PinnedName(digest)
+
+	fmt.Fprintf(out, "Pushed %s\n", dest)
+	fmt.Fprintf(out, "Digest %s\n", pinned)
+
+	if digestFile != "" {
+		if err := ioutil.WriteFile(digestFile, []byte(pinned+"\n"), 0644); err != nil {
+			return fmt.Errorf("error writing digest file %q: %v", digestFile, err)
+		}
+	}
+	return nil
+}
+
+// platformLayer is a layer stack to be pushed as the image for a platform
+type platformLayer struct {
+	Platform *layers.Platform
+	Layer    string
+}
+
+// pushImage builds the image from sourceLayer (and its bases), uploads it and pushes its manifest as reference.
+// If reference is empty, the manifest is pushed by digest.  The image manifest is recorded in the layer store
+// by digest, and also as localTag if that is set.  Up to jobs blobs are uploaded concurrently.
+// It returns the descriptor of the pushed manifest.
+func pushImage(out io.Writer, layerStore layers.Store, registry *docker.Registry, auth *docker.Auth, dest *DockerImageSpec, sourceLayer string, platform *layers.Platform, format string, jobs int, reference string, localTag string) (*docker.ManifestV2Layer, error) {
 	var newLayers []*imageconfig.AddLayer
 	var baseImage string
 
 	{
-		source := flags.Source
+		source := sourceLayer
 		for {
 			layer, err := layerStore.FindLayer(source)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			if layer == nil {
-				return fmt.Errorf("layer %q not found", source)
+				return nil, fmt.Errorf("layer %q not found", source)
 			}
 
 			newLayer := &imageconfig.AddLayer{
@@ -150,7 +294,7 @@ func RunPushCommand(factory Factory, flags *PushOptions, out io.Writer) error {
 
 			options, err := layer.GetOptions()
 			if err != nil {
-				return err
+				return nil, err
 			}
 			newLayer.Options = options
 
@@ -168,42 +312,47 @@ func RunPushCommand(factory Factory, flags *PushOptions, out io.Writer) error {
 	var baseImageManifest *layers.ImageManifest
 	var baseImageSpec *DockerImageSpec
 	if baseImage != "" {
+		var err error
 		baseImageSpec, err = ParseDockerImageSpec(baseImage)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		baseImageManifest, err = layerStore.FindImageManifest(baseImageSpec.Repository, baseImageSpec.Tag)
+		// A tag can refer to a manifest list, so we need the base image for the platform we are building
+		baseImageManifest, err = layerStore.FindImageManifest(baseImageSpec.Repository, baseImageSpec.Reference(), platform)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if baseImageManifest == nil {
-			return fmt.Errorf("base image %q not found", baseImage)
+			if platform != nil {
+				return nil, fmt.Errorf("base image %q not found for platform %s; fetch it with --platform %s", baseImage, platform, platform)
+			}
+			return nil, fmt.Errorf("base image %q not found", baseImage)
 		}
 
 		if baseImageManifest.Config.Digest == "" {
-			return fmt.Errorf("base image %q did not have a valid manifest", baseImage)
+			return nil, fmt.Errorf("base image %q did not have a valid manifest", baseImage)
 		}
 
 		configBlob, err := layerStore.FindBlob(baseImageSpec.Repository, baseImageManifest.Config.Digest)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		configBlobReader, err := configBlob.Open()
 		if err != nil {
-			return err
+			return nil, err
 		}
 		defer configBlobReader.Close()
 
 		configBlobBytes, err := ioutil.ReadAll(configBlobReader)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		base = &imageconfig.ImageConfig{}
 		err = json.Unmarshal(configBlobBytes, base)
 		if err != nil {
-			return fmt.Errorf("error parsing config blob %s/%s: %v", baseImageSpec.Repository, baseImageManifest.Config.Digest, err)
+			return nil, fmt.Errorf("error parsing config blob %s/%s: %v", baseImageSpec.Repository, baseImageManifest.Config.Digest, err)
 		}
 	}
 
@@ -211,57 +360,81 @@ func RunPushCommand(factory Factory, flags *PushOptions, out io.Writer) error {
 		// BuildTar automatically saves the blob
 		blob, diffID, err := newLayer.Layer.BuildTar(layerStore, dest.Repository)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		newLayer.Blob = blob
 		newLayer.DiffID = diffID
 	}
 
-	config, err := imageconfig.JoinLayer(base, newLayers)
+	config, err := imageconfig.JoinLayer(base, platform, newLayers)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	configBytes, err := json.Marshal(config)
 	if err != nil {
-		return fmt.Errorf("error serializing image config: %v", err)
+		return nil, fmt.Errorf("error serializing image config: %v", err)
 	}
 
 	configDigest := sha256Bytes(configBytes)
 	configBlob, err := layerStore.AddBlob(dest.Repository, configDigest, bytes.NewReader(configBytes))
 	if err != nil {
-		return fmt.Errorf("error storing config blob: %v", err)
+		return nil, fmt.Errorf("error storing config blob: %v", err)
 	}
 
 	imageManifest := &layers.ImageManifest{}
 	imageManifest.Repository = dest.Repository
 	imageManifest.Tag = dest.Tag
+	imageManifest.Platform = &layers.Platform{
+		OS:           config.OS,
+		Architecture: config.Architecture,
+		Variant:      config.Variant,
+	}
 	imageManifest.Config = layers.LayerManifest{
 		Digest: configBlob.Digest(),
 		Size:   configBlob.Length(),
 	}
 
-	// Add and upload base layers
+	// The manifest lists the layers in order; the uploads can happen in any order
+	syncOut := &syncWriter{w: out}
+	var uploads []func() error
+	uploading := make(map[string]bool)
+	addUpload := func(digest string, upload func() error) {
+		// An image can contain the same blob more than once, but we only need to upload it once
+		if uploading[digest] {
+			return
+		}
+		uploading[digest] = true
+		uploads = append(uploads, upload)
+	}
+
+	// Add base layers
 	if base != nil {
+		// If the base image lives on the same registry, we can ask the registry to mount the blob
+		mountFrom := ""
+		if baseImageSpec.Host == dest.Host && baseImageSpec.Repository != dest.Repository {
+			mountFrom = baseImageSpec.Repository
+		}
+
 		for i, baseLayer := range baseImageManifest.Layers {
 			imageManifest.Layers = append(imageManifest.Layers, layers.LayerManifest{
 				Digest: baseLayer.Digest,
 				Size:   baseLayer.Size,
 			})
 
-			// TODO: Cross-copy blobs ... we don't need to download them
 			src, err := layerStore.FindBlob(baseImageSpec.Repository, baseLayer.Digest)
 			if err != nil {
-				return err
-			}
-			err = uploadBlob(out, targetRegistry, auth, dest.Repository, src, fmt.Sprintf("%s layer #%d)", baseImageSpec, i+1))
-			if err != nil {
-				return err
+				return nil, err
 			}
+			digest := baseLayer.Digest
+			info := fmt.Sprintf("%s layer #%d", baseImageSpec, i+1)
+			addUpload(digest, func() error {
+				return uploadBlob(syncOut, registry, auth, dest.Repository, digest, src, mountFrom, info)
+			})
 		}
 	}
 
-	// Add and upload new layers
+	// Add new layers
 	for _, newLayer := range newLayers {
 		digest := newLayer.Blob.Digest()
 
@@ -272,62 +445,94 @@ func RunPushCommand(factory Factory, flags *PushOptions, out io.Writer) error {
 
 		src, err := layerStore.FindBlob(dest.Repository, digest)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if src == nil {
-			return fmt.Errorf("unable to find layer blob %s %s", dest.Repository, digest)
-		}
-		err = uploadBlob(out, targetRegistry, auth, dest.Repository, src, newLayer.Description)
-		if err != nil {
-			return err
+			return nil, fmt.Errorf("unable to find layer blob %s %s", dest.Repository, digest)
 		}
+		info := newLayer.Description
+		addUpload(digest, func() error {
+			return uploadBlob(syncOut, registry, auth, dest.Repository, digest, src, "", info)
+		})
 	}
 
-	// Build and upload the manifest
-	{
-		err = layerStore.WriteImageManifest(dest.Repository, dest.Tag, imageManifest)
-		if err != nil {
-			return fmt.Errorf("error writing image manifest: %v", err)
-		}
+	if err := runJobs(jobs, uploads); err != nil {
+		return nil, err
+	}
 
-		err = uploadBlob(out, targetRegistry, auth, dest.Repository, configBlob, "image manifest")
-		if err != nil {
-			return err
-		}
+	// Upload the image config
+	err = uploadBlob(out, registry, auth, dest.Repository, configBlob.Digest(), configBlob, "", "image manifest")
+	if err != nil {
+		return nil, err
 	}
 
 	// Push the manifest
-	{
-		dockerManifest := &docker.ManifestV2{}
-		dockerManifest.Config = docker.ManifestV2Layer{
-			Digest:    imageManifest.Config.Digest,
-			MediaType: "application/vnd.docker.container.image.v1+json",
-			Size:      imageManifest.Config.Size,
-		}
-
-		dockerManifest.SchemaVersion = 2
-		dockerManifest.MediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerManifest := buildManifest(imageManifest, format)
+	descriptor, err := registry.PutManifest(auth, dest.Repository, reference, dockerManifest)
+	if err != nil {
+		return nil, fmt.Errorf("error writing manifest: %v", err)
+	}
 
-		for _, layer := range imageManifest.Layers {
-			dockerManifest.Layers = append(dockerManifest.Layers, docker.ManifestV2Layer{
-				Digest:    layer.Digest,
-				MediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip",
-				Size:      layer.Size,
-			})
-		}
-		err := targetRegistry.PutManifest(auth, dest.Repository, dest.Tag, dockerManifest)
+	// Record the image locally, so it can be used as a base
+	imageManifest.Digest = descriptor.Digest
+	if localTag != "" {
+		err = layerStore.WriteImageManifest(dest.Repository, localTag, imageManifest)
 		if err != nil {
-			return fmt.Errorf("error writing manifest: %v", err)
+			return nil, fmt.Errorf("error writing image manifest: %v", err)
 		}
 	}
+	err = layerStore.WriteImageManifest(dest.Repository, descriptor.Digest, imageManifest)
+	if err != nil {
+		return nil, fmt.Errorf("error writing image manifest: %v", err)
+	}
 
-	fmt.Fprintf(out, "Pushed %s\n", dest)
-	return nil
+	return descriptor, nil
+}
+
+// buildManifestList builds a manifest list (or OCI index) from the manifests for each platform
+func buildManifestList(manifests []docker.ManifestV2Layer, format string) *docker.ManifestV2 {
+	list := &docker.ManifestV2{}
+	list.SchemaVersion = 2
+	list.MediaType = docker.MediaTypeDockerManifestList
+	if format == ManifestFormatOCI {
+		list.MediaType = docker.MediaTypeOCIIndex
+	}
+	list.Manifests = manifests
+	return list
 }
 
-func uploadBlob(out io.Writer, registry *docker.Registry, auth *docker.Auth, destRepository string, srcBlob layers.Blob, info string) error {
-	digest := srcBlob.Digest()
+// buildManifest builds the registry manifest for the image, using the media types for the requested format
+func buildManifest(imageManifest *layers.ImageManifest, format string) *docker.ManifestV2 {
+	manifestMediaType := docker.MediaTypeDockerManifest
+	configMediaType := docker.MediaTypeDockerConfig
+	layerMediaType := docker.MediaTypeDockerLayer
+	if format == ManifestFormatOCI {
+		manifestMediaType = docker.MediaTypeOCIManifest
+		configMediaType = docker.MediaTypeOCIConfig
+		layerMediaType = docker.MediaTypeOCILayer
+	}
+
+	manifest := &docker.ManifestV2{}
+	manifest.SchemaVersion = 2
+	manifest.MediaType = manifestMediaType
+	manifest.Config = &docker.ManifestV2Layer{
+		Digest:    imageManifest.Config.Digest,
+		MediaType: configMediaType,
+		Size:      imageManifest.Config.Size,
+	}
+
+	for _, layer := range imageManifest.Layers {
+		manifest.Layers = append(manifest.Layers, docker.ManifestV2Layer{
+			Digest:    layer.Digest,
+			MediaType: layerMediaType,
+			Size:      layer.Size,
+		})
+	}
+
+	return manifest
+}
 
+func uploadBlob(out io.Writer, registry *docker.Registry, auth *docker.Auth, destRepository string, digest string, srcBlob layers.Blob, mountFrom string, info string) error {
 	hasBlob, err := registry.HasBlob(auth, destRepository, digest)
 	if err != nil {
 		return err
@@ -338,6 +543,21 @@ func uploadBlob(out io.Writer, registry *docker.Registry, auth *docker.Auth, des
 		return nil
 	}
 
+	if mountFrom != "" {
+		mounted, err := registry.MountBlob(auth, destRepository, digest, mountFrom)
+		if err != nil {
+			return err
+		}
+		if mounted {
+			fmt.Fprintf(out, "Mounted blob: %s (from %s, %s)\n", info, mountFrom, digest)
+			return nil
+		}
+	}
+
+	if srcBlob == nil {
+		return fmt.Errorf("unable to find blob %s locally for %s", digest, info)
+	}
+
 	r, err := srcBlob.Open()
 	if err != nil {
 		return err
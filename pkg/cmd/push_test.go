@@ -0,0 +1,196 @@
+package cmd
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"kope.io/build/pkg/docker"
+	"kope.io/build/pkg/layers"
+)
+
+// memoryBlob is a layers.Blob held in memory
+type memoryBlob struct {
+	data []byte
+}
+
+func (b *memoryBlob) Digest() string {
+	return sha256Bytes(b.data)
+}
+
+func (b *memoryBlob) Length() int64 {
+	return int64(len(b.data))
+}
+
+func (b *memoryBlob) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(b.data)), nil
+}
+
+func TestUploadBlobFallsBackWhenMountDeclined(t *testing.T) {
+	e := newTestEnvironment(t)
+	defer e.Close()
+
+	blob := &memoryBlob{data: []byte("layer data")}
+
+	var mutex sync.Mutex
+	var requests []string
+	var uploaded []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		requests = append(requests, req.Method+" "+req.URL.Path)
+		switch {
+		case req.Method == "HEAD" && req.URL.Path == "/v2/app/blobs/"+blob.Digest():
+			w.WriteHeader(404)
+
+		case req.Method == "POST" && req.URL.Path == "/v2/app/blobs/uploads/" && req.URL.Query().Get("mount") != "":
+			// Decline the mount by starting a regular upload, as registries do when they don't have the blob
+			w.Header().Set("Location", "/v2/app/blobs/uploads/declined")
+			w.WriteHeader(202)
+
+		case req.Method == "DELETE" && req.URL.Path == "/v2/app/blobs/uploads/declined":
+			w.WriteHeader(204)
+
+		case req.Method == "POST" && req.URL.Path == "/v2/app/blobs/uploads/":
+			w.Header().Set("Location", "/v2/app/blobs/uploads/1")
+			w.WriteHeader(202)
+
+		case req.Method == "PATCH" && req.URL.Path == "/v2/app/blobs/uploads/1":
+			body, _ := ioutil.ReadAll(req.Body)
+			uploaded = append(uploaded, body...)
+			w.Header().Set("Location", "/v2/app/blobs/uploads/1")
+			w.WriteHeader(202)
+
+		case req.Method == "PUT" && req.URL.Path == "/v2/app/blobs/uploads/1":
+			if req.URL.Query().Get("digest") != blob.Digest() {
+				w.WriteHeader(400)
+				return
+			}
+			w.Header().Set("Docker-Content-Digest", blob.Digest())
+			w.WriteHeader(201)
+
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	registry := &docker.Registry{URL: server.URL}
+	var out bytes.Buffer
+	if err := uploadBlob(&out, registry, &docker.Auth{}, "app", blob.Digest(), blob, "base", "layer #1"); err != nil {
+		t.Fatalf("error uploading blob: %v", err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	expected := []string{
+		"HEAD /v2/app/blobs/" + blob.Digest(),
+		"POST /v2/app/blobs/uploads/",
+		"DELETE /v2/app/blobs/uploads/declined",
+		"POST /v2/app/blobs/uploads/",
+		"PATCH /v2/app/blobs/uploads/1",
+		"PUT /v2/app/blobs/uploads/1",
+	}
+	if strings.Join(requests, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected requests:\n%s", strings.Join(requests, "\n"))
+	}
+	if !bytes.Equal(uploaded, blob.data) {
+		t.Errorf("uploaded %q, expected %q", uploaded, blob.data)
+	}
+	if !strings.Contains(out.String(), "Uploading blob: layer #1") {
+		t.Errorf("expected upload to be reported, got %q", out.String())
+	}
+}
+
+func TestBuildManifestFormats(t *testing.T) {
+	imageManifest := &layers.ImageManifest{
+		Config: layers.LayerManifest{Digest: "sha256:" + strings.Repeat("c", 64), Size: 100},
+		Layers: []layers.LayerManifest{
+			{Digest: "sha256:" + strings.Repeat("1", 64), Size: 1000},
+			{Digest: "sha256:" + strings.Repeat("2", 64), Size: 2000},
+		},
+	}
+
+	grid := []struct {
+		Format   string
+		Manifest string
+		Config   string
+		Layer    string
+	}{
+		{
+			Format:   ManifestFormatDocker,
+			Manifest: "application/vnd.docker.distribution.manifest.v2+json",
+			Config:   "application/vnd.docker.container.image.v1+json",
+			Layer:    "application/vnd.docker.image.rootfs.diff.tar.gzip",
+		},
+		{
+			Format:   ManifestFormatOCI,
+			Manifest: "application/vnd.oci.image.manifest.v1+json",
+			Config:   "application/vnd.oci.image.config.v1+json",
+			Layer:    "application/vnd.oci.image.layer.v1.tar+gzip",
+		},
+	}
+
+	for _, g := range grid {
+		manifest := buildManifest(imageManifest, g.Format)
+		if manifest.SchemaVersion != 2 || manifest.MediaType != g.Manifest {
+			t.Errorf("%s: unexpected manifest schema %d, media type %q", g.Format, manifest.SchemaVersion, manifest.MediaType)
+		}
+		if manifest.Config.MediaType != g.Config || manifest.Config.Digest != imageManifest.Config.Digest || manifest.Config.Size != 100 {
+			t.Errorf("%s: unexpected config descriptor %+v", g.Format, manifest.Config)
+		}
+		if len(manifest.Layers) != 2 {
+			t.Fatalf("%s: expected 2 layers, got %d", g.Format, len(manifest.Layers))
+		}
+		for i, layer := range manifest.Layers {
+			if layer.MediaType != g.Layer || layer.Digest != imageManifest.Layers[i].Digest || layer.Size != imageManifest.Layers[i].Size {
+				t.Errorf("%s: unexpected layer descriptor %+v", g.Format, layer)
+			}
+		}
+	}
+}
+
+func TestBuildManifestList(t *testing.T) {
+	descriptors := []docker.ManifestV2Layer{
+		{
+			MediaType: docker.MediaTypeDockerManifest,
+			Digest:    "sha256:" + strings.Repeat("1", 64),
+			Size:      500,
+			Platform:  &docker.Platform{OS: "linux", Architecture: "amd64"},
+		},
+		{
+			MediaType: docker.MediaTypeDockerManifest,
+			Digest:    "sha256:" + strings.Repeat("2", 64),
+			Size:      600,
+			Platform:  &docker.Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+		},
+	}
+
+	grid := map[string]string{
+		ManifestFormatDocker: "application/vnd.docker.distribution.manifest.list.v2+json",
+		ManifestFormatOCI:    "application/vnd.oci.image.index.v1+json",
+	}
+	for format, mediaType := range grid {
+		list := buildManifestList(descriptors, format)
+		if list.SchemaVersion != 2 || list.MediaType != mediaType || !list.IsList() {
+			t.Errorf("%s: unexpected manifest list schema %d, media type %q", format, list.SchemaVersion, list.MediaType)
+		}
+		if list.Config != nil || len(list.Layers) != 0 {
+			t.Errorf("%s: manifest list should not have a config or layers", format)
+		}
+		if !reflect.DeepEqual(list.Manifests, descriptors) {
+			t.Errorf("%s: unexpected manifests %v", format, list.Manifests)
+		}
+		if entry := list.FindPlatform(&docker.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}); entry == nil || entry.Digest != descriptors[1].Digest {
+			t.Errorf("%s: platform entry not found in %v", format, list.Manifests)
+		}
+	}
+}
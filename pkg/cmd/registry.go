@@ -0,0 +1,17 @@
+package cmd
+
+import (
+	"io"
+
+	"github.com/spf13/cobra"
+)
+
+func BuildRegistryCommand(f Factory, out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use: "registry",
+	}
+
+	cmd.AddCommand(BuildRegistryDeleteCommand(f, out))
+
+	return cmd
+}
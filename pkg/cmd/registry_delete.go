@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+	"kope.io/build/pkg/docker"
+)
+
+type RegistryDeleteOptions struct {
+	// Images are the images to delete, e.g. docker://registry.example.com/app:preview-123
+	Images []string
+
+	// DryRun reports what would be deleted, without deleting anything
+	DryRun bool
+}
+
+func BuildRegistryDeleteCommand(f Factory, out io.Writer) *cobra.Command {
+	options := &RegistryDeleteOptions{}
+
+	cmd := &cobra.Command{
+		Use: "delete",
+		Run: func(cmd *cobra.Command, args []string) {
+			options.Images = cmd.Flags().Args()
+			if err := RunRegistryDeleteCommand(f, options, out); err != nil {
+				ExitWithError(err)
+			}
+		},
+	}
+
+	cmd.Flags().BoolVar(&options.DryRun, "dry-run", false, "only print the manifests which would be deleted")
+
+	return cmd
+}
+
+func RunRegistryDeleteCommand(factory Factory, options *RegistryDeleteOptions, out io.Writer) error {
+	if len(options.Images) == 0 {
+		return fmt.Errorf("image is required, e.g. docker://registry.example.com/app:tag")
+	}
+
+	// Parse everything first, so a typo doesn't leave us having deleted only some of the images
+	var specs []*DockerImageSpec
+	for _, image := range options.Images {
+		spec, err := ParseDockerImageSpec(image)
+		if err != nil {
+			return err
+		}
+		specs = append(specs, spec)
+	}
+
+	for _, spec := range specs {
+		registry, err := factory.Registry(spec.Host)
+		if err != nil {
+			return err
+		}
+		auth := &docker.Auth{HttpClient: registry.HttpClient}
+
+		// Registries only delete by digest, which also removes any other tags pointing to the same manifest
+		digest, err := registry.ResolveManifest(auth, spec.Repository, spec.Reference())
+		if err != nil {
+			return err
+		}
+
+		if options.DryRun {
+			fmt.Fprintf(out, "Would delete %s (%s)\n", spec, digest)
+			continue
+		}
+
+		if err := registry.DeleteManifest(auth, spec.Repository, digest); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Deleted %s (%s)\n", spec, digest)
+	}
+
+	return nil
+}
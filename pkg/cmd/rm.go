@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+type RmOptions struct {
+	// Paths are the paths to delete, as <layer>:<path>
+	Paths []string
+
+	// Recursive allows deleting non-empty directories
+	Recursive bool
+
+	// Opaque keeps the directories, but hides their contents in the layers below
+	Opaque bool
+}
+
+func BuildRmCommand(f Factory, out io.Writer) *cobra.Command {
+	options := &RmOptions{}
+
+	cmd := &cobra.Command{
+		Use: "rm",
+		Run: func(cmd *cobra.Command, args []string) {
+			options.Paths = cmd.Flags().Args()
+			if err := RunRmCommand(f, options, out); err != nil {
+				ExitWithError(err)
+			}
+		},
+	}
+
+	cmd.Flags().BoolVarP(&options.Recursive, "recursive", "r", false, "delete directories and their contents")
+	cmd.Flags().BoolVar(&options.Opaque, "opaque", false, "keep the directories, but hide their contents from the layers below")
+
+	return cmd
+}
+
+func RunRmCommand(factory Factory, options *RmOptions, out io.Writer) error {
+	if len(options.Paths) == 0 {
+		return fmt.Errorf("path is required, e.g. <layer>:/etc/motd")
+	}
+
+	layerStore, err := factory.LayerStore()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range options.Paths {
+		tokens := strings.SplitN(p, ":", 2)
+		if len(tokens) != 2 {
+			return fmt.Errorf("unknown path %q - expected <layer>:<path>", p)
+		}
+
+		l, err := layerStore.FindLayer(tokens[0])
+		if err != nil {
+			return err
+		}
+
+		if l == nil {
+			return fmt.Errorf("layer %q does not exist", tokens[0])
+		}
+
+		if options.Opaque {
+			if err := l.MakeOpaque(tokens[1]); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Made %s opaque\n", p)
+		} else {
+			if err := l.DeletePath(tokens[1], options.Recursive); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Removed %s\n", p)
+		}
+	}
+
+	return nil
+}
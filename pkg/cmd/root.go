@@ -33,12 +33,20 @@ func buildRootCommand(f Factory, out io.Writer) *cobra.Command {
 		Use: "imagebuilder",
 	}
 
+	cmd.AddCommand(BuildCatalogCommand(f, out))
+	cmd.AddCommand(BuildChownCommand(f, out))
 	cmd.AddCommand(BuildCopyCommand(f, out))
 	cmd.AddCommand(BuildCreateCommand(f, out))
 	cmd.AddCommand(BuildDeleteCommand(f, out))
 	cmd.AddCommand(BuildFetchCommand(f, out))
+	cmd.AddCommand(BuildLoginCommand(f, out))
+	cmd.AddCommand(BuildLogoutCommand(f, out))
 	cmd.AddCommand(BuildPushCommand(f, out))
+	cmd.AddCommand(BuildRegistryCommand(f, out))
+	cmd.AddCommand(BuildRmCommand(f, out))
+	cmd.AddCommand(BuildServeCommand(f, out))
 	cmd.AddCommand(BuildSetCommand(f, out))
+	cmd.AddCommand(BuildTagsCommand(f, out))
 	cmd.AddCommand(BuildEnvCommand(f, out))
 
 	cmd.PersistentFlags().AddGoFlagSet(goflag.CommandLine)
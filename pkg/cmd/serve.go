@@ -0,0 +1,17 @@
+package cmd
+
+import (
+	"io"
+
+	"github.com/spf13/cobra"
+)
+
+func BuildServeCommand(f Factory, out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use: "serve",
+	}
+
+	cmd.AddCommand(BuildServeRegistryCommand(f, out))
+
+	return cmd
+}
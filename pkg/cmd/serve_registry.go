@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"kope.io/build/pkg/registry"
+)
+
+type ServeRegistryOptions struct {
+	// Store is the directory holding the registry content
+	Store string
+
+	// Listen is the address to listen on, e.g. :5000
+	Listen string
+
+	// Users are username:password pairs; if set, clients must authenticate as one of them
+	Users []string
+
+	// AllowDelete enables deleting manifests
+	AllowDelete bool
+}
+
+func BuildServeRegistryCommand(f Factory, out io.Writer) *cobra.Command {
+	options := &ServeRegistryOptions{}
+
+	cmd := &cobra.Command{
+		Use: "registry",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := RunServeRegistryCommand(f, options, out); err != nil {
+				ExitWithError(err)
+			}
+		},
+	}
+
+	cmd.Flags().StringVar(&options.Store, "store", "", "directory in which to store images")
+	cmd.Flags().StringVar(&options.Listen, "listen", "localhost:5000", "address on which to serve the registry")
+	cmd.Flags().StringSliceVar(&options.Users, "user", nil, "username:password allowed to access the registry; enables token authentication")
+	cmd.Flags().BoolVar(&options.AllowDelete, "allow-delete", false, "allow manifests to be deleted")
+
+	return cmd
+}
+
+func RunServeRegistryCommand(factory Factory, options *ServeRegistryOptions, out io.Writer) error {
+	if options.Store == "" {
+		return fmt.Errorf("--store is required")
+	}
+
+	server := registry.NewServer(options.Store)
+	server.AllowDelete = options.AllowDelete
+	for _, user := range options.Users {
+		tokens := strings.SplitN(user, ":", 2)
+		if len(tokens) != 2 || tokens[0] == "" {
+			return fmt.Errorf("invalid --user %q - expected username:password", user)
+		}
+		if server.Users == nil {
+			server.Users = make(map[string]string)
+		}
+		server.Users[tokens[0]] = tokens[1]
+	}
+
+	fmt.Fprintf(out, "Serving registry from %s on %s\n", options.Store, options.Listen)
+	if err := http.ListenAndServe(options.Listen, server); err != nil {
+		return fmt.Errorf("error serving registry: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+
+	"github.com/spf13/cobra"
+	"kope.io/build/pkg/docker"
+)
+
+type TagsOptions struct {
+	Repository string
+
+	// Filter is a regular expression; only matching tags are listed
+	Filter string
+
+	// JSON prints the tags as a JSON document
+	JSON bool
+}
+
+func BuildTagsCommand(f Factory, out io.Writer) *cobra.Command {
+	options := &TagsOptions{}
+
+	cmd := &cobra.Command{
+		Use: "tags",
+		Run: func(cmd *cobra.Command, args []string) {
+			options.Repository = cmd.Flags().Arg(0)
+			if err := RunTagsCommand(f, options, out); err != nil {
+				ExitWithError(err)
+			}
+		},
+	}
+
+	cmd.Flags().StringVar(&options.Filter, "filter", "", "only list tags matching this regular expression")
+	cmd.Flags().BoolVar(&options.JSON, "json", false, "print the tags as json")
+
+	return cmd
+}
+
+// tagList is the json output of the tags command, in the same form as the registry API
+type tagList struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+func RunTagsCommand(factory Factory, options *TagsOptions, out io.Writer) error {
+	if options.Repository == "" {
+		return fmt.Errorf("repository is required, e.g. docker://ubuntu")
+	}
+
+	var filter *regexp.Regexp
+	if options.Filter != "" {
+		var err error
+		filter, err = regexp.Compile(options.Filter)
+		if err != nil {
+			return fmt.Errorf("invalid --filter %q: %v", options.Filter, err)
+		}
+	}
+
+	// Any tag in the spec is ignored
+	spec, err := ParseDockerImageSpec(options.Repository)
+	if err != nil {
+		return err
+	}
+
+	registry, err := factory.Registry(spec.Host)
+	if err != nil {
+		return err
+	}
+	auth := &docker.Auth{HttpClient: registry.HttpClient}
+
+	tags, err := registry.ListTags(auth, spec.Repository)
+	if err != nil {
+		return err
+	}
+
+	result := &tagList{
+		Name: spec.Repository,
+		Tags: []string{},
+	}
+	for _, tag := range tags {
+		if filter != nil && !filter.MatchString(tag) {
+			continue
+		}
+		result.Tags = append(result.Tags, tag)
+	}
+
+	if options.JSON {
+		b, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error serializing tags: %v", err)
+		}
+		fmt.Fprintf(out, "%s\n", b)
+		return nil
+	}
+
+	for _, tag := range result.Tags {
+		fmt.Fprintf(out, "%s\n", tag)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package docker
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -10,6 +11,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
 )
@@ -19,69 +22,161 @@ type Auth struct {
 	URL        string
 	Subject    string
 
+	// Username and Password, if set, are used instead of looking up credentials in the docker config
+	Username string
+	Password string
+
+	// mutex guards cache, so that an Auth can be shared by concurrent requests
+	mutex sync.Mutex
 	cache []*Token
 }
 
 type Token struct {
-	auth   *Auth
+	auth  *Auth
+	basic string
+
+	// mutex guards bearer, expires and refreshToken.  It is never held while we talk to the token server,
+	// so a refresh doesn't hold up requests using the token (or any other token).
+	mutex  sync.Mutex
 	bearer *tokenResponse
-	basic  string
 
 	registry string
-	scopes   []string
+	scopes   []*scope
+
+	// expires is when the bearer token expires
+	expires time.Time
+
+	// realm and service are from the challenge, so that we can fetch a fresh token when this one expires
+	realm   string
+	service string
+
+	// credentials are the base64 encoded basic credentials for the token server
+	credentials string
+	// refreshToken is an OAuth2 refresh token, which we prefer to credentials if we have one
+	refreshToken string
 }
 
 type tokenResponse struct {
-	Token       string `json:"token"`
-	AccessToken string `json:"access_token"`
-	ExpiresIn   int    `json:"expires_in"`
-	IssuedAt    string `json:"issued_at"`
+	Token        string `json:"token"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	IssuedAt     string `json:"issued_at"`
 }
 
+// defaultTokenExpiresIn is the token lifetime in seconds if the server doesn't specify it, per the token spec
+const defaultTokenExpiresIn = 60
+
+// tokenExpiryMargin is how long before expiry we stop using a token, so it doesn't expire mid-request
+const tokenExpiryMargin = 20 * time.Second
+
+// oauthClientID identifies us to token servers in the OAuth2 flows
+const oauthClientID = "kcb"
+
 type dockerConfig struct {
 	Auths map[string]*dockerConfigAuth `json:"auths"`
+
+	// CredsStore is the credential helper used for all registries, unless overridden in CredHelpers
+	CredsStore string `json:"credsStore"`
+	// CredHelpers maps registry hostnames to the credential helper for that registry
+	CredHelpers map[string]string `json:"credHelpers"`
 }
 
 type dockerConfigAuth struct {
-	Email string `json:"email"`
+	Email string `json:"email,omitempty"`
 	Auth  string `json:"auth"`
+
+	// IdentityToken is an OAuth2 refresh token, used in place of a password
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// FindHeader returns the authorization header from a cached token with permission on the repository
+// (and any extraScopes, e.g. repository:other:pull), or "" if we don't have a suitable token.
+func (a *Auth) FindHeader(registry *Registry, repository string, permission string, extraScopes ...string) string {
+	return a.findHeaderForScopes(registry, append([]string{repositoryScope(repository, permission).String()}, extraScopes...))
 }
 
-func (a *Auth) FindHeader(registry *Registry, repository string, permission string) string {
-	token := a.findToken(registry, repository, permission)
+// findHeaderForScopes returns the authorization header from a cached token covering all the scopes,
+// or "" if we don't have a suitable token
+func (a *Auth) findHeaderForScopes(registry *Registry, scopes []string) string {
+	var requested []*scope
+	for _, s := range scopes {
+		requested = append(requested, parseScopes(s)...)
+	}
+
+	token := a.findToken(registry, requested)
 	if token == nil {
 		return ""
 	}
 
+	// We only refresh the token we are going to use, and we do it without holding a.mutex
 	header, err := token.GetAuthorizationHeader()
 	if err != nil {
-		glog.Infof("error getting header from token: %v", err)
+		glog.V(2).Infof("evicting token for %s: %v", scopesString(token.scopes), err)
+		a.removeToken(token)
+		return ""
 	}
 
 	return header
 }
 
-func (a *Auth) findToken(registry *Registry, repository string, permission string) *Token {
+// findToken returns a cached token covering the requested scopes, which may need to be refreshed before use.
+// Other tokens which have expired are evicted; we will get a new token if we need them again.
+// Tokens which are only about to expire are kept, as another request may be refreshing them.
+func (a *Auth) findToken(registry *Registry, requested []*scope) *Token {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+
+	var found *Token
+	var keep []*Token
 	for _, token := range a.cache {
-		if token.registry != registry.URL {
+		if found == nil && token.covers(registry, requested) {
+			found = token
+			keep = append(keep, token)
 			continue
 		}
-
-		if token.basic != "" {
-			return token
+		if token.expired(now) {
+			glog.V(2).Infof("evicting expired token for %s", scopesString(token.scopes))
+			continue
 		}
+		keep = append(keep, token)
+	}
+	a.cache = keep
 
-		if token.bearer != nil {
-			scope := "repository:" + repository + ":" + permission
-			for _, s := range token.scopes {
-				if s == scope {
-					return token
-				}
-			}
+	if found == nil {
+		glog.V(4).Infof("Could not find cached token for %s", scopesString(requested))
+	}
+	return found
+}
+
+// covers returns true if the token can be used for the requested scopes on the registry
+func (t *Token) covers(registry *Registry, requested []*scope) bool {
+	if t.registry != registry.URL {
+		return false
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.basic == "" && t.bearer == nil {
+		return false
+	}
+	return scopesCover(t.scopes, requested)
+}
+
+// removeToken removes the token from the cache
+func (a *Auth) removeToken(token *Token) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var keep []*Token
+	for _, t := range a.cache {
+		if t != token {
+			keep = append(keep, t)
 		}
 	}
-	glog.V(4).Infof("Could not find cached token for %s %s", repository, permission)
-	return nil
+	a.cache = keep
 }
 
 func tokenizeWWWAuthenticate(s string) []string {
@@ -104,7 +199,11 @@ func tokenizeWWWAuthenticate(s string) []string {
 	return strings.FieldsFunc(s, f)
 }
 
-func (a *Auth) GetHeader(registry *Registry, resp *http.Response) (string, error) {
+// GetHeader responds to the www-authenticate challenge in resp, returning the authorization header to retry with.
+// extraScopes are requested in addition to those in the challenge, so that a single token can cover
+// several repositories (e.g. for cross-repository mounts).  A basic challenge has no scope, so basic
+// credentials are cached for just the extraScopes, and we are challenged again for other repositories.
+func (a *Auth) GetHeader(registry *Registry, resp *http.Response, extraScopes ...string) (string, error) {
 	wwwAuthenticate := resp.Header.Get("www-authenticate")
 	if wwwAuthenticate == "" {
 		return "", fmt.Errorf("Permission error, but did not recieve www-authenticate header")
@@ -142,7 +241,12 @@ func (a *Auth) GetHeader(registry *Registry, resp *http.Response) (string, error
 			return "", fmt.Errorf("realm not specified in www-authenticate header: %q", wwwAuthenticate)
 		}
 
-		token, err := a.getToken(registry, service, scope, realm)
+		scopes := parseScopes(scope)
+		for _, s := range extraScopes {
+			scopes = append(scopes, parseScopes(s)...)
+		}
+
+		token, err := a.getToken(registry, service, mergeScopes(scopes), realm)
 		if err != nil {
 			return "", err
 		}
@@ -168,13 +272,19 @@ func (a *Auth) GetHeader(registry *Registry, resp *http.Response) (string, error
 			return "", nil
 		}
 
+		var scopes []*scope
+		for _, s := range extraScopes {
+			scopes = append(scopes, parseScopes(s)...)
+		}
+
 		token := &Token{
 			auth:  a,
 			basic: authConfig.Auth,
 
 			registry: registry.URL,
+			scopes:   mergeScopes(scopes),
 		}
-		a.cache = append(a.cache, token)
+		a.addToken(token)
 		return token.GetAuthorizationHeader()
 	} else {
 		return "", fmt.Errorf("unknown www-authenticate challenge: %q", wwwAuthenticate)
@@ -182,6 +292,12 @@ func (a *Auth) GetHeader(registry *Registry, resp *http.Response) (string, error
 }
 
 func (a *Auth) getAuthentication(site string) (*dockerConfigAuth, error) {
+	if a.Username != "" {
+		return &dockerConfigAuth{
+			Auth: base64.StdEncoding.EncodeToString([]byte(a.Username + ":" + a.Password)),
+		}, nil
+	}
+
 	var errors []error
 
 	config := os.Getenv("REGISTRY_CONFIG")
@@ -196,7 +312,7 @@ func (a *Auth) getAuthentication(site string) (*dockerConfigAuth, error) {
 	}
 
 	{
-		p := filepath.Join(os.Getenv("HOME"), ".docker/config.json")
+		p := dockerConfigPath()
 		b, err := ioutil.ReadFile(p)
 		if err != nil {
 			if !os.IsNotExist(err) {
@@ -259,6 +375,16 @@ func getAuthentication(config []byte, site string) (*dockerConfigAuth, error) {
 		return nil, fmt.Errorf("error parsing: %v", err)
 	}
 
+	if helper := findCredentialHelper(conf, site); helper != "" {
+		auth, err := getCredentialsFromHelper(helper, site)
+		if err != nil {
+			return nil, err
+		}
+		if auth != nil {
+			return auth, nil
+		}
+	}
+
 	return getAuthenticationFromAuths(conf.Auths, site)
 }
 
@@ -279,8 +405,8 @@ func getLegacyAuthentication(config []byte, site string) (*dockerConfigAuth, err
 
 func getAuthenticationFromAuths(conf map[string]*dockerConfigAuth, site string) (*dockerConfigAuth, error) {
 	var keys []string
-	if site == "" || site == "https://registry-1.docker.io/" {
-		keys = append(keys, "https://registry-1.docker.io/")
+	if site == "" || site == DockerHubURL {
+		keys = append(keys, DockerHubURL)
 		keys = append(keys, "https://index.docker.io/")
 		keys = append(keys, "https://index.docker.io/v1/")
 	} else {
@@ -306,15 +432,17 @@ func getAuthenticationFromAuths(conf map[string]*dockerConfigAuth, site string)
 	return nil, nil
 }
 
-func (a *Auth) getToken(registry *Registry, service string, scope string, realm string) (*Token, error) {
-	httpClient := a.HttpClient
-	if httpClient == nil {
-		httpClient = http.DefaultClient
-	}
+func (a *Auth) addToken(token *Token) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.cache = append(a.cache, token)
+}
 
+func (a *Auth) getToken(registry *Registry, service string, scopes []*scope, realm string) (*Token, error) {
 	site := registry.URL
 	if site == "" {
-		site = "https://registry-1.docker.io/"
+		site = DockerHubURL
 	}
 	glog.Infof("Requesting docker token for %s", site)
 
@@ -323,21 +451,106 @@ func (a *Auth) getToken(registry *Registry, service string, scope string, realm
 		return nil, err
 	}
 
-	// e.g. "https://auth.docker.io/token?service=registry.docker.io&scope=" + scope
-	authUrl := realm
-	var params []string
-	if service != "" {
-		params = append(params, "service="+url.QueryEscape(service))
+	token := &Token{
+		auth:     a,
+		registry: registry.URL,
+		scopes:   scopes,
+
+		realm:   realm,
+		service: service,
 	}
-	if scope != "" {
-		params = append(params, "scope="+url.QueryEscape(scope))
+	if auth != nil {
+		token.credentials = auth.Auth
+		token.refreshToken = auth.IdentityToken
 	}
-	if len(params) != 0 {
-		authUrl += "?" + strings.Join(params, "&")
+
+	if err := token.fetch(); err != nil {
+		return nil, err
 	}
-	req, err := http.NewRequest("GET", authUrl, nil)
-	if auth != nil && auth.Auth != "" {
-		req.Header.Add("authorization", "Basic "+auth.Auth)
+
+	a.addToken(token)
+	return token, nil
+}
+
+// fetch requests a new bearer token from the token server.  If we have a refresh token (either an identity token
+// from the docker config, or one issued with a previous token) we use the OAuth2 flow, otherwise we
+// request a token using our basic credentials, asking for a refresh token for next time.
+// The caller must not hold t.mutex.
+func (t *Token) fetch() error {
+	t.mutex.Lock()
+	refreshToken := t.refreshToken
+	t.mutex.Unlock()
+
+	data, err := t.requestToken(refreshToken)
+	if err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.bearer = data
+	t.expires = data.expiry(time.Now())
+	if data.RefreshToken != "" {
+		t.refreshToken = data.RefreshToken
+	}
+	return nil
+}
+
+// requestToken asks the token server for a bearer token, using refreshToken if set, otherwise our credentials
+func (t *Token) requestToken(refreshToken string) (*tokenResponse, error) {
+	httpClient := t.auth.HttpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	scope := scopesString(t.scopes)
+
+	var req *http.Request
+	if refreshToken != "" {
+		form := url.Values{}
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", refreshToken)
+		form.Set("client_id", oauthClientID)
+		if t.service != "" {
+			form.Set("service", t.service)
+		}
+		if scope != "" {
+			form.Set("scope", scope)
+		}
+
+		r, err := http.NewRequest("POST", t.realm, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, fmt.Errorf("error building token request: %v", err)
+		}
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req = r
+	} else {
+		// e.g. "https://auth.docker.io/token?service=registry.docker.io&scope=" + scope
+		authUrl := t.realm
+		var params []string
+		if t.service != "" {
+			params = append(params, "service="+url.QueryEscape(t.service))
+		}
+		// A challenge can carry several space-separated scopes (e.g. for cross-repository mounts);
+		// token servers expect each as a separate parameter
+		for _, s := range t.scopes {
+			params = append(params, "scope="+url.QueryEscape(s.String()))
+		}
+		if t.credentials != "" {
+			params = append(params, "offline_token=true", "client_id="+url.QueryEscape(oauthClientID))
+		}
+		if len(params) != 0 {
+			authUrl += "?" + strings.Join(params, "&")
+		}
+		r, err := http.NewRequest("GET", authUrl, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error building token request: %v", err)
+		}
+		if t.credentials != "" {
+			r.Header.Add("authorization", "Basic "+t.credentials)
+		}
+		req = r
 	}
 	glog.V(2).Infof("HTTP %s %s", req.Method, req.URL)
 
@@ -365,17 +578,58 @@ func (a *Auth) getToken(registry *Registry, service string, scope string, realm
 		return nil, fmt.Errorf("error parsing response: %v", err)
 	}
 
-	// TODO split scope so repository:a:push,pull => repository:a:pull
-	scopes := []string{scope}
+	// OAuth2 responses only set access_token
+	if data.Token == "" {
+		data.Token = data.AccessToken
+	}
+	if data.Token == "" {
+		return nil, fmt.Errorf("token server did not return a token for %q", scope)
+	}
 
-	token := &Token{
-		auth:     a,
-		bearer:   data,
-		registry: registry.URL,
-		scopes:   scopes,
+	return data, nil
+}
+
+// expiry computes when the token expires, from issued_at (if the server told us) and expires_in
+func (r *tokenResponse) expiry(now time.Time) time.Time {
+	issuedAt := now
+	if r.IssuedAt != "" {
+		t, err := time.Parse(time.RFC3339, r.IssuedAt)
+		if err != nil {
+			glog.V(2).Infof("ignoring unparseable issued_at %q: %v", r.IssuedAt, err)
+		} else if t.Before(now) {
+			// Don't trust a server clock that is ahead of ours
+			issuedAt = t
+		}
 	}
-	a.cache = append(a.cache, token)
-	return token, nil
+
+	expiresIn := r.ExpiresIn
+	if expiresIn <= 0 {
+		expiresIn = defaultTokenExpiresIn
+	}
+	return issuedAt.Add(time.Duration(expiresIn) * time.Second)
+}
+
+// expired returns true if the bearer token has expired
+func (t *Token) expired(now time.Time) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.bearer != nil && !t.expires.IsZero() && now.After(t.expires)
+}
+
+// expiring is isExpiring for callers which don't hold t.mutex
+func (t *Token) expiring(now time.Time) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.isExpiring(now)
+}
+
+// isExpiring returns true if the token expires within tokenExpiryMargin, so should not be used.
+// The caller must hold t.mutex.
+func (t *Token) isExpiring(now time.Time) bool {
+	if t.bearer == nil || t.expires.IsZero() {
+		return false
+	}
+	return !now.Add(tokenExpiryMargin).Before(t.expires)
 }
 
 func (t *Token) GetAuthorizationHeader() (string, error) {
@@ -383,8 +637,18 @@ func (t *Token) GetAuthorizationHeader() (string, error) {
 		return "Basic " + t.basic, nil
 	}
 
+	if t.expiring(time.Now()) {
+		// Concurrent callers may both refresh the token; that is harmless, and better than waiting on each other
+		glog.V(2).Infof("refreshing docker token for %s", scopesString(t.scopes))
+		if err := t.fetch(); err != nil {
+			return "", fmt.Errorf("error refreshing expired token: %v", err)
+		}
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
 	if t.bearer != nil {
-		// TODO: Check expiration and refresh
 		return "Bearer " + t.bearer.Token, nil
 	}
 
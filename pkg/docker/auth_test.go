@@ -1,8 +1,13 @@
 package docker
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestGetAuthentication(t *testing.T) {
@@ -50,3 +55,263 @@ func TestGetAuthentication(t *testing.T) {
 	}
 
 }
+
+func TestTokenExpiry(t *testing.T) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	grid := []struct {
+		Response tokenResponse
+		Expected time.Time
+	}{
+		{
+			Response: tokenResponse{ExpiresIn: 300},
+			Expected: now.Add(300 * time.Second),
+		},
+		{
+			// Per the spec, tokens without expires_in last 60 seconds
+			Response: tokenResponse{},
+			Expected: now.Add(60 * time.Second),
+		},
+		{
+			Response: tokenResponse{ExpiresIn: 300, IssuedAt: "2017-06-01T11:58:00Z"},
+			Expected: now.Add(180 * time.Second),
+		},
+		{
+			// issued_at in the future (clock skew) is ignored
+			Response: tokenResponse{ExpiresIn: 300, IssuedAt: "2017-06-01T13:00:00Z"},
+			Expected: now.Add(300 * time.Second),
+		},
+	}
+
+	for _, g := range grid {
+		actual := g.Response.expiry(now)
+		if !actual.Equal(g.Expected) {
+			t.Errorf("unexpected expiry for %+v: actual=%v expected=%v", g.Response, actual, g.Expected)
+		}
+	}
+}
+
+func TestTokenRefresh(t *testing.T) {
+	var requests []*http.Request
+	issued := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		requests = append(requests, req)
+		issued++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": "token-%d", "refresh_token": "refresh-%d", "expires_in": 300}`, issued, issued)
+	}))
+	defer server.Close()
+
+	auth := &Auth{}
+	registry := &Registry{URL: "https://registry.example.com"}
+	token := &Token{
+		auth:     auth,
+		registry: registry.URL,
+		scopes:   parseScopes("repository:foo/bar:pull"),
+		realm:    server.URL,
+		service:  "registry.example.com",
+
+		credentials: "aGVsbG86d29ybGQ=",
+	}
+	if err := token.fetch(); err != nil {
+		t.Fatalf("unexpected error fetching token: %v", err)
+	}
+	auth.cache = append(auth.cache, token)
+
+	if header := auth.FindHeader(registry, "foo/bar", "pull"); header != "Bearer token-1" {
+		t.Errorf("unexpected header %q", header)
+	}
+	if requests[0].Method != "GET" || requests[0].Header.Get("Authorization") != "Basic aGVsbG86d29ybGQ=" {
+		t.Errorf("expected first token to be requested with basic credentials")
+	}
+
+	// Once the token is about to expire, it should be refreshed using the refresh token
+	token.expires = time.Now().Add(tokenExpiryMargin / 2)
+	if header := auth.FindHeader(registry, "foo/bar", "pull"); header != "Bearer token-2" {
+		t.Errorf("unexpected header after refresh %q", header)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("expected token to be refreshed, got %d requests", len(requests))
+	}
+	refresh := requests[1]
+	if refresh.Method != "POST" || refresh.PostForm.Get("grant_type") != "refresh_token" || refresh.PostForm.Get("refresh_token") != "refresh-1" {
+		t.Errorf("unexpected refresh request: %s %v", refresh.Method, refresh.PostForm)
+	}
+	if refresh.PostForm.Get("scope") != "repository:foo/bar:pull" {
+		t.Errorf("unexpected scope in refresh request: %q", refresh.PostForm.Get("scope"))
+	}
+
+	// A token that cannot be refreshed is evicted
+	server.Close()
+	token.expires = time.Now()
+	if header := auth.FindHeader(registry, "foo/bar", "pull"); header != "" {
+		t.Errorf("expected no header for expired token, got %q", header)
+	}
+	if len(auth.cache) != 0 {
+		t.Errorf("expected expired token to be evicted")
+	}
+}
+
+func TestAuthConcurrentUse(t *testing.T) {
+	auth := &Auth{}
+	registry := &Registry{URL: "https://registry.example.com"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			repository := fmt.Sprintf("foo/bar%d", i%3)
+			auth.addToken(&Token{
+				auth:     auth,
+				bearer:   &tokenResponse{Token: repository},
+				registry: registry.URL,
+				scopes:   parseScopes("repository:" + repository + ":pull,push"),
+				expires:  time.Now().Add(time.Hour),
+			})
+			if header := auth.FindHeader(registry, repository, "pull"); header != "Bearer "+repository {
+				t.Errorf("unexpected header for %s: %q", repository, header)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestTokenRefreshOnlyForRequestedScope(t *testing.T) {
+	var mutex sync.Mutex
+	var refreshed []string
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		scope := req.PostForm.Get("scope")
+		mutex.Lock()
+		refreshed = append(refreshed, scope)
+		mutex.Unlock()
+
+		// Hold up the refresh, so we can check it doesn't block other requests
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": "refreshed-%s", "expires_in": 300}`, scope)
+	}))
+	defer server.Close()
+
+	auth := &Auth{}
+	registry := &Registry{URL: "https://registry.example.com"}
+	for _, repository := range []string{"foo", "bar", "baz"} {
+		expires := time.Now().Add(time.Hour)
+		switch repository {
+		case "foo":
+			expires = time.Now().Add(tokenExpiryMargin / 2)
+		case "baz":
+			expires = time.Now().Add(-time.Second)
+		}
+		auth.addToken(&Token{
+			auth:         auth,
+			bearer:       &tokenResponse{Token: repository},
+			registry:     registry.URL,
+			scopes:       parseScopes("repository:" + repository + ":pull"),
+			expires:      expires,
+			realm:        server.URL,
+			refreshToken: "refresh-" + repository,
+		})
+	}
+
+	done := make(chan string)
+	go func() {
+		done <- auth.FindHeader(registry, "foo", "pull")
+	}()
+
+	// While foo is refreshing, we can still use the token for bar, and the token for foo stays in the cache
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mutex.Lock()
+		n := len(refreshed)
+		mutex.Unlock()
+		if n != 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("token for foo was not refreshed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if header := auth.FindHeader(registry, "bar", "pull"); header != "Bearer bar" {
+		t.Errorf("unexpected header for bar: %q", header)
+	}
+
+	close(release)
+	if header := <-done; header != "Bearer refreshed-repository:foo:pull" {
+		t.Errorf("unexpected header for foo after refresh: %q", header)
+	}
+	if header := auth.FindHeader(registry, "foo", "pull"); header != "Bearer refreshed-repository:foo:pull" {
+		t.Errorf("expected refreshed token for foo to be cached, got %q", header)
+	}
+
+	// Only the requested token is refreshed; the expired token for baz is dropped instead
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(refreshed) != 1 || refreshed[0] != "repository:foo:pull" {
+		t.Errorf("expected only foo to be refreshed, refreshed %v", refreshed)
+	}
+	if header := auth.FindHeader(registry, "baz", "pull"); header != "" {
+		t.Errorf("expected expired token for baz to be evicted, got %q", header)
+	}
+}
+
+func TestBasicTokenScopedToRepository(t *testing.T) {
+	var mutex sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		authorization := req.Header.Get("Authorization")
+		requests = append(requests, fmt.Sprintf("%s %s", req.URL.Path, authorization))
+		if authorization != "Basic aGVsbG86d29ybGQ=" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(401)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	registry := &Registry{URL: server.URL}
+	auth := &Auth{Username: "hello", Password: "world"}
+
+	for _, repository := range []string{"a", "a", "b"} {
+		resp, err := registry.do(auth, &registryRequest{
+			Method:     "GET",
+			URL:        server.URL + "/v2/" + repository + "/tags/list",
+			Repository: repository,
+			Permission: "pull",
+		})
+		if err != nil {
+			t.Fatalf("error from request to %s: %v", repository, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Errorf("unexpected status for %s: %d", repository, resp.StatusCode)
+		}
+	}
+
+	// The credentials are sent to a once challenged for it, but b must challenge us again
+	expected := []string{
+		"/v2/a/tags/list ",
+		"/v2/a/tags/list Basic aGVsbG86d29ybGQ=",
+		"/v2/a/tags/list Basic aGVsbG86d29ybGQ=",
+		"/v2/b/tags/list ",
+		"/v2/b/tags/list Basic aGVsbG86d29ybGQ=",
+	}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("unexpected requests %q", requests)
+	}
+
+	if auth.FindHeader(registry, "a", "pull") == "" || auth.FindHeader(registry, "b", "pull") == "" {
+		t.Errorf("expected basic tokens to be cached for a and b")
+	}
+	if auth.FindHeader(registry, "c", "pull") != "" || auth.FindHeader(registry, "a", "pull,push") != "" {
+		t.Errorf("basic token should not be used beyond the scopes it was challenged for")
+	}
+}
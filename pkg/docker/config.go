@@ -0,0 +1,182 @@
+package docker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+)
+
+// dockerConfigPath returns the path to the docker config file, honoring DOCKER_CONFIG like the docker CLI
+func dockerConfigPath() string {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+	return filepath.Join(dir, "config.json")
+}
+
+// credentialServerURL returns the key under which we store credentials for the site, matching the docker CLI
+func credentialServerURL(site string) string {
+	if isDockerHub(site) {
+		return dockerHubServerURL
+	}
+	return registryHost(site)
+}
+
+// SaveCredentials stores the credentials for the registry in the docker config, in the same format
+// we read them.  If a credential helper is configured for the registry, the credentials are stored there instead.
+func SaveCredentials(registry *Registry, username string, password string) error {
+	site := registry.URL
+	serverURL := credentialServerURL(site)
+
+	p := dockerConfigPath()
+	raw, conf, err := readDockerConfig(p)
+	if err != nil {
+		return err
+	}
+
+	if helper := findCredentialHelper(conf, site); helper != "" {
+		request, err := json.Marshal(&credentialHelperResponse{
+			ServerURL: serverURL,
+			Username:  username,
+			Secret:    password,
+		})
+		if err != nil {
+			return fmt.Errorf("error serializing credentials: %v", err)
+		}
+		if _, err := runCredentialHelper(helper, "store", string(request)); err != nil {
+			return err
+		}
+		glog.Infof("Stored credentials for %s in credential helper %s", serverURL, helper)
+		return nil
+	}
+
+	auths, err := rawAuths(raw)
+	if err != nil {
+		return fmt.Errorf("error parsing %q: %v", p, err)
+	}
+
+	entry, err := json.Marshal(&dockerConfigAuth{
+		Auth: base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+	})
+	if err != nil {
+		return fmt.Errorf("error serializing credentials: %v", err)
+	}
+	auths[serverURL] = entry
+
+	return writeDockerConfig(p, raw, auths)
+}
+
+// RemoveCredentials removes the credentials for the registry from the docker config (and credential helper).
+// It returns false if there were no credentials to remove.
+func RemoveCredentials(registry *Registry) (bool, error) {
+	site := registry.URL
+	serverURL := credentialServerURL(site)
+
+	p := dockerConfigPath()
+	raw, conf, err := readDockerConfig(p)
+	if err != nil {
+		return false, err
+	}
+
+	removed := false
+
+	if helper := findCredentialHelper(conf, site); helper != "" {
+		existing, err := runCredentialHelper(helper, "get", serverURL)
+		if err != nil {
+			return false, err
+		}
+		if existing != nil {
+			if _, err := runCredentialHelper(helper, "erase", serverURL); err != nil {
+				return false, err
+			}
+			removed = true
+		}
+	}
+
+	auths, err := rawAuths(raw)
+	if err != nil {
+		return false, fmt.Errorf("error parsing %q: %v", p, err)
+	}
+	if _, found := auths[serverURL]; found {
+		delete(auths, serverURL)
+		if err := writeDockerConfig(p, raw, auths); err != nil {
+			return false, err
+		}
+		removed = true
+	}
+
+	return removed, nil
+}
+
+// readDockerConfig reads the docker config, both as raw fields (so we can preserve fields we don't understand)
+// and parsed.  A missing file is treated as empty.
+func readDockerConfig(p string) (map[string]json.RawMessage, *dockerConfig, error) {
+	raw := make(map[string]json.RawMessage)
+	conf := &dockerConfig{}
+
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return raw, conf, nil
+		}
+		return nil, nil, fmt.Errorf("error reading %q: %v", p, err)
+	}
+
+	if len(b) != 0 {
+		if err := json.Unmarshal(b, &raw); err != nil {
+			return nil, nil, fmt.Errorf("error parsing %q: %v", p, err)
+		}
+		if err := json.Unmarshal(b, conf); err != nil {
+			return nil, nil, fmt.Errorf("error parsing %q: %v", p, err)
+		}
+	}
+
+	return raw, conf, nil
+}
+
+// rawAuths returns the auths entries from the raw config, keeping each entry unparsed
+func rawAuths(raw map[string]json.RawMessage) (map[string]json.RawMessage, error) {
+	auths := make(map[string]json.RawMessage)
+	if b := raw["auths"]; len(b) != 0 {
+		if err := json.Unmarshal(b, &auths); err != nil {
+			return nil, err
+		}
+	}
+	return auths, nil
+}
+
+func writeDockerConfig(p string, raw map[string]json.RawMessage, auths map[string]json.RawMessage) error {
+	b, err := json.Marshal(auths)
+	if err != nil {
+		return fmt.Errorf("error serializing auths: %v", err)
+	}
+	raw["auths"] = b
+
+	data, err := json.MarshalIndent(raw, "", "\t")
+	if err != nil {
+		return fmt.Errorf("error serializing docker config: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return fmt.Errorf("error creating directory for %q: %v", p, err)
+	}
+
+	// Write to a temp file and rename, so we never leave a truncated config behind
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("error writing %q: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error writing %q: %v", p, err)
+	}
+
+	glog.V(2).Infof("wrote docker config %q", p)
+	return nil
+}
@@ -0,0 +1,85 @@
+package docker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSaveAndRemoveCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-config")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldDockerConfig := os.Getenv("DOCKER_CONFIG")
+	os.Setenv("DOCKER_CONFIG", dir)
+	defer os.Setenv("DOCKER_CONFIG", oldDockerConfig)
+
+	// Fields we don't understand must be preserved
+	p := filepath.Join(dir, "config.json")
+	existing := `{"auths": {"quay.io": {"auth": "cXVheTpxdWF5", "email": "me@example.com"}}, "detachKeys": "ctrl-e,e"}`
+	if err := ioutil.WriteFile(p, []byte(existing), 0600); err != nil {
+		t.Fatalf("error writing config: %v", err)
+	}
+
+	registry := &Registry{URL: "https://private.registry.io"}
+	if err := SaveCredentials(registry, "hello", "world"); err != nil {
+		t.Fatalf("unexpected error saving credentials: %v", err)
+	}
+	if err := SaveCredentials(&Registry{}, "hub", "user"); err != nil {
+		t.Fatalf("unexpected error saving credentials: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatalf("error reading config: %v", err)
+	}
+
+	// We should read back what we wrote
+	for site, expected := range map[string]string{
+		"https://private.registry.io":   "aGVsbG86d29ybGQ=",
+		"https://registry-1.docker.io/": "aHViOnVzZXI=",
+		"https://quay.io":               "cXVheTpxdWF5",
+	} {
+		auth, err := getAuthentication(b, site)
+		if err != nil {
+			t.Fatalf("unexpected error reading credentials: %v", err)
+		}
+		if auth == nil || auth.Auth != expected {
+			t.Errorf("unexpected credentials for %s: %v", site, auth)
+		}
+	}
+
+	removed, err := RemoveCredentials(registry)
+	if err != nil || !removed {
+		t.Fatalf("expected credentials to be removed: removed=%v err=%v", removed, err)
+	}
+	removed, err = RemoveCredentials(registry)
+	if err != nil || removed {
+		t.Fatalf("expected no credentials to remove: removed=%v err=%v", removed, err)
+	}
+
+	b, err = ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatalf("error reading config: %v", err)
+	}
+	var actual map[string]interface{}
+	if err := json.Unmarshal(b, &actual); err != nil {
+		t.Fatalf("error parsing config: %v", err)
+	}
+	expected := map[string]interface{}{
+		"auths": map[string]interface{}{
+			"quay.io":                     map[string]interface{}{"auth": "cXVheTpxdWF5", "email": "me@example.com"},
+			"https://index.docker.io/v1/": map[string]interface{}{"auth": "aHViOnVzZXI="},
+		},
+		"detachKeys": "ctrl-e,e",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected config after logout: %s", string(b))
+	}
+}
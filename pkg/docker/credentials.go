@@ -0,0 +1,130 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// credentialHelperPrefix is prepended to the helper name to find the helper binary
+const credentialHelperPrefix = "docker-credential-"
+
+// credentialsNotFound is the message helpers return when they have no credentials for the server
+const credentialsNotFound = "credentials not found in native keychain"
+
+// identityTokenUsername is the username helpers return when the secret is an identity token
+const identityTokenUsername = "<token>"
+
+// dockerHubServerURL is the key docker uses for Docker Hub credentials
+const dockerHubServerURL = "https://index.docker.io/v1/"
+
+type credentialHelperResponse struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// isDockerHub returns true if the site is Docker Hub
+func isDockerHub(site string) bool {
+	switch registryHost(site) {
+	case "", "registry-1.docker.io", "index.docker.io", "docker.io":
+		return true
+	}
+	return false
+}
+
+// registryHost returns the hostname (and port) of a site, e.g. https://gcr.io/ => gcr.io
+func registryHost(site string) string {
+	host := strings.TrimPrefix(site, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	if i := strings.Index(host, "/"); i != -1 {
+		host = host[:i]
+	}
+	return host
+}
+
+// credentialServerURLs returns the server URLs under which credentials for the site might be stored
+func credentialServerURLs(site string) []string {
+	if isDockerHub(site) {
+		return []string{dockerHubServerURL}
+	}
+	host := registryHost(site)
+	return []string{host, "https://" + host}
+}
+
+// findCredentialHelper returns the credential helper configured for the site, or "" if there is none.
+// A per-registry credHelpers entry takes precedence over the global credsStore.
+func findCredentialHelper(conf *dockerConfig, site string) string {
+	keys := []string{registryHost(site)}
+	if isDockerHub(site) {
+		keys = []string{"index.docker.io", "docker.io", "registry-1.docker.io", dockerHubServerURL}
+	}
+	for _, k := range keys {
+		if helper := conf.CredHelpers[k]; helper != "" {
+			return helper
+		}
+	}
+	return conf.CredsStore
+}
+
+// getCredentialsFromHelper runs `docker-credential-<helper> get`, returning nil if the helper has no credentials
+func getCredentialsFromHelper(helper string, site string) (*dockerConfigAuth, error) {
+	for _, serverURL := range credentialServerURLs(site) {
+		response, err := runCredentialHelper(helper, "get", serverURL)
+		if err != nil {
+			return nil, err
+		}
+		if response == nil {
+			continue
+		}
+
+		creds := &credentialHelperResponse{}
+		if err := json.Unmarshal(response, creds); err != nil {
+			return nil, fmt.Errorf("error parsing response from credential helper %s: %v", helper, err)
+		}
+
+		if creds.Username == identityTokenUsername {
+			glog.Infof("Found identity token for %s in credential helper %s", serverURL, helper)
+			return &dockerConfigAuth{IdentityToken: creds.Secret}, nil
+		}
+
+		glog.Infof("Found credentials for %s in credential helper %s", serverURL, helper)
+		return &dockerConfigAuth{
+			Auth: base64.StdEncoding.EncodeToString([]byte(creds.Username + ":" + creds.Secret)),
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// runCredentialHelper invokes the helper with the given action, writing input to stdin.
+// It returns nil (and no error) if the helper reports that it has no credentials.
+func runCredentialHelper(helper string, action string, input string) ([]byte, error) {
+	name := credentialHelperPrefix + helper
+
+	cmd := exec.Command(name, action)
+	cmd.Stdin = strings.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	glog.V(2).Infof("running credential helper: %s %s", name, action)
+	err := cmd.Run()
+	if err != nil {
+		message := strings.TrimSpace(stdout.String())
+		if message == credentialsNotFound {
+			return nil, nil
+		}
+		if _, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("credential helper %s %s failed: %s %s", name, action, message, strings.TrimSpace(stderr.String()))
+		}
+		return nil, fmt.Errorf("error running credential helper %s: %v", name, err)
+	}
+
+	return stdout.Bytes(), nil
+}
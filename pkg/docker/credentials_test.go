@@ -0,0 +1,166 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fakeCredentialHelper is a docker-credential-* helper which knows about a fixed set of servers
+const fakeCredentialHelper = `#!/bin/sh
+read server
+case "$1:$server" in
+  "get:https://index.docker.io/v1/")
+    echo '{"ServerURL":"https://index.docker.io/v1/","Username":"hello","Secret":"world"}'
+    ;;
+  "get:gcr.io")
+    echo '{"ServerURL":"gcr.io","Username":"<token>","Secret":"refresh-me"}'
+    ;;
+  "get:broken.example.com")
+    echo 'something went wrong' >&2
+    exit 2
+    ;;
+  *)
+    echo 'credentials not found in native keychain'
+    exit 1
+    ;;
+esac
+`
+
+// installFakeCredentialHelpers writes the fake helper under each name into a temp dir, and puts it on the PATH
+func installFakeCredentialHelpers(t *testing.T, names ...string) func() {
+	dir, err := ioutil.TempDir("", "credential-helpers")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+
+	for _, name := range names {
+		p := filepath.Join(dir, credentialHelperPrefix+name)
+		if err := ioutil.WriteFile(p, []byte(fakeCredentialHelper), 0755); err != nil {
+			t.Fatalf("error writing fake credential helper: %v", err)
+		}
+	}
+
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+oldPath)
+
+	return func() {
+		os.Setenv("PATH", oldPath)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestGetAuthenticationFromCredentialHelpers(t *testing.T) {
+	defer installFakeCredentialHelpers(t, "store", "gcr")()
+
+	credsStore := `
+	{
+		"auths": {
+			"https://index.docker.io/v1/": {}
+		},
+		"credsStore": "store"
+	}
+`
+
+	credHelpers := `
+	{
+		"auths": {
+			"https://private.registry.io": {
+				"auth": "aW5saW5lOmF1dGg="
+			}
+		},
+		"credsStore": "missing",
+		"credHelpers": {
+			"gcr.io": "gcr",
+			"broken.example.com": "store",
+			"private.registry.io": "store"
+		}
+	}
+`
+
+	grid := []struct {
+		Input    string
+		Site     string
+		Expected *dockerConfigAuth
+	}{
+		{
+			Input:    credsStore,
+			Site:     "https://registry-1.docker.io/",
+			Expected: &dockerConfigAuth{Auth: "aGVsbG86d29ybGQ="},
+		},
+		{
+			Input:    credsStore,
+			Site:     "",
+			Expected: &dockerConfigAuth{Auth: "aGVsbG86d29ybGQ="},
+		},
+		{
+			// The helper does not have credentials, and there is no inline auth
+			Input:    credsStore,
+			Site:     "https://private.registry.io",
+			Expected: nil,
+		},
+		{
+			// credHelpers takes precedence over credsStore
+			Input:    credHelpers,
+			Site:     "https://gcr.io",
+			Expected: &dockerConfigAuth{IdentityToken: "refresh-me"},
+		},
+		{
+			// The helper does not have credentials, so we fall back to inline auths
+			Input:    credHelpers,
+			Site:     "https://private.registry.io",
+			Expected: &dockerConfigAuth{Auth: "aW5saW5lOmF1dGg="},
+		},
+	}
+
+	for _, g := range grid {
+		actual, err := getAuthentication([]byte(g.Input), g.Site)
+		if err != nil {
+			t.Errorf("unexpected error getting authentication config for %q: %v", g.Site, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(actual, g.Expected) {
+			t.Errorf("unexpected authConfig for %q: actual=%v expected=%v", g.Site, actual, g.Expected)
+		}
+	}
+
+	// Helper failures are reported
+	if _, err := getAuthentication([]byte(credHelpers), "https://broken.example.com"); err == nil {
+		t.Errorf("expected error from failing credential helper")
+	}
+
+	// A configured helper which is not installed is an error
+	if _, err := getAuthentication([]byte(credHelpers), "https://other.registry.io"); err == nil {
+		t.Errorf("expected error from missing credential helper")
+	}
+}
+
+func TestFindCredentialHelper(t *testing.T) {
+	conf := &dockerConfig{
+		CredsStore: "desktop",
+		CredHelpers: map[string]string{
+			"123456789.dkr.ecr.us-east-1.amazonaws.com": "ecr-login",
+			"localhost:5000": "pass",
+		},
+	}
+
+	grid := []struct {
+		Site     string
+		Expected string
+	}{
+		{Site: "https://123456789.dkr.ecr.us-east-1.amazonaws.com", Expected: "ecr-login"},
+		{Site: "http://localhost:5000/", Expected: "pass"},
+		{Site: "https://quay.io", Expected: "desktop"},
+		{Site: "", Expected: "desktop"},
+	}
+
+	for _, g := range grid {
+		actual := findCredentialHelper(conf, g.Site)
+		if actual != g.Expected {
+			t.Errorf("unexpected credential helper for %q: actual=%q expected=%q", g.Site, actual, g.Expected)
+		}
+	}
+}
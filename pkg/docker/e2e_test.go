@@ -0,0 +1,231 @@
+package docker_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"kope.io/build/pkg/docker"
+	"kope.io/build/pkg/registry"
+)
+
+// startRegistry runs an in-process registry, returning a client for it and a function to stop it
+func startRegistry(t *testing.T, configure func(s *registry.Server)) (*docker.Registry, func()) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+
+	s := registry.NewServer(dir)
+	if configure != nil {
+		configure(s)
+	}
+	server := httptest.NewServer(s)
+
+	return &docker.Registry{URL: server.URL}, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func digestOf(data []byte) string {
+	hash := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
+
+// pushTestImage uploads a config and a layer, and pushes a manifest for them as tag
+func pushTestImage(t *testing.T, r *docker.Registry, auth *docker.Auth, repository string, tag string, layer []byte) *docker.ManifestV2Layer {
+	config := []byte(`{"architecture": "amd64", "os": "linux"}`)
+	for _, blob := range [][]byte{config, layer} {
+		if err := r.UploadBlob(auth, repository, digestOf(blob), bytes.NewReader(blob), int64(len(blob))); err != nil {
+			t.Fatalf("error uploading blob: %v", err)
+		}
+	}
+
+	manifest := &docker.ManifestV2{
+		SchemaVersion: 2,
+		MediaType:     docker.MediaTypeDockerManifest,
+		Config:        &docker.ManifestV2Layer{MediaType: docker.MediaTypeDockerConfig, Size: int64(len(config)), Digest: digestOf(config)},
+		Layers:        []docker.ManifestV2Layer{{MediaType: docker.MediaTypeDockerLayer, Size: int64(len(layer)), Digest: digestOf(layer)}},
+	}
+	descriptor, err := r.PutManifest(auth, repository, tag, manifest)
+	if err != nil {
+		t.Fatalf("error pushing manifest: %v", err)
+	}
+	return descriptor
+}
+
+func TestEndToEndPushAndPull(t *testing.T) {
+	r, stop := startRegistry(t, nil)
+	defer stop()
+
+	// Small chunks, so the upload takes several requests
+	r.ChunkSize = 1000
+	auth := &docker.Auth{}
+
+	layer := bytes.Repeat([]byte("0123456789"), 512)
+	descriptor := pushTestImage(t, r, auth, "team/group/app", "v1", layer)
+
+	found, err := r.HasBlob(auth, "team/group/app", digestOf(layer))
+	if err != nil || !found {
+		t.Fatalf("expected layer to exist after upload: found=%v err=%v", found, err)
+	}
+
+	var downloaded bytes.Buffer
+	if _, err := r.DownloadBlob(auth, "team/group/app", digestOf(layer), &downloaded); err != nil {
+		t.Fatalf("error downloading layer: %v", err)
+	}
+	if !bytes.Equal(downloaded.Bytes(), layer) {
+		t.Errorf("downloaded layer did not match uploaded layer")
+	}
+
+	// Resume part way through
+	var rest bytes.Buffer
+	if _, err := r.DownloadBlobFrom(auth, "team/group/app", digestOf(layer), 1234, &rest); err != nil {
+		t.Fatalf("error resuming download: %v", err)
+	}
+	if !bytes.Equal(rest.Bytes(), layer[1234:]) {
+		t.Errorf("resumed download did not match the rest of the layer")
+	}
+
+	manifest, err := r.GetManifest(auth, "team/group/app", "v1")
+	if err != nil {
+		t.Fatalf("error reading manifest: %v", err)
+	}
+	if manifest.Digest() != descriptor.Digest {
+		t.Errorf("manifest had digest %s, pushed %s", manifest.Digest(), descriptor.Digest)
+	}
+	if len(manifest.Layers) != 1 || manifest.Layers[0].Digest != digestOf(layer) {
+		t.Errorf("unexpected layers in manifest: %v", manifest.Layers)
+	}
+
+	resolved, err := r.ResolveManifest(auth, "team/group/app", "v1")
+	if err != nil {
+		t.Fatalf("error resolving manifest: %v", err)
+	}
+	if resolved != descriptor.Digest {
+		t.Errorf("tag resolved to %s, pushed %s", resolved, descriptor.Digest)
+	}
+
+	// Mount the layer into another repository and tag the image there too
+	mounted, err := r.MountBlob(auth, "other", digestOf(layer), "team/group/app")
+	if err != nil || !mounted {
+		t.Fatalf("expected layer to be mounted: mounted=%v err=%v", mounted, err)
+	}
+	pushTestImage(t, r, auth, "other", "latest", layer)
+	pushTestImage(t, r, auth, "team/group/app", "v2", layer)
+
+	tags, err := r.ListTags(auth, "team/group/app")
+	if err != nil {
+		t.Fatalf("error listing tags: %v", err)
+	}
+	if !reflect.DeepEqual(tags, []string{"v1", "v2"}) {
+		t.Errorf("unexpected tags %v", tags)
+	}
+
+	repositories, err := r.Catalog(auth)
+	if err != nil {
+		t.Fatalf("error listing repositories: %v", err)
+	}
+	if !reflect.DeepEqual(repositories, []string{"other", "team/group/app"}) {
+		t.Errorf("unexpected repositories %v", repositories)
+	}
+}
+
+func TestEndToEndUploadRejectsBadDigest(t *testing.T) {
+	r, stop := startRegistry(t, nil)
+	defer stop()
+	auth := &docker.Auth{}
+
+	data := []byte("some data")
+	if err := r.UploadBlob(auth, "app", digestOf([]byte("other data")), bytes.NewReader(data), int64(len(data))); err == nil {
+		t.Fatalf("expected error uploading blob with the wrong digest")
+	}
+	found, err := r.HasBlob(auth, "app", digestOf([]byte("other data")))
+	if err != nil || found {
+		t.Errorf("blob with bad digest should not be stored: found=%v err=%v", found, err)
+	}
+
+	// Manifests can only refer to blobs in the repository
+	manifest := &docker.ManifestV2{
+		SchemaVersion: 2,
+		MediaType:     docker.MediaTypeDockerManifest,
+		Config:        &docker.ManifestV2Layer{MediaType: docker.MediaTypeDockerConfig, Size: 1, Digest: digestOf([]byte("missing"))},
+	}
+	if _, err := r.PutManifest(auth, "app", "latest", manifest); err == nil {
+		t.Errorf("expected error pushing manifest referring to a missing blob")
+	}
+}
+
+func TestEndToEndDelete(t *testing.T) {
+	var server *registry.Server
+	r, stop := startRegistry(t, func(s *registry.Server) {
+		server = s
+	})
+	defer stop()
+	auth := &docker.Auth{}
+
+	descriptor := pushTestImage(t, r, auth, "app", "preview-1", []byte("layer"))
+
+	// Deletes are disabled by default
+	err := r.DeleteManifest(auth, "app", descriptor.Digest)
+	if err == nil || !strings.Contains(err.Error(), "does not allow deletes") {
+		t.Errorf("expected deletes to be disabled, got %v", err)
+	}
+
+	server.AllowDelete = true
+	if err := r.DeleteManifest(auth, "app", descriptor.Digest); err != nil {
+		t.Fatalf("error deleting manifest: %v", err)
+	}
+	if _, err := r.ResolveManifest(auth, "app", "preview-1"); err == nil {
+		t.Errorf("expected tag to be removed with its manifest")
+	}
+	if err := r.DeleteManifest(auth, "app", descriptor.Digest); err == nil {
+		t.Errorf("expected error deleting a manifest twice")
+	}
+}
+
+func TestEndToEndTokenAuth(t *testing.T) {
+	r, stop := startRegistry(t, func(s *registry.Server) {
+		s.Users = map[string]string{"ci": "secret"}
+	})
+	defer stop()
+
+	// Setting the username means we don't look for credentials in the docker config
+	wrongPassword := &docker.Auth{Username: "ci", Password: "wrong"}
+	if err := r.CheckAuthentication(wrongPassword); err == nil {
+		t.Errorf("expected the registry to reject a bad password")
+	}
+	if _, err := r.ListTags(wrongPassword, "app"); err == nil {
+		t.Errorf("expected the registry to reject a bad password")
+	}
+
+	auth := &docker.Auth{Username: "ci", Password: "secret"}
+	if err := r.CheckAuthentication(auth); err != nil {
+		t.Fatalf("unexpected error checking authentication: %v", err)
+	}
+
+	descriptor := pushTestImage(t, r, auth, "app", "latest", []byte("layer"))
+
+	manifest, err := r.GetManifest(auth, "app", "latest")
+	if err != nil {
+		t.Fatalf("error reading manifest: %v", err)
+	}
+	if manifest.Digest() != descriptor.Digest {
+		t.Errorf("manifest had digest %s, pushed %s", manifest.Digest(), descriptor.Digest)
+	}
+
+	repositories, err := r.Catalog(auth)
+	if err != nil {
+		t.Fatalf("error listing repositories: %v", err)
+	}
+	if !reflect.DeepEqual(repositories, []string{"app"}) {
+		t.Errorf("unexpected repositories %v", repositories)
+	}
+}
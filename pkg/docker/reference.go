@@ -0,0 +1,135 @@
+package docker
+
+import (
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Reference is a parsed image reference, such as registry.example.com:5000/team/app:1.0
+type Reference struct {
+	// Domain is the registry host[:port], or empty for docker hub
+	Domain string
+
+	// Path is the repository in the registry.  Official images on docker hub have the library/ prefix.
+	Path string
+
+	// Tag is the tag, if one was specified
+	Tag string
+
+	// Digest is the manifest digest, if one was specified, e.g. sha256:...
+	Digest string
+}
+
+// maxNameLength is the longest repository name (including the domain) that registries accept
+const maxNameLength = 255
+
+var (
+	// domainRegexp matches host[:port], where host is a dns name or a bracketed ipv6 address
+	domainRegexp = regexp.MustCompile(`^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*|\[[a-fA-F0-9:]+\])(?::[0-9]+)?$`)
+
+	// pathComponentRegexp matches a single component of a repository path, e.g. app in team/app
+	pathComponentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+
+	tagRegexp = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127}$`)
+)
+
+// ParseReference parses an image reference following the grammar of the docker distribution project:
+// [domain/]path[:tag][@digest].  The first path component is the domain if it contains a "." or ":",
+// is localhost, or has upper case letters; otherwise the image is on docker hub.
+// Docker hub references are normalized, so that docker.io/ubuntu has an empty Domain and Path library/ubuntu.
+func ParseReference(s string) (*Reference, error) {
+	if s == "" {
+		return nil, fmt.Errorf("image reference is empty")
+	}
+
+	ref := &Reference{}
+
+	name := s
+	if i := strings.Index(name, "@"); i != -1 {
+		ref.Digest = name[i+1:]
+		name = name[:i]
+		if err := ValidateDigest(ref.Digest); err != nil {
+			return nil, fmt.Errorf("invalid digest in image reference %q: %v", s, err)
+		}
+	}
+
+	// The tag follows the last colon, unless that colon is the port of the domain
+	if i := strings.LastIndex(name, ":"); i != -1 && i > strings.LastIndex(name, "/") {
+		ref.Tag = name[i+1:]
+		name = name[:i]
+		if err := ValidateTag(ref.Tag); err != nil {
+			return nil, fmt.Errorf("invalid image reference %q: %v", s, err)
+		}
+	}
+
+	if len(name) > maxNameLength {
+		return nil, fmt.Errorf("repository name in image reference %q is longer than %d characters", s, maxNameLength)
+	}
+
+	path := name
+	if i := strings.Index(name, "/"); i != -1 {
+		first := name[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" || strings.ToLower(first) != first {
+			ref.Domain = first
+			path = name[i+1:]
+			if !domainRegexp.MatchString(ref.Domain) {
+				return nil, fmt.Errorf("invalid registry %q in image reference %q", ref.Domain, s)
+			}
+		}
+	}
+
+	if err := ValidateRepository(path); err != nil {
+		return nil, fmt.Errorf("invalid image reference %q: %v", s, err)
+	}
+	ref.Path = path
+
+	if isDockerHub(ref.Domain) {
+		ref.Domain = ""
+		if !strings.Contains(ref.Path, "/") {
+			ref.Path = "library/" + ref.Path
+		}
+	}
+
+	return ref, nil
+}
+
+// ValidateRepository checks that path is a valid repository name (without the registry domain), e.g. team/app
+func ValidateRepository(path string) error {
+	if len(path) > maxNameLength {
+		return fmt.Errorf("repository %q is longer than %d characters", path, maxNameLength)
+	}
+	for _, component := range strings.Split(path, "/") {
+		if !pathComponentRegexp.MatchString(component) {
+			if component == "" {
+				return fmt.Errorf("invalid repository %q", path)
+			}
+			return fmt.Errorf("invalid repository %q: %q must be lower case letters and digits, separated by '.', '_', '__' or '-'", path, component)
+		}
+	}
+	return nil
+}
+
+// ValidateTag checks that tag is a valid tag: up to 128 letters, digits, '_', '.' and '-', not starting with '.' or '-'
+func ValidateTag(tag string) error {
+	if !tagRegexp.MatchString(tag) {
+		return fmt.Errorf("invalid tag %q", tag)
+	}
+	return nil
+}
+
+// ValidateDigest checks that s is a digest we can verify, i.e. sha256:<64 hex characters>
+func ValidateDigest(s string) error {
+	if !strings.HasPrefix(s, "sha256:") {
+		return fmt.Errorf("unsupported digest %q - expected sha256:<hex>", s)
+	}
+	hash := strings.TrimPrefix(s, "sha256:")
+	if len(hash) != 64 {
+		return fmt.Errorf("digest %q has wrong length", s)
+	}
+	if _, err := hex.DecodeString(hash); err != nil || strings.ToLower(hash) != hash {
+		return fmt.Errorf("digest %q is not lowercase hex", s)
+	}
+	return nil
+}
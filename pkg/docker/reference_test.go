@@ -0,0 +1,126 @@
+package docker
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+
+	grid := []struct {
+		Input    string
+		Expected *Reference
+	}{
+		// Docker hub
+		{Input: "ubuntu", Expected: &Reference{Path: "library/ubuntu"}},
+		{Input: "ubuntu:14.04", Expected: &Reference{Path: "library/ubuntu", Tag: "14.04"}},
+		{Input: "justinsb/app", Expected: &Reference{Path: "justinsb/app"}},
+		{Input: "justinsb/app:v1", Expected: &Reference{Path: "justinsb/app", Tag: "v1"}},
+		{Input: "team/group/app", Expected: &Reference{Path: "team/group/app"}},
+		{Input: "docker.io/ubuntu", Expected: &Reference{Path: "library/ubuntu"}},
+		{Input: "docker.io/library/ubuntu:latest", Expected: &Reference{Path: "library/ubuntu", Tag: "latest"}},
+		{Input: "index.docker.io/justinsb/app", Expected: &Reference{Path: "justinsb/app"}},
+		{Input: "registry-1.docker.io/justinsb/app", Expected: &Reference{Path: "justinsb/app"}},
+
+		// Domains
+		{Input: "gcr.io/project/app", Expected: &Reference{Domain: "gcr.io", Path: "project/app"}},
+		{Input: "gcr.io/project/group/app:tag", Expected: &Reference{Domain: "gcr.io", Path: "project/group/app", Tag: "tag"}},
+		{Input: "registry.gitlab.com/a/b/c/d/e:1", Expected: &Reference{Domain: "registry.gitlab.com", Path: "a/b/c/d/e", Tag: "1"}},
+		{Input: "localhost/app", Expected: &Reference{Domain: "localhost", Path: "app"}},
+		{Input: "localhost:5000/app", Expected: &Reference{Domain: "localhost:5000", Path: "app"}},
+		{Input: "localhost:5000/team/app:tag", Expected: &Reference{Domain: "localhost:5000", Path: "team/app", Tag: "tag"}},
+		{Input: "registry:5000/app", Expected: &Reference{Domain: "registry:5000", Path: "app"}},
+		{Input: "Registry/app", Expected: &Reference{Domain: "Registry", Path: "app"}},
+		{Input: "10.0.0.1:5000/app:1.0", Expected: &Reference{Domain: "10.0.0.1:5000", Path: "app", Tag: "1.0"}},
+		{Input: "[::1]:5000/app", Expected: &Reference{Domain: "[::1]:5000", Path: "app"}},
+		{Input: "my-registry.example.com/app", Expected: &Reference{Domain: "my-registry.example.com", Path: "app"}},
+
+		// Without a slash, there is no domain and a colon is always the tag
+		{Input: "gcr.io", Expected: &Reference{Path: "library/gcr.io"}},
+		{Input: "localhost:5000", Expected: &Reference{Path: "library/localhost", Tag: "5000"}},
+
+		// Path separators
+		{Input: "a/b.c_d__e-f--g", Expected: &Reference{Path: "a/b.c_d__e-f--g"}},
+
+		// Tags
+		{Input: "app:V1_2.3-rc", Expected: &Reference{Path: "library/app", Tag: "V1_2.3-rc"}},
+		{Input: "app:_x", Expected: &Reference{Path: "library/app", Tag: "_x"}},
+		{Input: "app:" + strings.Repeat("a", 128), Expected: &Reference{Path: "library/app", Tag: strings.Repeat("a", 128)}},
+
+		// Digests
+		{Input: "app@" + digest, Expected: &Reference{Path: "library/app", Digest: digest}},
+		{Input: "app:v1@" + digest, Expected: &Reference{Path: "library/app", Tag: "v1", Digest: digest}},
+		{Input: "localhost:5000/team/app@" + digest, Expected: &Reference{Domain: "localhost:5000", Path: "team/app", Digest: digest}},
+		{Input: "localhost:5000/team/app:tag@" + digest, Expected: &Reference{Domain: "localhost:5000", Path: "team/app", Tag: "tag", Digest: digest}},
+
+		// Invalid references
+		{Input: ""},
+		{Input: "app:"},
+		{Input: "app:-x"},
+		{Input: "app:.x"},
+		{Input: "app:" + strings.Repeat("a", 129)},
+		{Input: "app:a:b"},
+		{Input: "App"},
+		{Input: "team/App"},
+		{Input: "gcr.io/App"},
+		{Input: "-app"},
+		{Input: "app-"},
+		{Input: "a/.b"},
+		{Input: "a/b..c"},
+		{Input: "a/b___c"},
+		{Input: "a//b"},
+		{Input: "a/"},
+		{Input: "/a"},
+		{Input: "gcr.io/"},
+		{Input: "-gcr.io/app"},
+		{Input: "gcr.io:port/app"},
+		{Input: "gcr_io.com/app"},
+		{Input: "localhost:5000/"},
+		{Input: "app@sha256:abc"},
+		{Input: "app@md5:" + strings.Repeat("a", 32)},
+		{Input: "app@sha256:" + strings.Repeat("AB", 32)},
+		{Input: "app@"},
+		{Input: "@" + digest},
+		{Input: "a/" + strings.Repeat("b", maxNameLength-1)},
+	}
+
+	for _, g := range grid {
+		actual, err := ParseReference(g.Input)
+		if g.Expected == nil {
+			if err == nil {
+				t.Errorf("expected error parsing %q, got %+v", g.Input, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %v", g.Input, err)
+			continue
+		}
+		if *actual != *g.Expected {
+			t.Errorf("unexpected result parsing %q: actual=%+v expected=%+v", g.Input, actual, g.Expected)
+		}
+	}
+}
+
+func TestValidateDigest(t *testing.T) {
+	grid := []struct {
+		Input string
+		OK    bool
+	}{
+		{Input: "sha256:" + strings.Repeat("0123456789abcdef", 4), OK: true},
+		{Input: "sha256:" + strings.Repeat("0123456789ABCDEF", 4), OK: false},
+		{Input: "sha256:" + strings.Repeat("g", 64), OK: false},
+		{Input: "sha256:" + strings.Repeat("a", 63), OK: false},
+		{Input: "sha512:" + strings.Repeat("a", 128), OK: false},
+		{Input: strings.Repeat("a", 64), OK: false},
+		{Input: "", OK: false},
+	}
+
+	for _, g := range grid {
+		err := ValidateDigest(g.Input)
+		if (err == nil) != g.OK {
+			t.Errorf("unexpected result validating %q: %v", g.Input, err)
+		}
+	}
+}
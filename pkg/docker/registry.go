@@ -1,8 +1,9 @@
 package docker
 
 import (
-	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,67 +12,278 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang/glog"
+	"kope.io/build/pkg/verify"
 )
 
 type Registry struct {
 	URL string
 
 	HttpClient *http.Client
+
+	// ChunkSize is the maximum number of bytes sent in each PATCH when uploading a blob.
+	// If not set, DefaultChunkSize is used.
+	ChunkSize int64
+
+	// MaxRetries is the number of times a request is retried after a transient failure.
+	// If not set, DefaultMaxRetries is used; a negative value disables retries.
+	MaxRetries int
+
+	// RetryBackoff is the delay before the first retry, doubling on each subsequent retry.
+	// If not set, DefaultRetryBackoff is used.
+	RetryBackoff time.Duration
 }
 
+// DockerHubURL is the registry we use when Registry.URL is not set
+const DockerHubURL = "https://registry-1.docker.io/"
+
+// DefaultChunkSize is the chunk size used for blob uploads when Registry.ChunkSize is not set
+const DefaultChunkSize = 16 * 1024 * 1024
+
+// maxUploadResumes is the number of times we will try to resume a failed blob upload
+const maxUploadResumes = 5
+
 type tagListResponse struct {
 	Name string   `json:"name"`
 	Tags []string `json:"tags"`
 }
 
-func (r *Registry) ListTags(token *Token, image string) ([]string, error) {
-	client := &http.Client{}
+// maxListPages guards against registries which return a Link header pointing back at a page we have already read
+const maxListPages = 10000
 
-	authHeader, err := token.GetAuthorizationHeader()
-	if err != nil {
-		return nil, err
+// ListTags returns all the tags in the repository, following the Link headers the registry uses to paginate the list
+func (r *Registry) ListTags(auth *Auth, repository string) ([]string, error) {
+	var tags []string
+
+	u := r.buildUrl("v2/" + repository + "/tags/list")
+	for page := 0; u != ""; page++ {
+		if page >= maxListPages {
+			return nil, fmt.Errorf("too many pages listing tags for %s", r.buildHumanName(repository, ""))
+		}
+
+		header := make(http.Header)
+		header.Add("Accept", "application/json")
+
+		resp, body, err := r.doSimple(auth, &registryRequest{
+			Method:     "GET",
+			URL:        u,
+			Header:     header,
+			Repository: repository,
+			Permission: "pull",
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error getting %q: %v", u, err)
+		}
+
+		switch resp.StatusCode {
+		case 200:
+			// OK
+
+		case 401:
+			return nil, fmt.Errorf("permission denied listing tags for %s", r.buildHumanName(repository, ""))
+
+		case 404:
+			return nil, fmt.Errorf("repository %s not found", r.buildHumanName(repository, ""))
+
+		default:
+			glog.V(2).Infof("unexpected http response: %s %s", resp.Status, body)
+			return nil, fmt.Errorf("docker registry returned unexpected result listing tags for %s: %s", repository, resp.Status)
+		}
+
+		response := &tagListResponse{}
+		err = json.Unmarshal(body, response)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing response: %v", err)
+		}
+		tags = append(tags, response.Tags...)
+
+		u = r.nextPage(resp)
 	}
 
-	url := r.buildUrl("v2/" + image + "/tags/list")
-	req, err := http.NewRequest("GET", url, nil)
-	req.Header.Add("Authorization", authHeader)
-	req.Header.Add("Accept", "application/json")
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("error getting %q: %v", url, err)
+	return tags, nil
+}
+
+type catalogResponse struct {
+	Repositories []string `json:"repositories"`
+}
+
+// catalogScope is the token scope needed to list the repositories in a registry
+const catalogScope = "registry:catalog:*"
+
+// Catalog returns the names of all the repositories in the registry, following the Link headers the registry uses to paginate the list
+func (r *Registry) Catalog(auth *Auth) ([]string, error) {
+	var repositories []string
+
+	u := r.buildUrl("v2/_catalog")
+	for page := 0; u != ""; page++ {
+		if page >= maxListPages {
+			return nil, fmt.Errorf("too many pages listing repositories in %s", r.buildUrl(""))
+		}
+
+		header := make(http.Header)
+		header.Add("Accept", "application/json")
+
+		resp, body, err := r.doSimple(auth, &registryRequest{
+			Method:      "GET",
+			URL:         u,
+			Header:      header,
+			ExtraScopes: []string{catalogScope},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error getting %q: %v", u, err)
+		}
+
+		switch resp.StatusCode {
+		case 200:
+			// OK
+
+		case 401:
+			return nil, fmt.Errorf("permission denied listing repositories in %s", r.buildUrl(""))
+
+		case 404:
+			return nil, fmt.Errorf("registry %s does not support listing repositories", r.buildUrl(""))
+
+		default:
+			glog.V(2).Infof("unexpected http response: %s %s", resp.Status, body)
+			return nil, fmt.Errorf("docker registry returned unexpected result listing repositories: %s", resp.Status)
+		}
+
+		response := &catalogResponse{}
+		err = json.Unmarshal(body, response)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing response: %v", err)
+		}
+		repositories = append(repositories, response.Repositories...)
+
+		u = r.nextPage(resp)
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("error reading response: %v", err)
+	return repositories, nil
+}
+
+// nextPage returns the URL of the next page of a paginated list, from the Link header, or "" if this is the last page
+func (r *Registry) nextPage(resp *http.Response) string {
+	for _, link := range resp.Header["Link"] {
+		for _, entry := range strings.Split(link, ",") {
+			next, ok := parseNextLink(entry)
+			if ok {
+				return r.resolveLocation(next)
+			}
+		}
 	}
+	return ""
+}
 
-	response := &tagListResponse{}
-	err = json.Unmarshal(body, response)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing response: %v", err)
+// parseNextLink parses a Link header entry such as </v2/foo/tags/list?n=100&last=bar>; rel="next"
+func parseNextLink(entry string) (string, bool) {
+	tokens := strings.Split(entry, ";")
+	target := strings.TrimSpace(tokens[0])
+	if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+		return "", false
+	}
+
+	for _, param := range tokens[1:] {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "rel" && strings.Trim(strings.TrimSpace(kv[1]), `"`) == "next" {
+			return target[1 : len(target)-1], true
+		}
 	}
+	return "", false
+}
+
+// Media types for manifests, configs and layers, in both the Docker schema2 and OCI formats
+const (
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerConfig   = "application/vnd.docker.container.image.v1+json"
+	MediaTypeDockerLayer    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	MediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIConfig   = "application/vnd.oci.image.config.v1+json"
+	MediaTypeOCILayer    = "application/vnd.oci.image.layer.v1.tar+gzip"
 
-	return response.Tags, nil
+	MediaTypeOCIIndex = "application/vnd.oci.image.index.v1+json"
+)
+
+// manifestAcceptTypes are the manifest media types we understand, for the Accept header
+var manifestAcceptTypes = []string{
+	MediaTypeDockerManifest,
+	MediaTypeOCIManifest,
+	MediaTypeDockerManifestList,
+	MediaTypeOCIIndex,
 }
 
+// ManifestV2Layer is a descriptor for a blob or (in a manifest list) another manifest
 type ManifestV2Layer struct {
 	MediaType string `json:"mediaType"`
 	Size      int64  `json:"size"`
 	Digest    string `json:"digest"`
+
+	// Platform is only set for entries in a manifest list
+	Platform *Platform `json:"platform,omitempty"`
+}
+
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func (p *Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
 }
 
+// ManifestV2 is either an image manifest (with Config and Layers) or
+// a manifest list / image index (with Manifests), depending on MediaType
 type ManifestV2 struct {
 	SchemaVersion int    `json:"schemaVersion"`
 	MediaType     string `json:"mediaType"`
 	//Name string `json:"name"`
 	//Tag string `json:"tag"`
 	//Architecture string `json:"architecture"`
-	Layers []ManifestV2Layer `json:"layers"`
-	Config ManifestV2Layer   `json:"config"`
+	Layers []ManifestV2Layer `json:"layers,omitempty"`
+	Config *ManifestV2Layer  `json:"config,omitempty"`
+
+	Manifests []ManifestV2Layer `json:"manifests,omitempty"`
+
+	// digest is the digest of the manifest as read from the registry
+	digest string
+}
+
+// Digest returns the digest of the manifest, if it was read from a registry
+func (m *ManifestV2) Digest() string {
+	return m.digest
+}
+
+// IsList returns true if this is a manifest list or image index, rather than an image manifest
+func (m *ManifestV2) IsList() bool {
+	return m.MediaType == MediaTypeDockerManifestList || m.MediaType == MediaTypeOCIIndex
+}
+
+// FindPlatform returns the entry in a manifest list for the specified platform, or nil if there is none.
+// If the platform does not specify a variant, the first entry matching the os and architecture is returned.
+func (m *ManifestV2) FindPlatform(platform *Platform) *ManifestV2Layer {
+	for i := range m.Manifests {
+		entry := &m.Manifests[i]
+		if entry.Platform == nil {
+			continue
+		}
+		if entry.Platform.OS != platform.OS || entry.Platform.Architecture != platform.Architecture {
+			continue
+		}
+		if platform.Variant != "" && entry.Platform.Variant != platform.Variant {
+			continue
+		}
+		return entry
+	}
+	return nil
 }
 
 func (m *ManifestV2) String() string {
@@ -83,154 +295,314 @@ func (m *ManifestV2) String() string {
 	return string(v)
 }
 
-func (r *Registry) GetManifest(auth *Auth, repository string, tag string) (*ManifestV2, error) {
-	authHeader := auth.FindHeader(r, repository, "pull")
+// GetManifest reads the manifest for reference, which is either a tag or a digest.
+// If reference is a digest, we verify that the manifest we receive matches it.
+func (r *Registry) GetManifest(auth *Auth, repository string, reference string) (*ManifestV2, error) {
+	url := r.buildUrl("v2/" + repository + "/manifests/" + reference)
+	glog.V(4).Infof("Reading manifest at %s", url)
 
-	attempt := 0
-	for {
-		attempt++
+	header := make(http.Header)
+	for _, mediaType := range manifestAcceptTypes {
+		header.Add("Accept", mediaType)
+	}
 
-		url := r.buildUrl("v2/" + repository + "/manifests/" + tag)
-		glog.V(4).Infof("Reading manifest at %s", url)
+	resp, body, err := r.doSimple(auth, &registryRequest{
+		Method:     "GET",
+		URL:        url,
+		Header:     header,
+		Repository: repository,
+		Permission: "pull",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest from %s: %v", repository, err)
+	}
+
+	switch resp.StatusCode {
+	case 200:
+		glog.V(4).Infof("got docker manifest %s", body)
 
-		req, err := http.NewRequest("GET", url, nil)
-		if authHeader != "" {
-			req.Header.Add("Authorization", authHeader)
+		digest := sha256Digest(body)
+		if strings.HasPrefix(reference, "sha256:") && digest != reference {
+			return nil, fmt.Errorf("manifest for %s had digest %s", r.buildHumanName(repository, reference), digest)
 		}
-		req.Header.Add("Accept", "application/vnd.docker.distribution.manifest.v2+json")
 
-		resp, body, err := r.doSimpleRequest(req)
+		response := &ManifestV2{digest: digest}
+		err = json.Unmarshal(body, response)
 		if err != nil {
-			return nil, fmt.Errorf("error writing manifest to %s: %v", repository, err)
+			return nil, fmt.Errorf("error parsing response: %v", err)
 		}
-
-		switch resp.StatusCode {
-		case 200:
-			glog.V(4).Infof("got docker manifest %s", body)
-			response := &ManifestV2{}
-			err = json.Unmarshal(body, response)
-			if err != nil {
-				return nil, fmt.Errorf("error parsing response: %v", err)
+		if response.MediaType == "" {
+			// mediaType is optional in OCI manifests
+			response.MediaType = stripContentTypeParameters(resp.Header.Get("Content-Type"))
+		}
+		if response.SchemaVersion != 2 {
+			return nil, fmt.Errorf("unsupported manifest schema version %d for %s", response.SchemaVersion, r.buildHumanName(repository, reference))
+		}
+		switch response.MediaType {
+		case MediaTypeDockerManifest, MediaTypeOCIManifest:
+			if response.Config == nil {
+				return nil, fmt.Errorf("manifest for %s did not specify config", r.buildHumanName(repository, reference))
 			}
-			return response, nil
+		case MediaTypeDockerManifestList, MediaTypeOCIIndex:
+		default:
+			return nil, fmt.Errorf("unsupported manifest media type %q for %s", response.MediaType, r.buildHumanName(repository, reference))
+		}
+		return response, nil
 
-		case 401:
-			if attempt >= 2 {
-				return nil, fmt.Errorf("permission denied reading %s", r.buildHumanName(repository, tag))
-			}
+	case 401:
+		return nil, fmt.Errorf("permission denied reading %s", r.buildHumanName(repository, reference))
+
+	default:
+		glog.V(2).Infof("unexpected http response: %s %s", resp.Status, body)
+		return nil, fmt.Errorf("docker registry returned unexpected result reading manifest %s: %s", repository, resp.Status)
+	}
+}
+
+// ResolveManifest returns the digest of the manifest for reference, which is either a tag or a digest.
+// It uses a HEAD request, falling back to reading the manifest if the registry does not report the digest.
+func (r *Registry) ResolveManifest(auth *Auth, repository string, reference string) (string, error) {
+	url := r.buildUrl("v2/" + repository + "/manifests/" + reference)
+	glog.V(4).Infof("Resolving manifest at %s", url)
+
+	header := make(http.Header)
+	for _, mediaType := range manifestAcceptTypes {
+		header.Add("Accept", mediaType)
+	}
 
-			authHeader, err = auth.GetHeader(r, resp)
+	resp, _, err := r.doSimple(auth, &registryRequest{
+		Method:     "HEAD",
+		URL:        url,
+		Header:     header,
+		Repository: repository,
+		Permission: "pull",
+	})
+	if err != nil {
+		return "", fmt.Errorf("error resolving manifest %s: %v", r.buildHumanName(repository, reference), err)
+	}
+
+	switch resp.StatusCode {
+	case 200:
+		digest := resp.Header.Get("Docker-Content-Digest")
+		if digest == "" {
+			glog.V(2).Infof("registry did not return Docker-Content-Digest for %s; reading manifest", url)
+			manifest, err := r.GetManifest(auth, repository, reference)
 			if err != nil {
-				return nil, err
+				return "", err
 			}
-
-		default:
-			glog.V(2).Infof("unexpected http response: %s %s", resp.Status, body)
-			return nil, fmt.Errorf("docker registry returned unexpected result reading manifest %s: %s", repository, resp.Status)
+			digest = manifest.Digest()
+		}
+		if strings.HasPrefix(reference, "sha256:") && digest != reference {
+			return "", fmt.Errorf("manifest for %s had digest %s", r.buildHumanName(repository, reference), digest)
 		}
+		return digest, nil
+
+	case 401:
+		return "", fmt.Errorf("permission denied reading %s", r.buildHumanName(repository, reference))
+
+	case 404:
+		return "", fmt.Errorf("manifest %s not found", r.buildHumanName(repository, reference))
+
+	default:
+		return "", fmt.Errorf("docker registry returned unexpected result resolving manifest %s: %s", r.buildHumanName(repository, reference), resp.Status)
 	}
 }
 
-func (r *Registry) PutManifest(auth *Auth, repository string, tag string, manifest *ManifestV2) error {
-	authHeader := auth.FindHeader(r, repository, "pull,push")
+// DeleteManifest deletes the manifest with the digest, which removes every tag pointing to it.
+// Registries only accept deletion by digest; use ResolveManifest to find the digest for a tag.
+func (r *Registry) DeleteManifest(auth *Auth, repository string, digest string) error {
+	url := r.buildUrl("v2/" + repository + "/manifests/" + digest)
+	glog.V(2).Infof("Deleting manifest: DELETE %s", url)
+
+	resp, body, err := r.doSimple(auth, &registryRequest{
+		Method:     "DELETE",
+		URL:        url,
+		Repository: repository,
+		Permission: "delete",
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting manifest %s: %v", r.buildHumanName(repository, digest), err)
+	}
+
+	switch resp.StatusCode {
+	case 200, 202:
+		return nil
+
+	case 401, 403:
+		return fmt.Errorf("permission denied deleting %s", r.buildHumanName(repository, digest))
 
+	case 404:
+		return fmt.Errorf("manifest %s not found", r.buildHumanName(repository, digest))
+
+	case 405:
+		return fmt.Errorf("registry %s does not allow deletes (405 Method Not Allowed); deletion must be enabled in the registry configuration", r.buildUrl(""))
+
+	default:
+		glog.V(2).Infof("unexpected http response: %s %s", resp.Status, body)
+		return fmt.Errorf("docker registry returned unexpected result deleting manifest %s: %s", r.buildHumanName(repository, digest), resp.Status)
+	}
+}
+
+// PutManifest uploads the manifest as reference, which may be a tag or (if empty) the digest of the manifest.
+// It returns a descriptor for the uploaded manifest, suitable for including in a manifest list; the digest is
+// checked against the digest the registry reports.
+func (r *Registry) PutManifest(auth *Auth, repository string, reference string, manifest *ManifestV2) (*ManifestV2Layer, error) {
 	data, err := json.Marshal(manifest)
 	if err != nil {
-		return fmt.Errorf("error serializing manifest: %v", err)
+		return nil, fmt.Errorf("error serializing manifest: %v", err)
 	}
 
-	attempt := 0
-	for {
-		attempt++
-
-		url := r.buildUrl("v2/" + repository + "/manifests/" + tag)
-		glog.V(4).Infof("Creating manifest at %s: %s", url, string(data))
+	contentType := manifest.MediaType
+	if contentType == "" {
+		contentType = MediaTypeDockerManifest
+	}
 
-		req, err := http.NewRequest("PUT", url, bytes.NewReader(data))
-		if authHeader != "" {
-			req.Header.Add("Authorization", authHeader)
-		}
-		req.Header.Add("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+	descriptor := &ManifestV2Layer{
+		MediaType: contentType,
+		Size:      int64(len(data)),
+		Digest:    sha256Digest(data),
+	}
 
-		resp, body, err := r.doSimpleRequest(req)
-		if err != nil {
-			return fmt.Errorf("error writing manifest to %s: %v", repository, err)
-		}
+	if reference == "" {
+		reference = descriptor.Digest
+	}
 
-		switch resp.StatusCode {
-		case 201:
-			return nil
+	url := r.buildUrl("v2/" + repository + "/manifests/" + reference)
+	glog.V(4).Infof("Creating manifest at %s: %s", url, string(data))
 
-		case 401:
-			if attempt >= 2 {
-				return fmt.Errorf("permission denied uploading to %s", r.buildHumanName(repository, tag))
-			}
+	header := make(http.Header)
+	header.Add("Content-Type", contentType)
 
-			authHeader, err = auth.GetHeader(r, resp)
-			if err != nil {
-				return err
-			}
+	resp, body, err := r.doSimple(auth, &registryRequest{
+		Method:     "PUT",
+		URL:        url,
+		Header:     header,
+		Body:       data,
+		Repository: repository,
+		Permission: "pull,push",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error writing manifest to %s: %v", repository, err)
+	}
 
-		default:
-			glog.V(2).Infof("unexpected http response: %s %s", resp.Status, body)
-			return fmt.Errorf("docker registry returned unexpected result writing manifest to %s: %s", repository, resp.Status)
+	switch resp.StatusCode {
+	case 201:
+		// The registry should have stored exactly the bytes we sent; if its digest differs, the digest we
+		// report would not match what is pulled
+		if actual := resp.Header.Get("Docker-Content-Digest"); actual != "" && actual != descriptor.Digest {
+			return nil, fmt.Errorf("registry reported digest %s for manifest %s, expected %s", actual, r.buildHumanName(repository, reference), descriptor.Digest)
 		}
+		return descriptor, nil
+
+	case 401:
+		return nil, fmt.Errorf("permission denied uploading to %s", r.buildHumanName(repository, reference))
+
+	default:
+		glog.V(2).Infof("unexpected http response: %s %s", resp.Status, body)
+		return nil, fmt.Errorf("docker registry returned unexpected result writing manifest to %s: %s", repository, resp.Status)
 	}
+}
 
+// sha256Digest returns the digest of the data, in the form sha256:<hex>
+func sha256Digest(data []byte) string {
+	hash := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(hash[:])
 }
 
+// DownloadBlob downloads the whole blob, verifying the digest as it streams.
+// If the data does not match the digest, a *verify.DigestMismatchError is returned (after the data has been written to w).
 func (r *Registry) DownloadBlob(auth *Auth, repository string, digest string, w io.Writer) (int64, error) {
-	authHeader := auth.FindHeader(r, repository, "pull")
+	hasher := sha256.New()
+	n, err := r.DownloadBlobFrom(auth, repository, digest, 0, io.MultiWriter(w, hasher))
+	if err != nil {
+		return n, err
+	}
 
-	attempt := 0
-	for {
-		attempt++
+	if strings.HasPrefix(digest, "sha256:") {
+		actualDigest := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
+		if actualDigest != digest {
+			return n, &verify.DigestMismatchError{Expected: digest, Actual: actualDigest}
+		}
+	}
+	return n, nil
+}
 
-		url := r.buildUrl("v2/" + repository + "/blobs/" + digest)
-		glog.V(4).Infof("Reading blob at %s", url)
+// DownloadBlobFrom downloads the blob starting at offset, for resuming an interrupted download.
+// It returns the number of bytes written to w; if the transfer fails part way, the bytes written are still counted.
+func (r *Registry) DownloadBlobFrom(auth *Auth, repository string, digest string, offset int64, w io.Writer) (int64, error) {
+	url := r.buildUrl("v2/" + repository + "/blobs/" + digest)
+	glog.V(4).Infof("Reading blob at %s from offset %d", url, offset)
 
-		req, err := http.NewRequest("GET", url, nil)
-		if authHeader != "" {
-			req.Header.Add("Authorization", authHeader)
-		}
-		req.Header.Add("Accept", "application/vnd.docker.distribution.manifest.v2+json")
+	header := make(http.Header)
+	if offset > 0 {
+		header.Add("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
 
-		httpClient := r.httpClient()
+	resp, err := r.do(auth, &registryRequest{
+		Method:     "GET",
+		URL:        url,
+		Header:     header,
+		Repository: repository,
+		Permission: "pull",
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+		if offset > 0 {
+			// The registry ignored the Range header and sent the whole blob; skip what we already have
+			glog.V(2).Infof("registry does not support range requests; skipping %d bytes of %s", offset, digest)
+			if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+				return 0, fmt.Errorf("error skipping to offset %d of blob %s: %v", offset, digest, err)
+			}
+		}
+		return io.Copy(w, resp.Body)
 
-		glog.V(2).Infof("HTTP %s %s", req.Method, req.URL)
-		resp, err := httpClient.Do(req)
+	case 206:
+		start, err := parseContentRangeStart(resp.Header.Get("Content-Range"))
 		if err != nil {
 			return 0, err
 		}
-		// We can't defer resp.Body.Close, because we're in a loop
-
-		switch resp.StatusCode {
-		case 200:
-			n, err := io.Copy(w, resp.Body)
-
-			resp.Body.Close()
+		if start != offset {
+			return 0, fmt.Errorf("registry returned blob %s from offset %d, but we requested offset %d", digest, start, offset)
+		}
+		return io.Copy(w, resp.Body)
 
-			return n, err
+	case 416:
+		// We already have the whole blob (or more, if the staged data is bad); the digest check will tell
+		glog.V(2).Infof("registry reported range not satisfiable for %s at offset %d", digest, offset)
+		return 0, nil
 
-		case 401:
-			resp.Body.Close()
+	case 401:
+		return 0, &StatusError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("permission denied reading from %s", r.buildHumanName(repository, ""))}
 
-			if attempt >= 2 {
-				return 0, fmt.Errorf("permission denied reading from %s", r.buildHumanName(repository, ""))
-			}
-
-			authHeader, err = auth.GetHeader(r, resp)
-			if err != nil {
-				return 0, err
-			}
+	default:
+		glog.V(2).Infof("unexpected http response: %s", resp.Status)
+		return 0, &StatusError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("docker registry returned unexpected result reading blob %s/%s: %s", repository, digest, resp.Status)}
+	}
+}
 
-		default:
-			resp.Body.Close()
+// parseContentRangeStart returns the first byte position from a Content-Range header, of the form "bytes <start>-<end>/<size>"
+func parseContentRangeStart(s string) (int64, error) {
+	tokens := strings.SplitN(strings.TrimPrefix(s, "bytes "), "-", 2)
+	if len(tokens) != 2 {
+		return 0, fmt.Errorf("cannot parse content range %q", s)
+	}
+	start, err := strconv.ParseInt(tokens[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse content range %q", s)
+	}
+	return start, nil
+}
 
-			glog.V(2).Infof("unexpected http response: %s", resp.Status)
-			return 0, fmt.Errorf("docker registry returned unexpected result reading blob %s/%s: %s", repository, digest, resp.Status)
-		}
+// stripContentTypeParameters removes any parameters (e.g. charset) from a Content-Type header
+func stripContentTypeParameters(contentType string) string {
+	if i := strings.Index(contentType, ";"); i != -1 {
+		contentType = contentType[:i]
 	}
+	return strings.TrimSpace(contentType)
 }
 
 // randomId returns a random string; it isn't technically a UUID
@@ -256,7 +628,7 @@ func (r *Registry) httpClient() *http.Client {
 func (r *Registry) buildUrl(relativePath string) string {
 	url := r.URL
 	if url == "" {
-		url = "https://registry-1.docker.io/"
+		url = DockerHubURL
 	}
 	if !strings.HasSuffix(url, "/") {
 		url += "/"
@@ -265,6 +637,7 @@ func (r *Registry) buildUrl(relativePath string) string {
 	return url
 }
 
+// buildHumanName returns a display name for the repository and reference (a tag or digest)
 func (r *Registry) buildHumanName(repository, tag string) string {
 	s := r.URL
 	if repository != "" {
@@ -273,80 +646,53 @@ func (r *Registry) buildHumanName(repository, tag string) string {
 		}
 		s += repository
 
-		if tag != "" {
+		if strings.Contains(tag, ":") {
+			s += "@" + tag
+		} else if tag != "" {
 			s += ":" + tag
 		}
 	}
 	return s
 }
 
-func (r *Registry) doSimpleRequest(req *http.Request) (*http.Response, []byte, error) {
-	httpClient := r.httpClient()
-
-	glog.V(2).Infof("HTTP %s %s", req.Method, req.URL)
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return nil, nil, err
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
+// beginUpload starts a blob upload, returning the location for the upload
+func (r *Registry) beginUpload(auth *Auth, repository string) (string, error) {
+	url := r.buildUrl("v2/" + repository + "/blobs/uploads/")
+
+	header := make(http.Header)
+	header.Add("Content-Length", "0")
+
+	glog.V(2).Infof("Initiate blob upload: POST %s", url)
+	resp, _, err := r.doSimple(auth, &registryRequest{
+		Method:     "POST",
+		URL:        url,
+		Header:     header,
+		Body:       []byte{},
+		Repository: repository,
+		Permission: "pull,push",
+	})
 	if err != nil {
-		return nil, nil, fmt.Errorf("error reading response body: %v")
+		return "", fmt.Errorf("error initiating upload to %s: %v", repository, err)
 	}
 
-	return resp, body, err
-}
-
-func (r *Registry) beginUpload(auth *Auth, repository string) (string, string, error) {
-	authHeader := auth.FindHeader(r, repository, "pull,push")
-
-	attempt := 0
-
-	for {
-		attempt++
-
-		url := r.buildUrl("v2/" + repository + "/blobs/uploads/")
-
-		req, err := http.NewRequest("POST", url, bytes.NewReader(nil))
-		if authHeader != "" {
-			req.Header.Add("Authorization", authHeader)
+	switch resp.StatusCode {
+	case 202:
+		location := resp.Header.Get("Location")
+		if location == "" {
+			return "", fmt.Errorf("no location returned from upload begin")
 		}
-		req.Header.Add("Content-Length", "0")
+		return r.resolveLocation(location), nil
 
-		glog.V(2).Infof("Initiate blob upload: %s %s", req.Method, req.URL)
-		resp, _, err := r.doSimpleRequest(req)
-		if err != nil {
-			return "", "", fmt.Errorf("error initiating upload to %s: %v", repository, err)
-		}
+	case 401:
+		return "", fmt.Errorf("permission denied uploading to %s", r.buildHumanName(repository, ""))
 
-		switch resp.StatusCode {
-		case 202:
-			location := resp.Header.Get("Location")
-			if location == "" {
-				return "", "", fmt.Errorf("no location returned from upload begin")
-			}
-			return authHeader, location, nil
-
-		case 401:
-			if attempt >= 2 {
-				return "", "", fmt.Errorf("permission denied uploading to %s", r.buildHumanName(repository, ""))
-			}
-
-			authHeader, err = auth.GetHeader(r, resp)
-			if err != nil {
-				return "", "", err
-			}
-
-		default:
-			return "", "", fmt.Errorf("docker registry returned unexpected result initiating upload to %s: %s", repository, resp.Status)
-		}
+	default:
+		return "", fmt.Errorf("docker registry returned unexpected result initiating upload to %s: %s", repository, resp.Status)
 	}
 }
 
-func (r *Registry) completeUpload(authHeader string, location string, digest string, src io.Reader, length int64) error {
-	client := r.httpClient()
-
+// completeUpload finishes an upload with a PUT, sending data as the final chunk
+func (r *Registry) completeUpload(auth *Auth, repository string, location string, digest string, data []byte) error {
 	u := location
 	if strings.Contains(u, "?") {
 		u += "&"
@@ -354,20 +700,22 @@ func (r *Registry) completeUpload(authHeader string, location string, digest str
 		u += "?"
 	}
 	u += "digest=" + url.QueryEscape(digest)
-	req, err := http.NewRequest("PUT", u, src)
 
-	if authHeader != "" {
-		req.Header.Add("Authorization", authHeader)
-	}
-	req.Header.Add("Content-Length", strconv.FormatInt(length, 10))
-	req.Header.Add("Content-Type", "application/octet-stream")
-
-	glog.V(2).Infof("Blob upload of size %d: %s %s", length, req.Method, req.URL)
-	resp, err := client.Do(req)
+	header := make(http.Header)
+	header.Add("Content-Type", "application/octet-stream")
+
+	glog.V(2).Infof("Blob upload of size %d: PUT %s", len(data), u)
+	resp, _, err := r.doSimple(auth, &registryRequest{
+		Method:     "PUT",
+		URL:        u,
+		Header:     header,
+		Body:       data,
+		Repository: repository,
+		Permission: "pull,push",
+	})
 	if err != nil {
 		return fmt.Errorf("error uploading %q: %v", u, err)
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode != 201 {
 		return fmt.Errorf("docker registry returned unexpected result uploading to %s: %s", u, resp.Status)
@@ -424,14 +772,157 @@ func (r *Registry) completeUpload(authHeader string, location string, digest str
 //	}
 //}
 
+// CheckAuthentication verifies that we can access the registry with our credentials, using the /v2/ endpoint
+func (r *Registry) CheckAuthentication(auth *Auth) error {
+	resp, body, err := r.doSimple(auth, &registryRequest{
+		Method: "GET",
+		URL:    r.buildUrl("v2/"),
+	})
+	if err != nil {
+		return fmt.Errorf("error connecting to registry %s: %v", r.buildUrl(""), err)
+	}
+
+	switch resp.StatusCode {
+	case 200:
+		return nil
+
+	case 401:
+		if resp.Request.Header.Get("Authorization") == "" {
+			return fmt.Errorf("registry %s requires authentication, but no credentials were provided", r.buildUrl(""))
+		}
+		return fmt.Errorf("registry rejected credentials for %s", r.buildUrl(""))
+
+	default:
+		glog.V(2).Infof("unexpected http response: %s %s", resp.Status, body)
+		return fmt.Errorf("docker registry returned unexpected result checking authentication: %s", resp.Status)
+	}
+}
+
+// MountBlob asks the registry to mount a blob from another repository, avoiding an upload.
+// It returns false if the registry declined to mount the blob, in which case the caller should upload it.
+func (r *Registry) MountBlob(auth *Auth, repository string, digest string, fromRepository string) (bool, error) {
+	u := r.buildUrl("v2/" + repository + "/blobs/uploads/?mount=" + url.QueryEscape(digest) + "&from=" + url.QueryEscape(fromRepository))
+
+	header := make(http.Header)
+	header.Add("Content-Length", "0")
+
+	glog.V(2).Infof("Mount blob: POST %s", u)
+	resp, _, err := r.doSimple(auth, &registryRequest{
+		Method:     "POST",
+		URL:        u,
+		Header:     header,
+		Body:       []byte{},
+		Repository: repository,
+		Permission: "pull,push",
+		// We need a token that covers both repositories
+		ExtraScopes: []string{repositoryScope(fromRepository, "pull").String()},
+	})
+	if err != nil {
+		return false, fmt.Errorf("error mounting blob %s from %s into %s: %v", digest, fromRepository, repository, err)
+	}
+
+	switch resp.StatusCode {
+	case 201:
+		return true, nil
+
+	case 202:
+		// The registry started a regular upload instead; abandon it so the caller can upload normally
+		glog.V(2).Infof("registry declined to mount %s from %s", digest, fromRepository)
+		location := resp.Header.Get("Location")
+		if location != "" {
+			r.cancelUpload(auth, repository, r.resolveLocation(location))
+		}
+		return false, nil
+
+	case 401:
+		// We might lack pull permission on the source repository; that isn't fatal
+		glog.V(2).Infof("permission denied mounting %s from %s", digest, fromRepository)
+		return false, nil
+
+	default:
+		glog.V(2).Infof("unexpected response mounting blob: %s", resp.Status)
+		return false, nil
+	}
+}
+
+// cancelUpload deletes an in-progress upload; failures are only logged, because the registry will expire it anyway
+func (r *Registry) cancelUpload(auth *Auth, repository string, location string) {
+	resp, _, err := r.doSimple(auth, &registryRequest{
+		Method:     "DELETE",
+		URL:        location,
+		Repository: repository,
+		Permission: "pull,push",
+	})
+	if err != nil {
+		glog.V(2).Infof("error cancelling upload %s: %v", location, err)
+		return
+	}
+	if resp.StatusCode != 204 {
+		glog.V(2).Infof("unexpected response cancelling upload %s: %s", location, resp.Status)
+	}
+}
+
+// UploadBlob uploads the blob in chunks of ChunkSize bytes.  If a chunk fails and src is an io.Seeker,
+// we ask the registry how much it has received and resume from there.
 func (r *Registry) UploadBlob(auth *Auth, repository string, digest string, src io.Reader, length int64) error {
-	// TODO: Chunked / resumable uploading?
-	authHeader, location, err := r.beginUpload(auth, repository)
+	location, err := r.beginUpload(auth, repository)
 	if err != nil {
 		return err
 	}
 
-	err = r.completeUpload(authHeader, location, digest, src, length)
+	chunkSize := r.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if chunkSize > length {
+		chunkSize = length
+	}
+	buffer := make([]byte, chunkSize)
+
+	offset := int64(0)
+	resumes := 0
+	for offset < length {
+		n := chunkSize
+		if length-offset < n {
+			n = length - offset
+		}
+		chunk := buffer[:n]
+		if _, err := io.ReadFull(src, chunk); err != nil {
+			return fmt.Errorf("error reading blob %s at offset %d: %v", digest, offset, err)
+		}
+
+		nextLocation, err := r.uploadChunk(auth, repository, location, chunk, offset)
+		if err == nil {
+			location = nextLocation
+			offset += n
+			continue
+		}
+
+		seeker, ok := src.(io.Seeker)
+		if !ok || resumes >= maxUploadResumes {
+			return err
+		}
+		resumes++
+
+		glog.Warningf("error uploading chunk of %s at offset %d, will try to resume: %v", digest, offset, err)
+
+		statusLocation, committed, statusErr := r.getUploadStatus(auth, repository, location)
+		if statusErr != nil {
+			return fmt.Errorf("%v (and could not query upload status: %v)", err, statusErr)
+		}
+		if committed > length {
+			return fmt.Errorf("registry reported %d bytes uploaded for %s, but blob is only %d bytes", committed, digest, length)
+		}
+
+		glog.Infof("resuming upload of %s from offset %d", digest, committed)
+		if _, err := seeker.Seek(committed, io.SeekStart); err != nil {
+			return fmt.Errorf("error seeking to offset %d in blob %s: %v", committed, digest, err)
+		}
+		location = statusLocation
+		offset = committed
+	}
+
+	err = r.completeUpload(auth, repository, location, digest, nil)
 	if err != nil {
 		return err
 	}
@@ -439,46 +930,131 @@ func (r *Registry) UploadBlob(auth *Auth, repository string, digest string, src
 	return nil
 }
 
-func (r *Registry) HasBlob(auth *Auth, repository string, digest string) (bool, error) {
-	authHeader := auth.FindHeader(r, repository, "pull")
+// uploadChunk sends a single chunk of an upload with PATCH, returning the location for the next request.
+// We don't retry the PATCH here; UploadBlob resumes from the offset the registry reports instead.
+func (r *Registry) uploadChunk(auth *Auth, repository string, location string, chunk []byte, offset int64) (string, error) {
+	header := make(http.Header)
+	header.Add("Content-Range", fmt.Sprintf("%d-%d", offset, offset+int64(len(chunk))-1))
+	header.Add("Content-Type", "application/octet-stream")
+
+	glog.V(2).Infof("Blob upload chunk of size %d at offset %d: PATCH %s", len(chunk), offset, location)
+	resp, body, err := r.doSimple(auth, &registryRequest{
+		Method:     "PATCH",
+		URL:        location,
+		Header:     header,
+		Body:       chunk,
+		Repository: repository,
+		Permission: "pull,push",
+		NoRetry:    true,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error uploading chunk: %v", err)
+	}
 
-	attempt := 0
+	if resp.StatusCode != 202 {
+		glog.V(2).Infof("unexpected http response: %s %s", resp.Status, body)
+		return "", fmt.Errorf("docker registry returned unexpected result uploading chunk: %s", resp.Status)
+	}
 
-	for {
-		attempt++
+	return r.nextLocation(location, resp), nil
+}
 
-		url := r.buildUrl("v2/" + repository + "/blobs/" + digest)
+// getUploadStatus queries the registry for the progress of an upload, returning the number of bytes received
+func (r *Registry) getUploadStatus(auth *Auth, repository string, location string) (string, int64, error) {
+	resp, _, err := r.doSimple(auth, &registryRequest{
+		Method:     "GET",
+		URL:        location,
+		Repository: repository,
+		Permission: "pull,push",
+	})
+	if err != nil {
+		return "", 0, fmt.Errorf("error querying upload status: %v", err)
+	}
 
-		req, err := http.NewRequest("HEAD", url, bytes.NewReader(nil))
-		if authHeader != "" {
-			req.Header.Add("Authorization", authHeader)
-		}
+	if resp.StatusCode != 204 {
+		return "", 0, fmt.Errorf("docker registry returned unexpected result querying upload status: %s", resp.Status)
+	}
 
-		glog.V(2).Infof("Checking for blob: HEAD %s", url)
-		resp, _, err := r.doSimpleRequest(req)
-		if err != nil {
-			return false, fmt.Errorf("error checking for blob %s/%s: %v", repository, digest, err)
-		}
+	committed, err := parseUploadRange(resp.Header.Get("Range"))
+	if err != nil {
+		return "", 0, err
+	}
 
-		switch resp.StatusCode {
-		case 200:
-			return true, nil
+	return r.nextLocation(location, resp), committed, nil
+}
 
-		case 404:
-			return false, nil
+// parseUploadRange parses the Range header returned during uploads, of the form "0-<last byte>".
+// It returns the number of bytes the registry has received.
+func parseUploadRange(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
 
-		case 401:
-			if attempt >= 2 {
-				return false, fmt.Errorf("permission denied reading blob from %s", r.buildHumanName(repository, ""))
-			}
+	tokens := strings.SplitN(strings.TrimPrefix(s, "bytes="), "-", 2)
+	if len(tokens) != 2 || tokens[0] != "0" {
+		return 0, fmt.Errorf("cannot parse upload range %q", s)
+	}
 
-			authHeader, err = auth.GetHeader(r, resp)
-			if err != nil {
-				return false, err
-			}
+	end, err := strconv.ParseInt(tokens[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse upload range %q", s)
+	}
 
-		default:
-			return false, fmt.Errorf("unexpected response code checking for blob %s/%s: %s", repository, digest, resp.Status)
-		}
+	// docker/distribution reports an empty upload as "0-0", so we can't distinguish it from a single byte.
+	// Assuming nothing was received is the safe choice; the registry will reject a bad range.
+	if end == 0 {
+		return 0, nil
+	}
+	return end + 1, nil
+}
+
+// nextLocation returns the upload location to use for the next request, which the registry may have changed
+func (r *Registry) nextLocation(location string, resp *http.Response) string {
+	next := resp.Header.Get("Location")
+	if next == "" {
+		return location
+	}
+	return r.resolveLocation(next)
+}
+
+// resolveLocation resolves a (possibly relative) Location header against the registry URL
+func (r *Registry) resolveLocation(location string) string {
+	base, err := url.Parse(r.buildUrl(""))
+	if err != nil {
+		return location
+	}
+	u, err := base.Parse(location)
+	if err != nil {
+		return location
+	}
+	return u.String()
+}
+
+func (r *Registry) HasBlob(auth *Auth, repository string, digest string) (bool, error) {
+	url := r.buildUrl("v2/" + repository + "/blobs/" + digest)
+
+	glog.V(2).Infof("Checking for blob: HEAD %s", url)
+	resp, _, err := r.doSimple(auth, &registryRequest{
+		Method:     "HEAD",
+		URL:        url,
+		Repository: repository,
+		Permission: "pull",
+	})
+	if err != nil {
+		return false, fmt.Errorf("error checking for blob %s/%s: %v", repository, digest, err)
+	}
+
+	switch resp.StatusCode {
+	case 200:
+		return true, nil
+
+	case 404:
+		return false, nil
+
+	case 401:
+		return false, fmt.Errorf("permission denied reading blob from %s", r.buildHumanName(repository, ""))
+
+	default:
+		return false, fmt.Errorf("unexpected response code checking for blob %s/%s: %s", repository, digest, resp.Status)
 	}
 }
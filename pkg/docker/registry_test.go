@@ -0,0 +1,580 @@
+package docker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"kope.io/build/pkg/verify"
+)
+
+func TestParseUploadRange(t *testing.T) {
+	grid := []struct {
+		Input    string
+		Expected int64
+	}{
+		{Input: "", Expected: 0},
+		{Input: "0-0", Expected: 0},
+		{Input: "0-99", Expected: 100},
+		{Input: "bytes=0-1023", Expected: 1024},
+	}
+
+	for _, g := range grid {
+		actual, err := parseUploadRange(g.Input)
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %v", g.Input, err)
+			continue
+		}
+		if actual != g.Expected {
+			t.Errorf("unexpected result parsing %q: actual=%d expected=%d", g.Input, actual, g.Expected)
+		}
+	}
+
+	for _, s := range []string{"1-10", "0-x", "garbage"} {
+		if _, err := parseUploadRange(s); err == nil {
+			t.Errorf("expected error parsing %q", s)
+		}
+	}
+}
+
+// chunkedUploadServer is a minimal registry upload endpoint, which can be told to fail a PATCH part-way through
+type chunkedUploadServer struct {
+	received  bytes.Buffer
+	patches   int
+	failPatch int
+	digest    string
+}
+
+func (s *chunkedUploadServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.Method == "POST" && req.URL.Path == "/v2/test/repo/blobs/uploads/":
+		w.Header().Set("Location", "/v2/test/repo/blobs/uploads/1")
+		w.WriteHeader(202)
+
+	case req.Method == "PATCH":
+		s.patches++
+		body, _ := ioutil.ReadAll(req.Body)
+		var start, end int
+		fmt.Sscanf(req.Header.Get("Content-Range"), "%d-%d", &start, &end)
+		if start != s.received.Len() {
+			w.WriteHeader(416)
+			return
+		}
+		if s.patches == s.failPatch {
+			// Accept half the chunk, then fail
+			s.received.Write(body[:len(body)/2])
+			w.WriteHeader(500)
+			return
+		}
+		s.received.Write(body)
+		w.Header().Set("Location", "/v2/test/repo/blobs/uploads/1")
+		w.Header().Set("Range", fmt.Sprintf("0-%d", s.received.Len()-1))
+		w.WriteHeader(202)
+
+	case req.Method == "GET" && strings.HasPrefix(req.URL.Path, "/v2/test/repo/blobs/uploads/"):
+		w.Header().Set("Range", fmt.Sprintf("0-%d", s.received.Len()-1))
+		w.WriteHeader(204)
+
+	case req.Method == "PUT":
+		s.digest = req.URL.Query().Get("digest")
+		hash := sha256.Sum256(s.received.Bytes())
+		actual := "sha256:" + hex.EncodeToString(hash[:])
+		if actual != s.digest {
+			w.WriteHeader(400)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", actual)
+		w.WriteHeader(201)
+
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func TestUploadBlobChunkedResume(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	hash := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(hash[:])
+
+	for _, failPatch := range []int{0, 1, 3} {
+		handler := &chunkedUploadServer{failPatch: failPatch}
+		server := httptest.NewServer(handler)
+
+		registry := &Registry{URL: server.URL, ChunkSize: 3000}
+		err := registry.UploadBlob(&Auth{}, "test/repo", digest, bytes.NewReader(data), int64(len(data)))
+		server.Close()
+
+		if err != nil {
+			t.Errorf("unexpected error uploading blob (failPatch=%d): %v", failPatch, err)
+			continue
+		}
+		if !bytes.Equal(handler.received.Bytes(), data) {
+			t.Errorf("uploaded data did not match (failPatch=%d)", failPatch)
+		}
+		if handler.digest != digest {
+			t.Errorf("unexpected digest on completion: %q", handler.digest)
+		}
+	}
+}
+
+func TestDownloadBlobFrom(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	digest := sha256Digest(data)
+
+	// Supports range requests
+	ranged := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.ServeContent(w, req, "blob", time.Time{}, bytes.NewReader(data))
+	}))
+	defer ranged.Close()
+
+	// Ignores range requests
+	unranged := httptest.NewServer(&memoryRegistry{blobs: map[string][]byte{digest: data}})
+	defer unranged.Close()
+
+	for _, server := range []*httptest.Server{ranged, unranged} {
+		for _, offset := range []int64{0, 1, 4321, int64(len(data))} {
+			registry := &Registry{URL: server.URL}
+
+			var buf bytes.Buffer
+			buf.Write(data[:offset])
+			n, err := registry.DownloadBlobFrom(&Auth{}, "test/repo", digest, offset, &buf)
+			if err != nil {
+				t.Errorf("unexpected error downloading from offset %d: %v", offset, err)
+				continue
+			}
+			if n != int64(len(data))-offset {
+				t.Errorf("unexpected bytes downloaded from offset %d: %d", offset, n)
+			}
+			if !bytes.Equal(buf.Bytes(), data) {
+				t.Errorf("resumed download from offset %d did not match", offset)
+			}
+		}
+	}
+}
+
+func TestDownloadBlobResumesAfterInterruption(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	digest := sha256Digest(data)
+
+	// The first request is cut off half way through the body
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.Write(data[:len(data)/2])
+			return
+		}
+		http.ServeContent(w, req, "blob", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	registry := &Registry{URL: server.URL}
+
+	var buf bytes.Buffer
+	n, err := registry.DownloadBlobFrom(&Auth{}, "test/repo", digest, 0, &buf)
+	if err == nil {
+		t.Fatalf("expected error from interrupted download")
+	}
+	if n != int64(len(data)/2) || buf.Len() != len(data)/2 {
+		t.Fatalf("unexpected bytes from interrupted download: n=%d buffered=%d", n, buf.Len())
+	}
+
+	if _, err := registry.DownloadBlobFrom(&Auth{}, "test/repo", digest, n, &buf); err != nil {
+		t.Fatalf("unexpected error resuming download: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("resumed download did not match")
+	}
+}
+
+func TestParseContentRangeStart(t *testing.T) {
+	grid := []struct {
+		Input    string
+		Expected int64
+	}{
+		{Input: "bytes 0-99/100", Expected: 0},
+		{Input: "bytes 4321-9999/10000", Expected: 4321},
+		{Input: "bytes 10-19/*", Expected: 10},
+	}
+	for _, g := range grid {
+		actual, err := parseContentRangeStart(g.Input)
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %v", g.Input, err)
+			continue
+		}
+		if actual != g.Expected {
+			t.Errorf("unexpected result parsing %q: actual=%d expected=%d", g.Input, actual, g.Expected)
+		}
+	}
+
+	for _, s := range []string{"", "bytes */100", "garbage"} {
+		if _, err := parseContentRangeStart(s); err == nil {
+			t.Errorf("expected error parsing %q", s)
+		}
+	}
+}
+
+func TestDownloadBlobVerifiesDigest(t *testing.T) {
+	data := []byte("hello world")
+	digest := sha256Digest(data)
+	corrupt := sha256Digest([]byte("goodbye world"))
+
+	server := httptest.NewServer(&memoryRegistry{blobs: map[string][]byte{
+		digest:  data,
+		corrupt: data,
+	}})
+	defer server.Close()
+
+	registry := &Registry{URL: server.URL}
+
+	var buf bytes.Buffer
+	if _, err := registry.DownloadBlob(&Auth{}, "test/repo", digest, &buf); err != nil {
+		t.Errorf("unexpected error downloading blob: %v", err)
+	}
+
+	_, err := registry.DownloadBlob(&Auth{}, "test/repo", corrupt, &buf)
+	if !verify.IsDigestMismatch(err) {
+		t.Fatalf("expected digest mismatch, got %v", err)
+	}
+	mismatch := err.(*verify.DigestMismatchError)
+	if mismatch.Expected != corrupt || mismatch.Actual != digest {
+		t.Errorf("unexpected digests in error: %v", mismatch)
+	}
+}
+
+func TestListTagsPagination(t *testing.T) {
+	defer useEmptyDockerConfig(t)()
+
+	pages := map[string]struct {
+		Tags []string
+		Link string
+	}{
+		"":    {Tags: []string{"1.0", "1.1"}, Link: `</v2/test/repo/tags/list?n=2&last=1.1>; rel="next"`},
+		"1.1": {Tags: []string{"2.0", "2.1"}, Link: `<http://%s/v2/test/repo/tags/list?n=2&last=2.1>; rel="next"`},
+		"2.1": {Tags: []string{"latest"}},
+	}
+
+	tokens := 0
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/token" {
+			tokens++
+			if req.URL.Query().Get("scope") != "repository:test/repo:pull" {
+				t.Errorf("unexpected scope requested: %q", req.URL.Query().Get("scope"))
+			}
+			fmt.Fprintf(w, `{"token": "secret"}`)
+			return
+		}
+
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:test/repo:pull"`, server.URL))
+			w.WriteHeader(401)
+			return
+		}
+		if req.URL.Path != "/v2/test/repo/tags/list" {
+			w.WriteHeader(404)
+			return
+		}
+
+		page, found := pages[req.URL.Query().Get("last")]
+		if !found {
+			w.WriteHeader(400)
+			return
+		}
+		if page.Link != "" {
+			w.Header().Set("Link", strings.Replace(page.Link, "%s", req.Host, -1))
+		}
+		fmt.Fprintf(w, `{"name": "test/repo", "tags": ["%s"]}`, strings.Join(page.Tags, `", "`))
+	}))
+	defer server.Close()
+
+	registry := &Registry{URL: server.URL}
+	tags, err := registry.ListTags(&Auth{}, "test/repo")
+	if err != nil {
+		t.Fatalf("unexpected error listing tags: %v", err)
+	}
+
+	expected := []string{"1.0", "1.1", "2.0", "2.1", "latest"}
+	if strings.Join(tags, ",") != strings.Join(expected, ",") {
+		t.Errorf("unexpected tags: actual=%v expected=%v", tags, expected)
+	}
+	if tokens != 1 {
+		t.Errorf("expected the token to be reused across pages, but requested %d tokens", tokens)
+	}
+}
+
+func TestCatalogPagination(t *testing.T) {
+	defer useEmptyDockerConfig(t)()
+
+	pages := map[string]struct {
+		Repositories []string
+		Link         string
+	}{
+		"":      {Repositories: []string{"a/one", "a/two"}, Link: `</v2/_catalog?n=2&last=a%2Ftwo>; rel="next"`},
+		"a/two": {Repositories: []string{"b/three"}},
+	}
+
+	tokens := 0
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/token" {
+			tokens++
+			if req.URL.Query().Get("scope") != catalogScope {
+				t.Errorf("unexpected scope requested: %q", req.URL.Query().Get("scope"))
+			}
+			fmt.Fprintf(w, `{"token": "secret"}`)
+			return
+		}
+
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="%s"`, server.URL, catalogScope))
+			w.WriteHeader(401)
+			return
+		}
+		if req.URL.Path != "/v2/_catalog" {
+			w.WriteHeader(404)
+			return
+		}
+
+		page, found := pages[req.URL.Query().Get("last")]
+		if !found {
+			w.WriteHeader(400)
+			return
+		}
+		if page.Link != "" {
+			w.Header().Set("Link", page.Link)
+		}
+		fmt.Fprintf(w, `{"repositories": ["%s"]}`, strings.Join(page.Repositories, `", "`))
+	}))
+	defer server.Close()
+
+	registry := &Registry{URL: server.URL}
+	repositories, err := registry.Catalog(&Auth{})
+	if err != nil {
+		t.Fatalf("unexpected error listing repositories: %v", err)
+	}
+
+	expected := []string{"a/one", "a/two", "b/three"}
+	if strings.Join(repositories, ",") != strings.Join(expected, ",") {
+		t.Errorf("unexpected repositories: actual=%v expected=%v", repositories, expected)
+	}
+	if tokens != 1 {
+		t.Errorf("expected the token to be reused across pages, but requested %d tokens", tokens)
+	}
+}
+
+func TestParseNextLink(t *testing.T) {
+	grid := []struct {
+		Input    string
+		Expected string
+		OK       bool
+	}{
+		{Input: `</v2/foo/tags/list?n=10&last=b>; rel="next"`, Expected: "/v2/foo/tags/list?n=10&last=b", OK: true},
+		{Input: ` <https://r.example.com/v2/_catalog?last=x>;rel=next`, Expected: "https://r.example.com/v2/_catalog?last=x", OK: true},
+		{Input: `</v2/foo/tags/list?n=10>; rel="prev"`, OK: false},
+		{Input: `/v2/foo/tags/list; rel="next"`, OK: false},
+		{Input: ``, OK: false},
+	}
+
+	for _, g := range grid {
+		actual, ok := parseNextLink(g.Input)
+		if ok != g.OK || actual != g.Expected {
+			t.Errorf("unexpected result parsing %q: actual=%q,%v expected=%q,%v", g.Input, actual, ok, g.Expected, g.OK)
+		}
+	}
+}
+
+func TestDeleteManifest(t *testing.T) {
+	defer useEmptyDockerConfig(t)()
+
+	manifest := []byte(`{"schemaVersion": 2}`)
+	digest := sha256Digest(manifest)
+
+	deletesEnabled := true
+	var deleted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Method == "HEAD" && req.URL.Path == "/v2/test/repo/manifests/preview-1":
+			if len(req.Header["Accept"]) != len(manifestAcceptTypes) {
+				t.Errorf("expected manifest types in Accept header, got %v", req.Header["Accept"])
+			}
+			w.Header().Set("Docker-Content-Digest", digest)
+			w.WriteHeader(200)
+
+		case req.Method == "DELETE" && req.URL.Path == "/v2/test/repo/manifests/"+digest:
+			if !deletesEnabled {
+				w.WriteHeader(405)
+				return
+			}
+			deleted = append(deleted, digest)
+			w.WriteHeader(202)
+
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	registry := &Registry{URL: server.URL}
+	auth := &Auth{}
+
+	actual, err := registry.ResolveManifest(auth, "test/repo", "preview-1")
+	if err != nil {
+		t.Fatalf("unexpected error resolving manifest: %v", err)
+	}
+	if actual != digest {
+		t.Errorf("unexpected digest: actual=%s expected=%s", actual, digest)
+	}
+
+	if _, err := registry.ResolveManifest(auth, "test/repo", "missing"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected not found error for missing tag, got %v", err)
+	}
+
+	if err := registry.DeleteManifest(auth, "test/repo", digest); err != nil {
+		t.Fatalf("unexpected error deleting manifest: %v", err)
+	}
+	if len(deleted) != 1 {
+		t.Errorf("expected manifest to be deleted once, deleted %v", deleted)
+	}
+
+	deletesEnabled = false
+	err = registry.DeleteManifest(auth, "test/repo", digest)
+	if err == nil || !strings.Contains(err.Error(), "does not allow deletes") {
+		t.Errorf("expected error reporting that deletes are disabled, got %v", err)
+	}
+}
+
+func TestPutManifestVerifiesDigest(t *testing.T) {
+	defer useEmptyDockerConfig(t)()
+
+	reportedDigest := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "PUT" || req.URL.Path != "/v2/test/repo/manifests/latest" {
+			w.WriteHeader(404)
+			return
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Errorf("error reading manifest: %v", err)
+		}
+		digest := reportedDigest
+		if digest == "" {
+			digest = sha256Digest(body)
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(201)
+	}))
+	defer server.Close()
+
+	registry := &Registry{URL: server.URL}
+	manifest := &ManifestV2{}
+	manifest.SchemaVersion = 2
+	manifest.MediaType = MediaTypeDockerManifest
+
+	descriptor, err := registry.PutManifest(&Auth{}, "test/repo", "latest", manifest)
+	if err != nil {
+		t.Fatalf("unexpected error putting manifest: %v", err)
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("error serializing manifest: %v", err)
+	}
+	if descriptor.Digest != sha256Digest(data) {
+		t.Errorf("unexpected digest %s, expected %s", descriptor.Digest, sha256Digest(data))
+	}
+
+	reportedDigest = sha256Digest([]byte("something else"))
+	if _, err := registry.PutManifest(&Auth{}, "test/repo", "latest", manifest); err == nil {
+		t.Errorf("expected error when the registry reports a different digest")
+	}
+}
+
+func TestFindPlatform(t *testing.T) {
+	list := &ManifestV2{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIIndex,
+		Manifests: []ManifestV2Layer{
+			{Digest: "sha256:attestation"},
+			{Digest: "sha256:amd64", Platform: &Platform{OS: "linux", Architecture: "amd64"}},
+			{Digest: "sha256:armv6", Platform: &Platform{OS: "linux", Architecture: "arm", Variant: "v6"}},
+			{Digest: "sha256:armv7", Platform: &Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+			{Digest: "sha256:windows", Platform: &Platform{OS: "windows", Architecture: "amd64"}},
+		},
+	}
+
+	grid := []struct {
+		Platform *Platform
+		Expected string
+	}{
+		{Platform: &Platform{OS: "linux", Architecture: "amd64"}, Expected: "sha256:amd64"},
+		{Platform: &Platform{OS: "windows", Architecture: "amd64"}, Expected: "sha256:windows"},
+		{Platform: &Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, Expected: "sha256:armv7"},
+		// Without a variant, we take the first match
+		{Platform: &Platform{OS: "linux", Architecture: "arm"}, Expected: "sha256:armv6"},
+		{Platform: &Platform{OS: "linux", Architecture: "arm", Variant: "v8"}, Expected: ""},
+		{Platform: &Platform{OS: "linux", Architecture: "s390x"}, Expected: ""},
+	}
+
+	for _, g := range grid {
+		entry := list.FindPlatform(g.Platform)
+		actual := ""
+		if entry != nil {
+			actual = entry.Digest
+		}
+		if actual != g.Expected {
+			t.Errorf("platform %s: expected %q, got %q", g.Platform, g.Expected, actual)
+		}
+	}
+}
+
+// useEmptyDockerConfig points DOCKER_CONFIG at an empty directory, so tests don't pick up the user's credentials
+func useEmptyDockerConfig(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "docker-config")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+
+	oldDockerConfig := os.Getenv("DOCKER_CONFIG")
+	os.Setenv("DOCKER_CONFIG", dir)
+
+	return func() {
+		os.Setenv("DOCKER_CONFIG", oldDockerConfig)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestGetManifestVerifiesDigest(t *testing.T) {
+	manifest := []byte(`{"schemaVersion": 2, "mediaType": "` + MediaTypeDockerManifest + `", "config": {"digest": "sha256:` + strings.Repeat("c", 64) + `", "size": 100}, "layers": []}`)
+	tampered := []byte(`{"schemaVersion": 2, "mediaType": "` + MediaTypeDockerManifest + `", "config": {"digest": "sha256:` + strings.Repeat("d", 64) + `", "size": 100}, "layers": []}`)
+	digest := sha256Digest(manifest)
+
+	server := httptest.NewServer(&memoryRegistry{manifests: map[string][]byte{
+		"latest": tampered,
+		digest:   tampered,
+	}})
+	defer server.Close()
+
+	registry := &Registry{URL: server.URL}
+
+	// A tag can refer to any manifest
+	if _, err := registry.GetManifest(&Auth{}, "test/repo", "latest"); err != nil {
+		t.Errorf("unexpected error reading manifest by tag: %v", err)
+	}
+
+	// But a digest pins the content
+	m, err := registry.GetManifest(&Auth{}, "test/repo", digest)
+	if err == nil || !strings.Contains(err.Error(), "had digest "+sha256Digest(tampered)) {
+		t.Errorf("expected error reading manifest with the wrong digest, got %v %v", m, err)
+	}
+}
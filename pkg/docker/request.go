@@ -0,0 +1,235 @@
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// DefaultMaxRetries is the number of times we retry a request that fails with a transient error,
+// when Registry.MaxRetries is not set
+const DefaultMaxRetries = 5
+
+// DefaultRetryBackoff is the delay before the first retry, when Registry.RetryBackoff is not set
+const DefaultRetryBackoff = time.Second
+
+// maxRetryBackoff caps the exponential backoff between retries
+const maxRetryBackoff = 30 * time.Second
+
+// maxRetryAfter caps how long we will honor a Retry-After header for
+const maxRetryAfter = 2 * time.Minute
+
+// sleep is replaced in tests
+var sleep = time.Sleep
+
+// registryRequest is a request to the registry.  The body is held in memory, so that it can be re-sent
+// if we retry the request.
+type registryRequest struct {
+	Method string
+	URL    string
+	Header http.Header
+	Body   []byte
+
+	// Repository and Permission select the token we send; ExtraScopes are requested in addition.
+	// Requests which are not for a repository (e.g. the catalog) can set just ExtraScopes.
+	Repository  string
+	Permission  string
+	ExtraScopes []string
+
+	// NoRetry disables retries on transient errors, for requests where the caller has a better recovery strategy
+	NoRetry bool
+}
+
+// do sends the request, handling auth challenges and retrying transient failures
+// (connection errors, 429 Too Many Requests and 5xx responses) with exponential backoff.
+// The caller must close the response body.
+func (r *Registry) do(auth *Auth, rr *registryRequest) (*http.Response, error) {
+	authHeader := ""
+	if auth != nil {
+		if rr.Repository != "" {
+			authHeader = auth.FindHeader(r, rr.Repository, rr.Permission, rr.ExtraScopes...)
+		} else if len(rr.ExtraScopes) != 0 {
+			authHeader = auth.findHeaderForScopes(r, rr.ExtraScopes)
+		}
+	}
+
+	maxRetries := r.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = DefaultMaxRetries
+	}
+	if maxRetries < 0 || rr.NoRetry {
+		maxRetries = 0
+	}
+
+	retries := 0
+	authenticated := false
+	for {
+		var body io.Reader
+		if rr.Body != nil {
+			body = bytes.NewReader(rr.Body)
+		}
+		req, err := http.NewRequest(rr.Method, rr.URL, body)
+		if err != nil {
+			return nil, fmt.Errorf("error building request: %v", err)
+		}
+		for k, v := range rr.Header {
+			req.Header[k] = v
+		}
+		if authHeader != "" {
+			req.Header.Set("Authorization", authHeader)
+		}
+
+		glog.V(2).Infof("HTTP %s %s", req.Method, req.URL)
+		resp, err := r.httpClient().Do(req)
+		if err != nil {
+			if retries >= maxRetries || !isRetryableError(err) {
+				return nil, err
+			}
+			delay := r.backoff(retries)
+			glog.Warningf("error from %s %s, will retry in %v: %v", rr.Method, rr.URL, delay, err)
+			retries++
+			sleep(delay)
+			continue
+		}
+
+		switch {
+		case resp.StatusCode == 401 && auth != nil && !authenticated:
+			// Get a token for the challenge, and try again (once).  We pass the scopes we need, so that
+			// the token is cached for them even if the challenge doesn't say what they are.
+			authenticated = true
+			scopes := rr.ExtraScopes
+			if rr.Repository != "" {
+				scopes = append([]string{repositoryScope(rr.Repository, rr.Permission).String()}, rr.ExtraScopes...)
+			}
+			authHeader, err = auth.GetHeader(r, resp, scopes...)
+			discardBody(resp)
+			if err != nil {
+				return nil, err
+			}
+
+		case isRetryableStatus(resp.StatusCode) && retries < maxRetries:
+			delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+			if !ok {
+				delay = r.backoff(retries)
+			}
+			glog.Warningf("%s %s returned %s, will retry in %v", rr.Method, rr.URL, resp.Status, delay)
+			discardBody(resp)
+			retries++
+			sleep(delay)
+
+		default:
+			return resp, nil
+		}
+	}
+}
+
+// doSimple sends the request with do, and reads the whole response body
+func (r *Registry) doSimple(auth *Auth, rr *registryRequest) (*http.Response, []byte, error) {
+	resp, err := r.do(auth, rr)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading response body: %v", err)
+	}
+
+	return resp, body, nil
+}
+
+// backoff returns the delay before the retry following the specified number of retries
+func (r *Registry) backoff(retries int) time.Duration {
+	delay := r.RetryBackoff
+	if delay <= 0 {
+		delay = DefaultRetryBackoff
+	}
+	for i := 0; i < retries; i++ {
+		delay *= 2
+		if delay >= maxRetryBackoff {
+			return maxRetryBackoff
+		}
+	}
+	return delay
+}
+
+// isRetryableError returns false for connection errors which retrying will not fix, such as certificate problems
+func isRetryableError(err error) bool {
+	// The TLS error types vary between go versions, but the messages are stable
+	msg := err.Error()
+	if strings.Contains(msg, "x509: ") || strings.Contains(msg, "tls: ") {
+		return false
+	}
+	return true
+}
+
+// StatusError is returned when the registry responds with an unexpected HTTP status
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return e.Message
+}
+
+// IsTransient returns true if err is a failure that may succeed if the request is sent again:
+// a connection error, or a response such as 503 Service Unavailable.  A 404 or 401, for example, is not transient.
+func IsTransient(err error) bool {
+	switch err := err.(type) {
+	case *StatusError:
+		return isRetryableStatus(err.StatusCode)
+	case *url.Error:
+		return isRetryableError(err)
+	}
+	return false
+}
+
+// isRetryableStatus returns true if the status code indicates a transient failure
+func isRetryableStatus(code int) bool {
+	switch code {
+	case 408, 429, 500, 502, 503, 504:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of seconds or an HTTP date
+func parseRetryAfter(s string, now time.Time) (time.Duration, bool) {
+	if s == "" {
+		return 0, false
+	}
+
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(s); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(s); err == nil {
+		delay = t.Sub(now)
+	} else {
+		glog.V(2).Infof("ignoring unparseable Retry-After %q", s)
+		return 0, false
+	}
+
+	if delay < 0 {
+		delay = 0
+	}
+	if delay > maxRetryAfter {
+		delay = maxRetryAfter
+	}
+	return delay, true
+}
+
+// discardBody reads and closes the response body, so the connection can be reused
+func discardBody(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
@@ -0,0 +1,376 @@
+package docker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fault is a failure injected in place of the real response
+type fault struct {
+	// Method restricts the fault to requests with this method; empty matches any request
+	Method string
+
+	// Status is the response code to return, unless Reset is set
+	Status     int
+	RetryAfter string
+
+	// Reset closes the connection without sending a response
+	Reset bool
+}
+
+// faultInjector wraps a handler, failing requests with the queued faults in order until they are used up
+type faultInjector struct {
+	handler http.Handler
+
+	mutex    sync.Mutex
+	faults   []fault
+	requests int
+}
+
+func (f *faultInjector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mutex.Lock()
+	f.requests++
+	var injected *fault
+	if len(f.faults) != 0 && (f.faults[0].Method == "" || f.faults[0].Method == req.Method) {
+		injected = &f.faults[0]
+		f.faults = f.faults[1:]
+	}
+	f.mutex.Unlock()
+
+	if injected == nil {
+		f.handler.ServeHTTP(w, req)
+		return
+	}
+
+	// Consume the body, so we know retries must re-send it
+	ioutil.ReadAll(req.Body)
+
+	if injected.Reset {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			panic(err)
+		}
+		conn.Close()
+		return
+	}
+
+	if injected.RetryAfter != "" {
+		w.Header().Set("Retry-After", injected.RetryAfter)
+	}
+	w.WriteHeader(injected.Status)
+}
+
+// memoryRegistry serves manifests and blobs for a single repository from memory
+type memoryRegistry struct {
+	mutex     sync.Mutex
+	manifests map[string][]byte
+	blobs     map[string][]byte
+}
+
+func (m *memoryRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	const prefix = "/v2/test/repo/"
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		w.WriteHeader(404)
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, prefix)
+
+	switch {
+	case strings.HasPrefix(path, "manifests/") && req.Method == "PUT":
+		body, _ := ioutil.ReadAll(req.Body)
+		m.manifests[strings.TrimPrefix(path, "manifests/")] = body
+		w.WriteHeader(201)
+
+	case strings.HasPrefix(path, "manifests/") && req.Method == "GET":
+		body, found := m.manifests[strings.TrimPrefix(path, "manifests/")]
+		if !found {
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("Content-Type", MediaTypeDockerManifest)
+		w.Write(body)
+
+	case strings.HasPrefix(path, "blobs/") && (req.Method == "GET" || req.Method == "HEAD"):
+		body, found := m.blobs[strings.TrimPrefix(path, "blobs/")]
+		if !found {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write(body)
+
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+// recordSleeps replaces sleep for the duration of a test, recording the requested delays
+func recordSleeps() (*[]time.Duration, func()) {
+	var sleeps []time.Duration
+	oldSleep := sleep
+	sleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+	}
+	return &sleeps, func() {
+		sleep = oldSleep
+	}
+}
+
+func TestRetryTransientFailures(t *testing.T) {
+	sleeps, restore := recordSleeps()
+	defer restore()
+
+	blob := []byte("hello world")
+	blobDigest := sha256Digest(blob)
+
+	grid := []struct {
+		Name   string
+		Faults []fault
+	}{
+		{Name: "no faults"},
+		{Name: "503", Faults: []fault{{Status: 503}}},
+		{Name: "502 then 504", Faults: []fault{{Status: 502}, {Status: 504}}},
+		{Name: "429", Faults: []fault{{Status: 429, RetryAfter: "1"}}},
+		{Name: "connection reset", Faults: []fault{{Reset: true}}},
+		{Name: "mixed", Faults: []fault{{Reset: true}, {Status: 500}, {Status: 429}}},
+	}
+
+	for _, g := range grid {
+		backend := &memoryRegistry{
+			manifests: make(map[string][]byte),
+			blobs:     map[string][]byte{blobDigest: blob},
+		}
+		injector := &faultInjector{handler: backend}
+		server := httptest.NewServer(injector)
+		registry := &Registry{URL: server.URL}
+		auth := &Auth{}
+
+		// Each operation sees the full sequence of faults
+		manifest := &ManifestV2{
+			SchemaVersion: 2,
+			MediaType:     MediaTypeDockerManifest,
+			Config:        &ManifestV2Layer{MediaType: MediaTypeDockerConfig, Size: int64(len(blob)), Digest: blobDigest},
+		}
+		injector.faults = append([]fault(nil), g.Faults...)
+		descriptor, err := registry.PutManifest(auth, "test/repo", "latest", manifest)
+		if err != nil {
+			t.Errorf("%s: unexpected error from PutManifest: %v", g.Name, err)
+		}
+
+		injector.faults = append([]fault(nil), g.Faults...)
+		actual, err := registry.GetManifest(auth, "test/repo", "latest")
+		if err != nil {
+			t.Errorf("%s: unexpected error from GetManifest: %v", g.Name, err)
+		} else if descriptor != nil && actual.Digest() != descriptor.Digest {
+			t.Errorf("%s: manifest body was not re-sent intact: digest %s, expected %s", g.Name, actual.Digest(), descriptor.Digest)
+		}
+
+		injector.faults = append([]fault(nil), g.Faults...)
+		found, err := registry.HasBlob(auth, "test/repo", blobDigest)
+		if err != nil {
+			t.Errorf("%s: unexpected error from HasBlob: %v", g.Name, err)
+		} else if !found {
+			t.Errorf("%s: HasBlob did not find blob", g.Name)
+		}
+
+		injector.faults = append([]fault(nil), g.Faults...)
+		var downloaded bytes.Buffer
+		if _, err := registry.DownloadBlob(auth, "test/repo", blobDigest, &downloaded); err != nil {
+			t.Errorf("%s: unexpected error from DownloadBlob: %v", g.Name, err)
+		} else if !bytes.Equal(downloaded.Bytes(), blob) {
+			t.Errorf("%s: downloaded blob did not match", g.Name)
+		}
+
+		server.Close()
+
+		expectedRequests := 4 * (len(g.Faults) + 1)
+		if injector.requests != expectedRequests {
+			t.Errorf("%s: unexpected number of requests: actual=%d expected=%d", g.Name, injector.requests, expectedRequests)
+		}
+	}
+
+	if len(*sleeps) == 0 {
+		t.Errorf("expected retries to back off")
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	grid := []struct {
+		Name     string
+		Faults   []fault
+		Expected []time.Duration
+	}{
+		{
+			Name:     "exponential",
+			Faults:   []fault{{Status: 503}, {Status: 503}, {Status: 503}},
+			Expected: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second},
+		},
+		{
+			Name:     "retry-after seconds",
+			Faults:   []fault{{Status: 429, RetryAfter: "7"}, {Status: 503}},
+			Expected: []time.Duration{7 * time.Second, 2 * time.Second},
+		},
+		{
+			Name:     "retry-after is capped",
+			Faults:   []fault{{Status: 429, RetryAfter: "86400"}},
+			Expected: []time.Duration{maxRetryAfter},
+		},
+		{
+			Name:     "unparseable retry-after",
+			Faults:   []fault{{Status: 429, RetryAfter: "soon"}},
+			Expected: []time.Duration{time.Second},
+		},
+	}
+
+	for _, g := range grid {
+		sleeps, restore := recordSleeps()
+
+		injector := &faultInjector{
+			handler: &memoryRegistry{blobs: map[string][]byte{"sha256:abc": []byte("abc")}},
+			faults:  g.Faults,
+		}
+		server := httptest.NewServer(injector)
+		registry := &Registry{URL: server.URL}
+
+		_, err := registry.HasBlob(&Auth{}, "test/repo", "sha256:abc")
+		server.Close()
+		restore()
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", g.Name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*sleeps, g.Expected) {
+			t.Errorf("%s: unexpected delays: actual=%v expected=%v", g.Name, *sleeps, g.Expected)
+		}
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	sleeps, restore := recordSleeps()
+	defer restore()
+
+	var faults []fault
+	for i := 0; i < 10; i++ {
+		faults = append(faults, fault{Status: 503})
+	}
+	injector := &faultInjector{
+		handler: &memoryRegistry{},
+		faults:  faults,
+	}
+	server := httptest.NewServer(injector)
+	defer server.Close()
+
+	registry := &Registry{URL: server.URL, MaxRetries: 2, RetryBackoff: time.Millisecond}
+	if _, err := registry.HasBlob(&Auth{}, "test/repo", "sha256:abc"); err == nil {
+		t.Errorf("expected error after retries were exhausted")
+	}
+	if injector.requests != 3 {
+		t.Errorf("unexpected number of requests: actual=%d expected=3", injector.requests)
+	}
+	if !reflect.DeepEqual(*sleeps, []time.Duration{time.Millisecond, 2 * time.Millisecond}) {
+		t.Errorf("unexpected delays: %v", *sleeps)
+	}
+
+	// Client errors are not retried
+	injector.requests = 0
+	injector.faults = []fault{{Status: 400}}
+	if _, err := registry.HasBlob(&Auth{}, "test/repo", "sha256:abc"); err == nil {
+		t.Errorf("expected error from 400 response")
+	}
+	if injector.requests != 1 {
+		t.Errorf("unexpected number of requests for 400 response: %d", injector.requests)
+	}
+}
+
+func TestUploadBlobRetries(t *testing.T) {
+	_, restore := recordSleeps()
+	defer restore()
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	hash := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(hash[:])
+
+	handler := &chunkedUploadServer{}
+	injector := &faultInjector{
+		handler: handler,
+		faults: []fault{
+			{Method: "POST", Status: 503},
+			{Method: "POST", Reset: true},
+			{Method: "PUT", Status: 429, RetryAfter: "1"},
+			{Method: "PUT", Reset: true},
+		},
+	}
+	server := httptest.NewServer(injector)
+	defer server.Close()
+
+	registry := &Registry{URL: server.URL, ChunkSize: 3000}
+	if err := registry.UploadBlob(&Auth{}, "test/repo", digest, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("unexpected error uploading blob: %v", err)
+	}
+	if !bytes.Equal(handler.received.Bytes(), data) {
+		t.Errorf("uploaded data did not match")
+	}
+	if handler.digest != digest {
+		t.Errorf("unexpected digest on completion: %q", handler.digest)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	grid := []struct {
+		Input    string
+		Expected time.Duration
+		OK       bool
+	}{
+		{Input: "", OK: false},
+		{Input: "garbage", OK: false},
+		{Input: "0", Expected: 0, OK: true},
+		{Input: "30", Expected: 30 * time.Second, OK: true},
+		{Input: "-5", Expected: 0, OK: true},
+		{Input: "3600", Expected: maxRetryAfter, OK: true},
+		{Input: "Thu, 01 Jun 2017 12:00:45 GMT", Expected: 45 * time.Second, OK: true},
+		{Input: "Thu, 01 Jun 2017 11:00:00 GMT", Expected: 0, OK: true},
+	}
+
+	for _, g := range grid {
+		actual, ok := parseRetryAfter(g.Input, now)
+		if ok != g.OK || actual != g.Expected {
+			t.Errorf("unexpected result parsing %q: actual=%v,%v expected=%v,%v", g.Input, actual, ok, g.Expected, g.OK)
+		}
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	grid := []struct {
+		Err       error
+		Transient bool
+	}{
+		{Err: &StatusError{StatusCode: 503, Message: "unavailable"}, Transient: true},
+		{Err: &StatusError{StatusCode: 429, Message: "too many requests"}, Transient: true},
+		{Err: &StatusError{StatusCode: 404, Message: "not found"}, Transient: false},
+		{Err: &StatusError{StatusCode: 401, Message: "permission denied"}, Transient: false},
+		{Err: &url.Error{Op: "Get", URL: "https://registry.example.com/v2/", Err: fmt.Errorf("connection reset by peer")}, Transient: true},
+		{Err: &url.Error{Op: "Get", URL: "https://registry.example.com/v2/", Err: fmt.Errorf("x509: certificate signed by unknown authority")}, Transient: false},
+		{Err: fmt.Errorf("registry returned blob from the wrong offset"), Transient: false},
+	}
+	for _, g := range grid {
+		if actual := IsTransient(g.Err); actual != g.Transient {
+			t.Errorf("IsTransient(%v) was %v, expected %v", g.Err, actual, g.Transient)
+		}
+	}
+}
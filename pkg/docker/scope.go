@@ -0,0 +1,146 @@
+package docker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// scope is a token scope, e.g. repository:foo/bar:pull,push
+type scope struct {
+	Type    string
+	Name    string
+	Actions []string
+}
+
+// parseScope parses a scope of the form type:name:action[,action...]
+func parseScope(s string) (*scope, error) {
+	first := strings.Index(s, ":")
+	last := strings.LastIndex(s, ":")
+	if first == -1 || first == last {
+		return nil, fmt.Errorf("cannot parse scope %q", s)
+	}
+
+	parsed := &scope{
+		Type: s[:first],
+		Name: s[first+1 : last],
+	}
+	for _, action := range strings.Split(s[last+1:], ",") {
+		if action != "" {
+			parsed.addAction(action)
+		}
+	}
+	return parsed, nil
+}
+
+// parseScopes parses space-separated scopes, as found in a www-authenticate challenge
+func parseScopes(s string) []*scope {
+	var scopes []*scope
+	for _, field := range strings.Fields(s) {
+		parsed, err := parseScope(field)
+		if err != nil {
+			glog.Warningf("ignoring scope: %v", err)
+			continue
+		}
+		scopes = append(scopes, parsed)
+	}
+	return scopes
+}
+
+// repositoryScope returns the scope for the permission (e.g. "pull,push") on the repository
+func repositoryScope(repository string, permission string) *scope {
+	s := &scope{
+		Type: "repository",
+		Name: repository,
+	}
+	for _, action := range strings.Split(permission, ",") {
+		if action != "" {
+			s.addAction(action)
+		}
+	}
+	return s
+}
+
+func (s *scope) String() string {
+	return s.Type + ":" + s.Name + ":" + strings.Join(s.Actions, ",")
+}
+
+func (s *scope) addAction(action string) {
+	for _, a := range s.Actions {
+		if a == action {
+			return
+		}
+	}
+	s.Actions = append(s.Actions, action)
+}
+
+func (s *scope) hasAction(action string) bool {
+	for _, a := range s.Actions {
+		if a == action || a == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// covers returns true if a token granted for s is sufficient for the requested scope
+func (s *scope) covers(requested *scope) bool {
+	if s.Type != requested.Type || s.Name != requested.Name {
+		return false
+	}
+	for _, action := range requested.Actions {
+		if !s.hasAction(action) {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeScopes combines scopes for the same resource, so we request each resource once with all its actions
+func mergeScopes(scopes []*scope) []*scope {
+	var merged []*scope
+	for _, s := range scopes {
+		found := false
+		for _, m := range merged {
+			if m.Type == s.Type && m.Name == s.Name {
+				for _, action := range s.Actions {
+					m.addAction(action)
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			c := &scope{Type: s.Type, Name: s.Name}
+			c.Actions = append(c.Actions, s.Actions...)
+			merged = append(merged, c)
+		}
+	}
+	return merged
+}
+
+// scopesCover returns true if the granted scopes include all the requested scopes
+func scopesCover(granted []*scope, requested []*scope) bool {
+	for _, r := range requested {
+		found := false
+		for _, g := range granted {
+			if g.covers(r) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func scopesString(scopes []*scope) string {
+	var s []string
+	for _, scope := range scopes {
+		s = append(s, scope.String())
+	}
+	return strings.Join(s, " ")
+}
@@ -0,0 +1,47 @@
+package docker
+
+import (
+	"testing"
+)
+
+func TestScopeCovers(t *testing.T) {
+	grid := []struct {
+		Granted   string
+		Requested string
+		Expected  bool
+	}{
+		{Granted: "repository:foo/bar:pull,push", Requested: "repository:foo/bar:pull", Expected: true},
+		{Granted: "repository:foo/bar:pull", Requested: "repository:foo/bar:pull,push", Expected: false},
+		{Granted: "repository:foo/bar:*", Requested: "repository:foo/bar:pull,push", Expected: true},
+		{Granted: "repository:foo/bar:pull", Requested: "repository:foo/baz:pull", Expected: false},
+		{Granted: "repository:foo/bar:pull registry:catalog:*", Requested: "registry:catalog:*", Expected: true},
+		{Granted: "repository:a:pull,push repository:b:pull", Requested: "repository:b:pull repository:a:push", Expected: true},
+		{Granted: "repository:a:pull,push", Requested: "repository:b:pull repository:a:push", Expected: false},
+		{Granted: "repository:localhost:5000/foo:pull", Requested: "repository:localhost:5000/foo:pull", Expected: true},
+	}
+
+	for _, g := range grid {
+		actual := scopesCover(parseScopes(g.Granted), parseScopes(g.Requested))
+		if actual != g.Expected {
+			t.Errorf("unexpected result for granted=%q requested=%q: actual=%v expected=%v", g.Granted, g.Requested, actual, g.Expected)
+		}
+	}
+}
+
+func TestMergeScopes(t *testing.T) {
+	grid := []struct {
+		Input    string
+		Expected string
+	}{
+		{Input: "repository:a:pull repository:a:push", Expected: "repository:a:pull,push"},
+		{Input: "repository:a:pull,push repository:b:pull repository:a:pull", Expected: "repository:a:pull,push repository:b:pull"},
+		{Input: "", Expected: ""},
+	}
+
+	for _, g := range grid {
+		actual := scopesString(mergeScopes(parseScopes(g.Input)))
+		if actual != g.Expected {
+			t.Errorf("unexpected merge of %q: actual=%q expected=%q", g.Input, actual, g.Expected)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package docker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// RegistryConfig is the connection configuration for a single registry
+type RegistryConfig struct {
+	// PlainHTTP connects to the registry over http instead of https
+	PlainHTTP bool `json:"plainHTTP,omitempty"`
+
+	// InsecureSkipVerify disables verification of the registry's certificate
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+
+	// CAFiles are PEM files containing additional CA certificates to trust for the registry
+	CAFiles []string `json:"caFiles,omitempty"`
+
+	// CertFile and KeyFile are a client certificate and key, for registries which require mutual TLS
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+
+	// Mirrors are registries (e.g. pull-through caches) which we try before this registry when fetching.
+	// Each is a URL such as https://mirror.example.com; its connection settings come from its own entry.
+	Mirrors []string `json:"mirrors,omitempty"`
+}
+
+// RegistriesConfig holds the configuration for the registries we talk to, keyed by host[:port].
+// Docker Hub is configured as docker.io.
+type RegistriesConfig struct {
+	Registries map[string]*RegistryConfig `json:"registries,omitempty"`
+
+	// CertsDirs are directories in the docker certs.d layout: <dir>/<host[:port]>/ holding CA certificates
+	// (*.crt) and client certificate / key pairs (*.cert and *.key).  If not set, DefaultCertsDirs is used.
+	CertsDirs []string `json:"certsDirs,omitempty"`
+}
+
+// DefaultCertsDirs returns the directories where docker looks for per-registry certificates
+func DefaultCertsDirs() []string {
+	return []string{
+		"/etc/docker/certs.d",
+		filepath.Join(filepath.Dir(dockerConfigPath()), "certs.d"),
+	}
+}
+
+// LoadRegistriesConfig reads the registries configuration from p; a missing file is an empty configuration
+func LoadRegistriesConfig(p string) (*RegistriesConfig, error) {
+	config := &RegistriesConfig{}
+
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			glog.V(2).Infof("registries config %q not found", p)
+			return config, nil
+		}
+		return nil, fmt.Errorf("error reading registries config %q: %v", p, err)
+	}
+
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, fmt.Errorf("error parsing registries config %q: %v", p, err)
+	}
+	return config, nil
+}
+
+// ForHost returns the configuration for the registry host, combining the explicit configuration
+// with any certificates found in the certs.d directories
+func (c *RegistriesConfig) ForHost(host string) (*RegistryConfig, error) {
+	config := &RegistryConfig{}
+	if explicit := c.Registries[host]; explicit != nil {
+		*config = *explicit
+		config.CAFiles = append([]string(nil), explicit.CAFiles...)
+		config.Mirrors = append([]string(nil), explicit.Mirrors...)
+	}
+
+	certsDirs := c.CertsDirs
+	if certsDirs == nil {
+		certsDirs = DefaultCertsDirs()
+	}
+	for _, certsDir := range certsDirs {
+		if err := config.addCertsDir(filepath.Join(certsDir, host)); err != nil {
+			return nil, err
+		}
+	}
+
+	return config, nil
+}
+
+// addCertsDir adds the certificates from a docker certs.d directory for a single registry
+func (c *RegistryConfig) addCertsDir(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("error reading certificates directory %q: %v", dir, err)
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		switch {
+		case strings.HasSuffix(name, ".crt"):
+			c.CAFiles = append(c.CAFiles, filepath.Join(dir, name))
+
+		case strings.HasSuffix(name, ".cert"):
+			keyName := strings.TrimSuffix(name, ".cert") + ".key"
+			keyFile := filepath.Join(dir, keyName)
+			if _, err := os.Stat(keyFile); err != nil {
+				return fmt.Errorf("missing key %s for client certificate %s", keyFile, filepath.Join(dir, name))
+			}
+			if c.CertFile != "" {
+				glog.V(2).Infof("ignoring client certificate %s, already using %s", filepath.Join(dir, name), c.CertFile)
+				continue
+			}
+			c.CertFile = filepath.Join(dir, name)
+			c.KeyFile = keyFile
+
+		case strings.HasSuffix(name, ".key"):
+			certName := strings.TrimSuffix(name, ".key") + ".cert"
+			if _, err := os.Stat(filepath.Join(dir, certName)); err != nil {
+				return fmt.Errorf("missing client certificate %s for key %s", filepath.Join(dir, certName), filepath.Join(dir, name))
+			}
+		}
+	}
+
+	return nil
+}
+
+// HTTPClient builds an http client using the configuration, or returns nil if the default client will do
+func (c *RegistryConfig) HTTPClient() (*http.Client, error) {
+	if !c.InsecureSkipVerify && len(c.CAFiles) == 0 && c.CertFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if len(c.CAFiles) != 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			glog.Warningf("unable to load system certificates: %v", err)
+			pool = x509.NewCertPool()
+		}
+		for _, caFile := range c.CAFiles {
+			b, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("error reading CA file %q: %v", caFile, err)
+			}
+			if !pool.AppendCertsFromPEM(b) {
+				return nil, fmt.Errorf("no certificates found in CA file %q", caFile)
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate %q / %q: %v", c.CertFile, c.KeyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// NewRegistry returns a Registry for the host, which is a host[:port] optionally prefixed with a scheme.
+// An empty host means Docker Hub.
+func (c *RegistriesConfig) NewRegistry(host string) (*Registry, error) {
+	if host == "" {
+		return &Registry{}, nil
+	}
+
+	scheme := "https://"
+	if strings.HasPrefix(host, "http://") {
+		scheme = "http://"
+	}
+	hostname := registryHost(host)
+
+	config, err := c.ForHost(hostname)
+	if err != nil {
+		return nil, err
+	}
+	if config.PlainHTTP {
+		scheme = "http://"
+	}
+
+	httpClient, err := config.HTTPClient()
+	if err != nil {
+		return nil, fmt.Errorf("error configuring connection to registry %s: %v", hostname, err)
+	}
+
+	return &Registry{
+		URL:        scheme + hostname,
+		HttpClient: httpClient,
+	}, nil
+}
+
+// dockerHubConfigKey is the key for Docker Hub in RegistriesConfig.Registries
+const dockerHubConfigKey = "docker.io"
+
+// mirrorMaxRetries is the number of retries for requests to a mirror; we would rather fall back quickly
+const mirrorMaxRetries = 1
+
+// NewMirrors returns the mirrors configured for the registry host, in the order they should be tried.
+// An empty host means Docker Hub.  Mirrors retry less than other registries, so that we fall back quickly.
+func (c *RegistriesConfig) NewMirrors(host string) ([]*Registry, error) {
+	key := registryHost(host)
+	if isDockerHub(host) {
+		key = dockerHubConfigKey
+	}
+
+	config := c.Registries[key]
+	if config == nil {
+		return nil, nil
+	}
+
+	var mirrors []*Registry
+	for _, mirror := range config.Mirrors {
+		if isDockerHub(mirror) {
+			return nil, fmt.Errorf("mirror %q for %s is docker hub", mirror, key)
+		}
+		registry, err := c.NewRegistry(strings.TrimSuffix(mirror, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("error configuring mirror %q for %s: %v", mirror, key, err)
+		}
+		registry.MaxRetries = mirrorMaxRetries
+		mirrors = append(mirrors, registry)
+	}
+	return mirrors, nil
+}
@@ -0,0 +1,291 @@
+package docker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert generates a self-signed certificate and key, writing them as PEM files
+func writeSelfSignedCert(t *testing.T, certFile string, keyFile string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("error parsing certificate: %v", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("error serializing key: %v", err)
+	}
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatalf("error writing certificate: %v", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("error writing key: %v", err)
+	}
+	return cert
+}
+
+// writeServerCA writes the certificate of a httptest TLS server as a PEM file
+func writeServerCA(t *testing.T, server *httptest.Server, p string) {
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(p, data, 0644); err != nil {
+		t.Fatalf("error writing CA file: %v", err)
+	}
+}
+
+func v2Handler(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/v2/" {
+		w.WriteHeader(404)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+func TestRegistriesConfigForHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs.d")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	hostDir := filepath.Join(dir, "registry.example.com:5000")
+	if err := os.MkdirAll(hostDir, 0755); err != nil {
+		t.Fatalf("error creating dir: %v", err)
+	}
+	for _, name := range []string{"ca.crt", "client.cert", "client.key", "README"} {
+		if err := ioutil.WriteFile(filepath.Join(hostDir, name), []byte{}, 0644); err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+	}
+
+	config := &RegistriesConfig{
+		Registries: map[string]*RegistryConfig{
+			"registry.example.com:5000": {CAFiles: []string{"/etc/ssl/internal.pem"}},
+			"localhost:5000":            {PlainHTTP: true},
+		},
+		CertsDirs: []string{dir},
+	}
+
+	actual, err := config.ForHost("registry.example.com:5000")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &RegistryConfig{
+		CAFiles:  []string{"/etc/ssl/internal.pem", filepath.Join(hostDir, "ca.crt")},
+		CertFile: filepath.Join(hostDir, "client.cert"),
+		KeyFile:  filepath.Join(hostDir, "client.key"),
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected config: actual=%+v expected=%+v", actual, expected)
+	}
+
+	// Merging must not modify the explicit configuration
+	if len(config.Registries["registry.example.com:5000"].CAFiles) != 1 {
+		t.Errorf("explicit configuration was modified")
+	}
+
+	// A client certificate without a key is an error
+	if err := os.Remove(filepath.Join(hostDir, "client.key")); err != nil {
+		t.Fatalf("error removing key: %v", err)
+	}
+	if _, err := config.ForHost("registry.example.com:5000"); err == nil {
+		t.Errorf("expected error for client certificate without key")
+	}
+
+	registry, err := config.NewRegistry("https://localhost:5000")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if registry.URL != "http://localhost:5000" {
+		t.Errorf("expected plain http registry, got %q", registry.URL)
+	}
+	if registry.HttpClient != nil {
+		t.Errorf("expected default http client for plain http registry")
+	}
+
+	registry, err = config.NewRegistry("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if registry.URL != "" {
+		t.Errorf("expected docker hub for empty host, got %q", registry.URL)
+	}
+}
+
+func TestRegistryPrivateCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(v2Handler))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "certs.d")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	// Without the CA, we don't trust the registry
+	config := &RegistriesConfig{CertsDirs: []string{dir}}
+	registry, err := config.NewRegistry(host)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := registry.CheckAuthentication(&Auth{}); err == nil {
+		t.Errorf("expected certificate error without CA")
+	}
+
+	// With the CA in certs.d, we do
+	if err := os.MkdirAll(filepath.Join(dir, host), 0755); err != nil {
+		t.Fatalf("error creating dir: %v", err)
+	}
+	writeServerCA(t, server, filepath.Join(dir, host, "ca.crt"))
+	registry, err = config.NewRegistry(host)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := registry.CheckAuthentication(&Auth{}); err != nil {
+		t.Errorf("unexpected error with CA: %v", err)
+	}
+
+	// Or we can skip verification
+	config = &RegistriesConfig{
+		Registries: map[string]*RegistryConfig{host: {InsecureSkipVerify: true}},
+		CertsDirs:  []string{},
+	}
+	registry, err = config.NewRegistry(host)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := registry.CheckAuthentication(&Auth{}); err != nil {
+		t.Errorf("unexpected error with insecureSkipVerify: %v", err)
+	}
+}
+
+func TestRegistryClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs.d")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(v2Handler))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "https://")
+	hostDir := filepath.Join(dir, host)
+	if err := os.MkdirAll(hostDir, 0755); err != nil {
+		t.Fatalf("error creating dir: %v", err)
+	}
+	writeServerCA(t, server, filepath.Join(hostDir, "ca.crt"))
+
+	config := &RegistriesConfig{CertsDirs: []string{dir}}
+
+	// Without a client certificate, the registry rejects us
+	registry, err := config.NewRegistry(host)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := registry.CheckAuthentication(&Auth{}); err == nil {
+		t.Errorf("expected error without client certificate")
+	}
+
+	clientCert := writeSelfSignedCert(t, filepath.Join(hostDir, "client.cert"), filepath.Join(hostDir, "client.key"))
+	pool := x509.NewCertPool()
+	pool.AddCert(clientCert)
+	server.TLS.ClientCAs = pool
+
+	registry, err = config.NewRegistry(host)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := registry.CheckAuthentication(&Auth{}); err != nil {
+		t.Errorf("unexpected error with client certificate: %v", err)
+	}
+}
+
+func TestRegistriesConfigMirrors(t *testing.T) {
+	config := &RegistriesConfig{
+		Registries: map[string]*RegistryConfig{
+			"docker.io": {
+				Mirrors: []string{"https://mirror.example.com/", "http://cache.internal:5000"},
+			},
+			"quay.io": {
+				Mirrors: []string{"plain.internal"},
+			},
+			"plain.internal": {PlainHTTP: true},
+			"bad.example.com": {
+				Mirrors: []string{"https://index.docker.io"},
+			},
+		},
+		CertsDirs: []string{},
+	}
+
+	grid := []struct {
+		Host     string
+		Expected []string
+	}{
+		{Host: "", Expected: []string{"https://mirror.example.com", "http://cache.internal:5000"}},
+		{Host: "https://registry-1.docker.io/", Expected: []string{"https://mirror.example.com", "http://cache.internal:5000"}},
+		{Host: "https://quay.io", Expected: []string{"http://plain.internal"}},
+		{Host: "https://gcr.io", Expected: nil},
+	}
+
+	for _, g := range grid {
+		mirrors, err := config.NewMirrors(g.Host)
+		if err != nil {
+			t.Errorf("unexpected error getting mirrors for %q: %v", g.Host, err)
+			continue
+		}
+		var actual []string
+		for _, mirror := range mirrors {
+			actual = append(actual, mirror.URL)
+			if mirror.MaxRetries != mirrorMaxRetries {
+				t.Errorf("mirror %s should fail fast, had MaxRetries=%d", mirror.URL, mirror.MaxRetries)
+			}
+		}
+		if !reflect.DeepEqual(actual, g.Expected) {
+			t.Errorf("unexpected mirrors for %q: actual=%v expected=%v", g.Host, actual, g.Expected)
+		}
+	}
+
+	if _, err := config.NewMirrors("https://bad.example.com"); err == nil {
+		t.Errorf("expected error for docker hub as a mirror")
+	}
+}
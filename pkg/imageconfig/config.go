@@ -1,6 +1,7 @@
 package imageconfig
 
 import (
+	"fmt"
 	"runtime"
 	"time"
 
@@ -16,6 +17,7 @@ type ImageConfig struct {
 	DockerVersion   string          `json:"docker_version"`
 	History         []History       `json:"history"`
 	OS              string          `json:"os"`
+	Variant         string          `json:"variant,omitempty"`
 	RootFS          RootFS          `json:"rootfs"`
 }
 
@@ -60,16 +62,28 @@ type AddLayer struct {
 	Description string
 }
 
-func JoinLayer(base *ImageConfig, addLayers []*AddLayer) (*ImageConfig, error) {
+// JoinLayer builds the image config for addLayers on top of base.  If platform is nil, the platform
+// is taken from base, or the host if there is no base.
+func JoinLayer(base *ImageConfig, platform *layers.Platform, addLayers []*AddLayer) (*ImageConfig, error) {
 	c := &ImageConfig{}
 	if base != nil {
 		*c = *base
-	} else {
-		// TODO: It is really easy to do a crossbuild, so "same" might be an invalid assumption
+		if platform != nil && (platform.OS != base.OS || platform.Architecture != base.Architecture) {
+			return nil, fmt.Errorf("base image is for platform %s/%s, not %s", base.OS, base.Architecture, platform)
+		}
+	} else if platform == nil {
 		c.Architecture = runtime.GOARCH
 		c.OS = runtime.GOOS
 	}
 
+	if platform != nil {
+		c.Architecture = platform.Architecture
+		c.OS = platform.OS
+		if platform.Variant != "" {
+			c.Variant = platform.Variant
+		}
+	}
+
 	now := time.Now().UTC()
 	c.Created = now.Format(time.RFC3339Nano)
 
@@ -7,21 +7,29 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
+	"kope.io/build/pkg/securepath"
+	"kope.io/build/pkg/verify"
 )
 
 var RemovedTimestamp = time.Time{}
 
 type FSLayerStore struct {
 	Path string
+
+	// mutex guards staging, the set of blobs currently being staged
+	mutex   sync.Mutex
+	staging map[string]*sync.Mutex
 }
 
 var _ Store = &FSLayerStore{}
@@ -83,18 +91,35 @@ func (s *FSLayerStore) AddBlob(repository string, digest string, r io.Reader) (B
 		return nil, fmt.Errorf("error creating blob directory %q: %v", p, err)
 	}
 
-	actualDigest, n, err := putFileWithSha(p, 0644, r)
+	// Write to a temp file and rename, so concurrent readers never see a partial blob
+	tmpfile, err := ioutil.TempFile(filepath.Dir(p), "."+digest)
 	if err != nil {
+		return nil, fmt.Errorf("error creating temp file for blob %q: %v", p, err)
+	}
+	tmpPath := tmpfile.Name()
+	tmpfile.Close()
+
+	actualDigest, n, err := putFileWithSha(tmpPath, 0644, r)
+	if err != nil {
+		os.Remove(tmpPath)
 		return nil, err
 	}
-	glog.Infof("copied blob to %q", p)
 	if digest != actualDigest {
-		err := os.Remove(p)
+		err := os.Remove(tmpPath)
 		if err != nil {
-			glog.Warningf("error removing blob with bad digest %q: %v", p, err)
+			glog.Warningf("error removing blob with bad digest %q: %v", tmpPath, err)
 		}
-		glog.Fatalf("digest does not match: %q vs %q", digest, actualDigest)
+		return nil, &verify.DigestMismatchError{Expected: digest, Actual: actualDigest}
 	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("error setting permissions on %q: %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, p); err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("error moving blob into place %q: %v", p, err)
+	}
+	glog.Infof("copied blob to %q", p)
 	return &FSBlob{
 		p:          p,
 		digest:     digest,
@@ -126,6 +151,188 @@ func (s *FSLayerStore) FindBlob(repository string, digest string) (Blob, error)
 	}, nil
 }
 
+func (s *FSLayerStore) StageBlob(repository string, digest string, size int64) (StagedBlob, error) {
+	if digest == "" {
+		return nil, fmt.Errorf("digest is required")
+	}
+	p := filepath.Join(s.Path, "staging", repository, digest)
+
+	// Only one caller can stage a blob at a time; the lock is held until the staged blob is closed
+	lock := s.stagingLock(p)
+	lock.Lock()
+	staged, err := s.openStagedBlob(p, repository, digest, size)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	staged.unlock = lock.Unlock
+	return staged, nil
+}
+
+// stagingLock returns the mutex for the staged blob at path p
+func (s *FSLayerStore) stagingLock(p string) *sync.Mutex {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.staging == nil {
+		s.staging = make(map[string]*sync.Mutex)
+	}
+	lock := s.staging[p]
+	if lock == nil {
+		lock = &sync.Mutex{}
+		s.staging[p] = lock
+	}
+	return lock
+}
+
+func (s *FSLayerStore) openStagedBlob(p string, repository string, digest string, size int64) (*fsStagedBlob, error) {
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating staging directory %q: %v", p, err)
+	}
+
+	// Hash whatever we already have, so we can keep verifying as we append
+	hasher := sha256.New()
+	written, err := hashExisting(p, hasher)
+	if err != nil {
+		return nil, err
+	}
+	if size > 0 && written > size {
+		glog.Warningf("discarding staged blob %q, which is larger than expected", p)
+		if err := os.Remove(p); err != nil {
+			return nil, fmt.Errorf("error removing staged blob %q: %v", p, err)
+		}
+		hasher.Reset()
+		written = 0
+	}
+
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening staged blob %q: %v", p, err)
+	}
+
+	return &fsStagedBlob{
+		store:      s,
+		p:          p,
+		f:          f,
+		hasher:     hasher,
+		digest:     digest,
+		size:       size,
+		written:    written,
+		repository: repository,
+	}, nil
+}
+
+// hashExisting feeds the contents of the file (if it exists) into the hasher, returning the length
+func hashExisting(p string, hasher io.Writer) (int64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("error opening staged blob %q: %v", p, err)
+	}
+	defer f.Close()
+
+	n, err := io.Copy(hasher, f)
+	if err != nil {
+		return 0, fmt.Errorf("error reading staged blob %q: %v", p, err)
+	}
+	return n, nil
+}
+
+// fsStagedBlob computes the digest as data is written, so we don't need to re-read the blob to verify it
+type fsStagedBlob struct {
+	store      *FSLayerStore
+	p          string
+	f          *os.File
+	hasher     hash.Hash
+	digest     string
+	size       int64
+	written    int64
+	repository string
+
+	// unlock releases the staging lock
+	unlock func()
+}
+
+var _ StagedBlob = &fsStagedBlob{}
+
+func (b *fsStagedBlob) Write(data []byte) (int, error) {
+	if b.size > 0 && b.written+int64(len(data)) > b.size {
+		return 0, &verify.SizeMismatchError{Expected: b.size, Actual: b.written + int64(len(data))}
+	}
+	n, err := b.f.Write(data)
+	b.hasher.Write(data[:n])
+	b.written += int64(n)
+	return n, err
+}
+
+func (b *fsStagedBlob) Size() int64 {
+	return b.written
+}
+
+func (b *fsStagedBlob) Close() error {
+	err := b.closeFile()
+	if b.unlock != nil {
+		b.unlock()
+		b.unlock = nil
+	}
+	return err
+}
+
+func (b *fsStagedBlob) closeFile() error {
+	if b.f == nil {
+		return nil
+	}
+	err := b.f.Close()
+	b.f = nil
+	if err != nil {
+		return fmt.Errorf("error closing staged blob %q: %v", b.p, err)
+	}
+	return nil
+}
+
+func (b *fsStagedBlob) Commit() (Blob, error) {
+	// We keep the staging lock until the blob is in place, so nobody else starts staging it
+	defer b.Close()
+
+	if err := b.closeFile(); err != nil {
+		return nil, err
+	}
+
+	var verifyErr error
+	actualDigest := "sha256:" + hex.EncodeToString(b.hasher.Sum(nil))
+	if b.size > 0 && b.written != b.size {
+		verifyErr = &verify.SizeMismatchError{Expected: b.size, Actual: b.written}
+	} else if actualDigest != b.digest {
+		verifyErr = &verify.DigestMismatchError{Expected: b.digest, Actual: actualDigest}
+	}
+	if verifyErr != nil {
+		// The staged data is corrupt (or for a different blob); start again next time
+		if err := os.Remove(b.p); err != nil {
+			glog.Warningf("error removing staged blob %q: %v", b.p, err)
+		}
+		return nil, verifyErr
+	}
+
+	p := filepath.Join(b.store.Path, "blob", b.repository, b.digest)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, fmt.Errorf("error creating blob directory %q: %v", p, err)
+	}
+	if err := os.Rename(b.p, p); err != nil {
+		return nil, fmt.Errorf("error moving staged blob %q to %q: %v", b.p, p, err)
+	}
+	glog.Infof("moved staged blob to %q", p)
+
+	return &FSBlob{
+		p:          p,
+		digest:     b.digest,
+		length:     b.written,
+		repository: b.repository,
+	}, nil
+}
+
 type FSBlob struct {
 	store      *FSLayerStore
 	p          string
@@ -146,16 +353,86 @@ func (b *FSBlob) Open() (io.ReadCloser, error) {
 	return os.Open(b.p)
 }
 
-func (s *FSLayerStore) WriteImageManifest(repository string, tag string, manifest *ImageManifest) error {
-	p := filepath.Join(s.Path, "image", repository, tag)
+func (s *FSLayerStore) WriteImageManifest(repository string, reference string, manifest *ImageManifest) error {
+	manifest.Repository = repository
+	if IsDigest(reference) {
+		if manifest.Digest == "" {
+			manifest.Digest = reference
+		}
+	} else {
+		manifest.Tag = reference
+	}
+
+	return s.writeImageRecord(repository, reference, manifest)
+}
+
+func (s *FSLayerStore) WritePlatformManifest(repository string, reference string, listDigest string, manifest *ImageManifest) error {
+	if manifest.Platform == nil {
+		return fmt.Errorf("platform is required for an image in a manifest list")
+	}
+	manifest.Repository = repository
+	if !IsDigest(reference) {
+		manifest.Tag = reference
+	}
+
+	index, err := s.readImageRecord(repository, reference)
+	if err != nil {
+		return err
+	}
+	if index == nil || index.Digest != listDigest || len(index.Manifests) == 0 {
+		// The reference now points to a different image; the images we had for other platforms are stale
+		index = &ImageManifest{}
+	}
+	index.Repository = repository
+	index.Tag = manifest.Tag
+	index.Digest = listDigest
+
+	replaced := false
+	for i, m := range index.Manifests {
+		if m.Platform != nil && *m.Platform == *manifest.Platform {
+			index.Manifests[i] = manifest
+			replaced = true
+		}
+	}
+	if !replaced {
+		index.Manifests = append(index.Manifests, manifest)
+	}
+
+	return s.writeImageRecord(repository, reference, index)
+}
+
+func (s *FSLayerStore) FindImageManifest(repository string, reference string, platform *Platform) (*ImageManifest, error) {
+	meta, err := s.readImageRecord(repository, reference)
+	if err != nil || meta == nil || len(meta.Manifests) == 0 {
+		return meta, err
+	}
+
+	if platform == nil {
+		if len(meta.Manifests) == 1 {
+			return meta.Manifests[0], nil
+		}
+		var platforms []string
+		for _, m := range meta.Manifests {
+			platforms = append(platforms, m.Platform.String())
+		}
+		return nil, fmt.Errorf("image %s:%s has been fetched for several platforms (%s); the platform must be specified", repository, reference, strings.Join(platforms, ", "))
+	}
+
+	for _, m := range meta.Manifests {
+		if m.Platform != nil && m.Platform.Matches(platform) {
+			return m, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *FSLayerStore) writeImageRecord(repository string, reference string, manifest *ImageManifest) error {
+	p := filepath.Join(s.Path, "image", repository, reference)
 	err := os.MkdirAll(filepath.Dir(p), 0755)
 	if err != nil {
 		return fmt.Errorf("error creating manifest directory %q: %v", p, err)
 	}
 
-	manifest.Repository = repository
-	manifest.Tag = tag
-
 	dataJson, err := json.MarshalIndent(manifest, "", "  ")
 	if err != nil {
 		return fmt.Errorf("error serializing data: %v", err)
@@ -169,8 +446,8 @@ func (s *FSLayerStore) WriteImageManifest(repository string, tag string, manifes
 	return nil
 }
 
-func (s *FSLayerStore) FindImageManifest(repository string, tag string) (*ImageManifest, error) {
-	p := filepath.Join(s.Path, "image", repository, tag)
+func (s *FSLayerStore) readImageRecord(repository string, reference string) (*ImageManifest, error) {
+	p := filepath.Join(s.Path, "image", repository, reference)
 
 	glog.V(4).Infof("reading image manifest %q", p)
 
@@ -202,11 +479,21 @@ func (l *fsLayer) Name() string {
 }
 
 func (l *fsLayer) PutFile(dest string, stat os.FileInfo, in io.Reader) (int64, error) {
-	dest = strings.TrimPrefix(dest, "/")
-	// TODO: Sanitize to remove .. etc
-	dest = filepath.Join(l.path, "rootfs", dest)
+	if err := checkNotWhiteout(dest); err != nil {
+		return 0, err
+	}
+	p, err := securepath.Resolve(filepath.Join(l.path, "rootfs"), dest)
+	if err != nil {
+		return 0, fmt.Errorf("cannot write %q to layer %s: %v", dest, l.name, err)
+	}
 
-	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err := l.clearWhiteouts(dest); err != nil {
+		return 0, err
+	}
+
+	dest = p
+
+	err = os.MkdirAll(filepath.Dir(dest), 0755)
 	if err != nil {
 		return 0, fmt.Errorf("failed to mkdirs for %q: %v", dest, err)
 	}
@@ -234,11 +521,22 @@ func (l *fsLayer) PutFile(dest string, stat os.FileInfo, in io.Reader) (int64, e
 }
 
 func (l *fsLayer) PutSymlink(dest string, stat os.FileInfo, target string) error {
-	dest = strings.TrimPrefix(dest, "/")
-	// TODO: Sanitize to remove .. etc
-	dest = filepath.Join(l.path, "rootfs", dest)
+	if err := checkNotWhiteout(dest); err != nil {
+		return err
+	}
+	// We replace dest if it is already a symlink, rather than following it
+	p, err := securepath.ResolveParent(filepath.Join(l.path, "rootfs"), dest)
+	if err != nil {
+		return fmt.Errorf("cannot write %q to layer %s: %v", dest, l.name, err)
+	}
+
+	if err := l.clearWhiteouts(dest); err != nil {
+		return err
+	}
 
-	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	dest = p
+
+	err = os.MkdirAll(filepath.Dir(dest), 0755)
 	if err != nil {
 		return fmt.Errorf("failed to mkdirs for %q: %v", dest, err)
 	}
@@ -301,6 +599,14 @@ func putFileWithSha(dest string, mode os.FileMode, in io.Reader) (hash string, n
 
 type layerMetadata struct {
 	Options Options `json:"options"`
+
+	// Whiteouts are the paths deleted from the layers below, e.g. /etc/motd
+	Whiteouts []string `json:"whiteouts,omitempty"`
+	// OpaqueDirs are the directories whose contents in the layers below are hidden
+	OpaqueDirs []string `json:"opaqueDirs,omitempty"`
+
+	// Owners are the owners of paths in the layer, e.g. /app; anything not listed is owned by root:root
+	Owners map[string]Owner `json:"owners,omitempty"`
 }
 
 func (f *fsLayer) SetOptions(options Options) error {
@@ -397,8 +703,18 @@ func (l *fsLayer) BuildTar(store Store, repository string) (Blob, string, error)
 		}
 	}()
 
+	// Whiteouts go first, so that they can never hide content from this layer
+	meta, err := l.readMetadata()
+	if err != nil {
+		return nil, "", err
+	}
+	err = writeWhiteoutsToTar(w, meta)
+	if err != nil {
+		return nil, "", fmt.Errorf("error building tar: %v", err)
+	}
+
 	rootfs := filepath.Join(l.path, "rootfs")
-	err = copyDirToTar(w, "", nil, rootfs)
+	err = copyDirToTar(w, "", nil, rootfs, meta.Owners)
 	if err != nil {
 		return nil, "", fmt.Errorf("error building tar: %v", err)
 	}
@@ -439,13 +755,14 @@ func (l *fsLayer) BuildTar(store Store, repository string) (Blob, string, error)
 
 }
 
-func copyDirToTar(w *tar.Writer, tarPrefix string, f os.FileInfo, srcDir string) error {
+func copyDirToTar(w *tar.Writer, tarPrefix string, f os.FileInfo, srcDir string, owners map[string]Owner) error {
 	if tarPrefix != "" {
 		hdr, err := tar.FileInfoHeader(f, "")
 		if err != nil {
 			return fmt.Errorf("error build tar entry: %v", err)
 		}
 		hdr.Name = tarPrefix
+		applyOwner(hdr, owners)
 
 		// TODO: Provide option to preserve timestamps?
 		hdr.ModTime = RemovedTimestamp
@@ -470,7 +787,7 @@ func copyDirToTar(w *tar.Writer, tarPrefix string, f os.FileInfo, srcDir string)
 
 	for _, f := range files {
 		if f.IsDir() {
-			err = copyDirToTar(w, tarPrefix+f.Name()+"/", f, filepath.Join(srcDir, f.Name()))
+			err = copyDirToTar(w, tarPrefix+f.Name()+"/", f, filepath.Join(srcDir, f.Name()), owners)
 			if err != nil {
 				return err
 
@@ -479,7 +796,7 @@ func copyDirToTar(w *tar.Writer, tarPrefix string, f os.FileInfo, srcDir string)
 		}
 
 		if f.Mode()&os.ModeSymlink == os.ModeSymlink {
-			err = copySymlinkToTar(w, tarPrefix, f, srcDir)
+			err = copySymlinkToTar(w, tarPrefix, f, srcDir, owners)
 			if err != nil {
 				return err
 			}
@@ -487,7 +804,7 @@ func copyDirToTar(w *tar.Writer, tarPrefix string, f os.FileInfo, srcDir string)
 			continue
 		}
 
-		err = copyFileToTar(w, tarPrefix, f, srcDir)
+		err = copyFileToTar(w, tarPrefix, f, srcDir, owners)
 		if err != nil {
 			return err
 		}
@@ -496,12 +813,13 @@ func copyDirToTar(w *tar.Writer, tarPrefix string, f os.FileInfo, srcDir string)
 	return nil
 }
 
-func copyFileToTar(w *tar.Writer, tarPrefix string, f os.FileInfo, srcDir string) error {
+func copyFileToTar(w *tar.Writer, tarPrefix string, f os.FileInfo, srcDir string, owners map[string]Owner) error {
 	hdr, err := tar.FileInfoHeader(f, "")
 	if err != nil {
 		return fmt.Errorf("error build tar entry: %v", err)
 	}
 	hdr.Name = path.Join(tarPrefix, f.Name())
+	applyOwner(hdr, owners)
 
 	// TODO: Provide option to preserve timestamps?
 	hdr.ModTime = RemovedTimestamp
@@ -528,12 +846,13 @@ func copyFileToTar(w *tar.Writer, tarPrefix string, f os.FileInfo, srcDir string
 	return nil
 }
 
-func copySymlinkToTar(w *tar.Writer, tarPrefix string, f os.FileInfo, srcDir string) error {
+func copySymlinkToTar(w *tar.Writer, tarPrefix string, f os.FileInfo, srcDir string, owners map[string]Owner) error {
 	hdr, err := tar.FileInfoHeader(f, "")
 	if err != nil {
 		return fmt.Errorf("error build tar entry: %v", err)
 	}
 	hdr.Name = path.Join(tarPrefix, f.Name())
+	applyOwner(hdr, owners)
 
 	// TODO: Provide option to preserve timestamps?
 	hdr.ModTime = RemovedTimestamp
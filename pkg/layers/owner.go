@@ -0,0 +1,125 @@
+package layers
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"kope.io/build/pkg/securepath"
+)
+
+// Owner is the ownership of a file in the image.  The zero value is root:root.
+type Owner struct {
+	Uid   int    `json:"uid"`
+	Gid   int    `json:"gid"`
+	Uname string `json:"uname,omitempty"`
+	Gname string `json:"gname,omitempty"`
+}
+
+// ParseOwner parses uid:gid, e.g. 1000:1000.  As with docker's --chown, a uid on its own is also used as the gid.
+// We don't have the image's /etc/passwd, so users and groups must be numeric.
+func ParseOwner(s string) (Owner, error) {
+	var owner Owner
+
+	tokens := strings.SplitN(s, ":", 2)
+	uid, err := strconv.Atoi(tokens[0])
+	if err != nil || uid < 0 {
+		return owner, fmt.Errorf("invalid owner %q - expected numeric uid:gid", s)
+	}
+	gid := uid
+	if len(tokens) == 2 {
+		gid, err = strconv.Atoi(tokens[1])
+		if err != nil || gid < 0 {
+			return owner, fmt.Errorf("invalid owner %q - expected numeric uid:gid", s)
+		}
+	}
+
+	owner.Uid = uid
+	owner.Gid = gid
+	if uid == 0 {
+		owner.Uname = "root"
+	}
+	if gid == 0 {
+		owner.Gname = "root"
+	}
+	return owner, nil
+}
+
+func (o Owner) String() string {
+	return fmt.Sprintf("%d:%d", o.Uid, o.Gid)
+}
+
+// applyOwner sets the ownership on a tar entry, ignoring whoever owns the file on the build machine
+func applyOwner(hdr *tar.Header, owners map[string]Owner) {
+	owner, found := owners["/"+strings.TrimSuffix(hdr.Name, "/")]
+	if !found {
+		owner = Owner{Uname: "root", Gname: "root"}
+	}
+
+	hdr.Uid = owner.Uid
+	hdr.Gid = owner.Gid
+	hdr.Uname = owner.Uname
+	hdr.Gname = owner.Gname
+}
+
+func (l *fsLayer) Chown(dests []string, owner Owner, recursive bool) error {
+	rootfs := filepath.Join(l.path, "rootfs")
+
+	meta, err := l.readMetadata()
+	if err != nil {
+		return err
+	}
+	if meta.Owners == nil {
+		meta.Owners = make(map[string]Owner)
+	}
+
+	setOwner := func(local string) error {
+		rel, err := filepath.Rel(rootfs, local)
+		if err != nil {
+			return fmt.Errorf("error finding path of %q in layer: %v", local, err)
+		}
+		meta.Owners["/"+filepath.ToSlash(rel)] = owner
+		return nil
+	}
+
+	for _, dest := range dests {
+		// As with chown -h, a symlink itself is changed, not its target
+		local, err := securepath.ResolveParent(rootfs, dest)
+		if err != nil {
+			return fmt.Errorf("cannot chown %q in layer %s: %v", dest, l.name, err)
+		}
+		if local == rootfs {
+			return fmt.Errorf("cannot chown the root directory")
+		}
+
+		stat, err := os.Lstat(local)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("%s does not exist in layer %s", dest, l.name)
+			}
+			return fmt.Errorf("error reading %q: %v", local, err)
+		}
+
+		if !recursive || !stat.IsDir() {
+			if err := setOwner(local); err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = filepath.Walk(local, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return fmt.Errorf("error reading %q: %v", p, err)
+			}
+			return setOwner(p)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return l.writeMetadata(meta)
+}
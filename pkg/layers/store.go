@@ -3,6 +3,7 @@ package layers
 import (
 	"io"
 	"os"
+	"strings"
 )
 
 type Store interface {
@@ -10,11 +11,24 @@ type Store interface {
 	DeleteLayer(name string) error
 	FindLayer(name string) (Layer, error)
 
+	// AddBlob stores the blob, returning a verify.DigestMismatchError if src does not match digest
 	AddBlob(repository string, digest string, src io.Reader) (Blob, error)
 	FindBlob(repository string, digest string) (Blob, error)
 
-	WriteImageManifest(repository string, tag string, manifest *ImageManifest) error
-	FindImageManifest(repository string, tag string) (*ImageManifest, error)
+	// StageBlob opens the staging area for a blob we are downloading.  Data from an earlier,
+	// interrupted download is kept, so that the download can be resumed.
+	// If size is positive, writes beyond size fail with a verify.SizeMismatchError.
+	// If another caller is staging the same blob, StageBlob waits until they close it.
+	StageBlob(repository string, digest string, size int64) (StagedBlob, error)
+
+	// WriteImageManifest records the image under reference, which is either a tag or a digest
+	WriteImageManifest(repository string, reference string, manifest *ImageManifest) error
+	// WritePlatformManifest records the image under reference as the entry for its platform in the manifest list listDigest.
+	// Images we already have for other platforms of the same list are kept.
+	WritePlatformManifest(repository string, reference string, listDigest string, manifest *ImageManifest) error
+	// FindImageManifest finds the image by reference, which is either a tag or a digest.
+	// If reference is a manifest list, it returns the image for platform, which can be nil if we only have one platform.
+	FindImageManifest(repository string, reference string, platform *Platform) (*ImageManifest, error)
 }
 
 type Layer interface {
@@ -23,6 +37,16 @@ type Layer interface {
 	PutFile(dest string, stat os.FileInfo, r io.Reader) (int64, error)
 	PutSymlink(dest string, stat os.FileInfo, target string) error
 
+	// DeletePath removes dest from the layer, and records a whiteout so that it is also removed from the layers below.
+	// Unless recursive is set, dest must not be a non-empty directory in this layer.
+	DeletePath(dest string, recursive bool) error
+	// MakeOpaque marks the directory dest as opaque, hiding whatever the layers below have in it
+	MakeOpaque(dest string) error
+
+	// Chown records the owner of each of dests in the image, rather than whoever owns them on the build machine.
+	// If recursive is set, directories are changed along with their contents.
+	Chown(dests []string, owner Owner, recursive bool) error
+
 	GetOptions() (Options, error)
 	SetOptions(options Options) error
 
@@ -36,11 +60,61 @@ type Blob interface {
 	Open() (io.ReadCloser, error)
 }
 
+// StagedBlob is a blob which is still being downloaded
+type StagedBlob interface {
+	io.Writer
+
+	// Size returns the number of bytes staged so far
+	Size() int64
+
+	// Commit verifies the size and digest of the staged data and moves it into the store.
+	// If verification fails, the staged data is discarded and a verify.SizeMismatchError or verify.DigestMismatchError is returned.
+	Commit() (Blob, error)
+
+	// Close releases the staged blob, keeping the data so the download can be resumed later
+	Close() error
+}
+
 type ImageManifest struct {
 	Repository string          `json:"repository"`
 	Tag        string          `json:"tag"`
+	Digest     string          `json:"digest,omitempty"`
+	Platform   *Platform       `json:"platform,omitempty"`
 	Config     LayerManifest   `json:"config"`
 	Layers     []LayerManifest `json:"layers"`
+
+	// Manifests are the images we have for each platform, when the reference is a manifest list.
+	// Digest is then the digest of the list, and Config and Layers are unset.
+	Manifests []*ImageManifest `json:"manifests,omitempty"`
+}
+
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// Matches returns true if an image for platform p can be used for the requested platform.
+// If the requested platform does not specify a variant, any variant matches.
+func (p *Platform) Matches(requested *Platform) bool {
+	if p.OS != requested.OS || p.Architecture != requested.Architecture {
+		return false
+	}
+	return requested.Variant == "" || p.Variant == requested.Variant
+}
+
+func (p *Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// IsDigest returns true if the reference is a digest (e.g. sha256:...) rather than a tag
+func IsDigest(reference string) bool {
+	// Tags cannot contain a colon
+	return strings.Contains(reference, ":")
 }
 
 type LayerManifest struct {
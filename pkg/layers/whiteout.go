@@ -0,0 +1,215 @@
+package layers
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"kope.io/build/pkg/securepath"
+)
+
+// Deletions are represented in layer tarballs as in the OCI image spec: an empty file .wh.<name> deletes <name>
+// from the layers below, and a file named .wh..wh..opq hides everything the layers below have in its directory.
+const (
+	WhiteoutPrefix    = ".wh."
+	WhiteoutOpaqueDir = ".wh..wh..opq"
+)
+
+// cleanWhiteoutPath normalizes a path we are deleting to an absolute path, e.g. /etc/motd
+func cleanWhiteoutPath(p string) (string, error) {
+	clean := path.Clean("/" + p)
+	if clean == "/" {
+		return "", fmt.Errorf("cannot delete the root directory")
+	}
+	if strings.HasPrefix(path.Base(clean), WhiteoutPrefix) {
+		return "", fmt.Errorf("cannot delete %q: names starting with %s are reserved for whiteouts", p, WhiteoutPrefix)
+	}
+	return clean, nil
+}
+
+// checkNotWhiteout rejects writing a file named like a whiteout, which would delete files when the layer is applied.
+// Deletions are made with DeletePath and MakeOpaque.
+func checkNotWhiteout(dest string) error {
+	if strings.HasPrefix(path.Base(path.Clean("/"+dest)), WhiteoutPrefix) {
+		return fmt.Errorf("cannot write %q: names starting with %s are reserved for whiteouts", dest, WhiteoutPrefix)
+	}
+	return nil
+}
+
+// isUnder returns true if p is dir or is inside dir
+func isUnder(p string, dir string) bool {
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// removeUnder returns the paths which are not dir or inside dir
+func removeUnder(paths []string, dir string) []string {
+	var keep []string
+	for _, p := range paths {
+		if !isUnder(p, dir) {
+			keep = append(keep, p)
+		}
+	}
+	return keep
+}
+
+func (l *fsLayer) DeletePath(dest string, recursive bool) error {
+	p, err := cleanWhiteoutPath(dest)
+	if err != nil {
+		return err
+	}
+
+	// We remove dest if it is a symlink, rather than following it
+	local, err := securepath.ResolveParent(filepath.Join(l.path, "rootfs"), p)
+	if err != nil {
+		return fmt.Errorf("cannot delete %q from layer %s: %v", dest, l.name, err)
+	}
+	stat, err := os.Lstat(local)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("error reading %q: %v", local, err)
+		}
+	} else {
+		if stat.IsDir() && !recursive {
+			files, err := ioutil.ReadDir(local)
+			if err != nil {
+				return fmt.Errorf("error reading directory %q: %v", local, err)
+			}
+			if len(files) != 0 {
+				return fmt.Errorf("%s is a non-empty directory in layer %s; delete it recursively", p, l.name)
+			}
+		}
+		if err := os.RemoveAll(local); err != nil {
+			return fmt.Errorf("error removing %q: %v", local, err)
+		}
+	}
+
+	meta, err := l.readMetadata()
+	if err != nil {
+		return err
+	}
+
+	// Anything we recorded inside p is superseded by the whiteout of p
+	meta.Whiteouts = removeUnder(meta.Whiteouts, p)
+	meta.OpaqueDirs = removeUnder(meta.OpaqueDirs, p)
+	for k := range meta.Owners {
+		if isUnder(k, p) {
+			delete(meta.Owners, k)
+		}
+	}
+	for _, w := range meta.Whiteouts {
+		if isUnder(p, w) {
+			// A parent is already deleted
+			return l.writeMetadata(meta)
+		}
+	}
+	meta.Whiteouts = append(meta.Whiteouts, p)
+	sort.Strings(meta.Whiteouts)
+
+	return l.writeMetadata(meta)
+}
+
+func (l *fsLayer) MakeOpaque(dest string) error {
+	p, err := cleanWhiteoutPath(dest)
+	if err != nil {
+		return err
+	}
+
+	// The directory must exist in this layer, so that the tarball recreates it
+	local, err := securepath.Resolve(filepath.Join(l.path, "rootfs"), p)
+	if err != nil {
+		return fmt.Errorf("cannot make %q opaque in layer %s: %v", dest, l.name, err)
+	}
+	stat, err := os.Lstat(local)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("error reading %q: %v", local, err)
+		}
+		if err := os.MkdirAll(local, 0755); err != nil {
+			return fmt.Errorf("error creating directory %q: %v", local, err)
+		}
+	} else if !stat.IsDir() {
+		return fmt.Errorf("%s is not a directory in layer %s", p, l.name)
+	}
+
+	meta, err := l.readMetadata()
+	if err != nil {
+		return err
+	}
+
+	// Deletions inside p are covered by the opaque directory
+	meta.Whiteouts = removeUnder(meta.Whiteouts, p)
+	for _, o := range meta.OpaqueDirs {
+		if o == p {
+			return l.writeMetadata(meta)
+		}
+	}
+	meta.OpaqueDirs = append(meta.OpaqueDirs, p)
+	sort.Strings(meta.OpaqueDirs)
+
+	return l.writeMetadata(meta)
+}
+
+// clearWhiteouts is called when we add dest to the layer, so that it is no longer deleted.
+// If a parent directory was deleted, it becomes an opaque directory: it exists, but only with our content.
+func (l *fsLayer) clearWhiteouts(dest string) error {
+	p := path.Clean("/" + dest)
+
+	meta, err := l.readMetadata()
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	var keep []string
+	for _, w := range meta.Whiteouts {
+		if !isUnder(p, w) {
+			keep = append(keep, w)
+			continue
+		}
+		changed = true
+		if w != p {
+			meta.OpaqueDirs = append(meta.OpaqueDirs, w)
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	meta.Whiteouts = keep
+	sort.Strings(meta.OpaqueDirs)
+	return l.writeMetadata(meta)
+}
+
+// writeWhiteoutsToTar writes the whiteout entries for the deletions recorded in the layer metadata
+func writeWhiteoutsToTar(w *tar.Writer, meta *layerMetadata) error {
+	var names []string
+	for _, p := range meta.OpaqueDirs {
+		names = append(names, path.Join(strings.TrimPrefix(p, "/"), WhiteoutOpaqueDir))
+	}
+	for _, p := range meta.Whiteouts {
+		dir, base := path.Split(strings.TrimPrefix(p, "/"))
+		names = append(names, dir+WhiteoutPrefix+base)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		hdr := &tar.Header{
+			Name:       name,
+			Typeflag:   tar.TypeReg,
+			Mode:       0644,
+			ModTime:    RemovedTimestamp,
+			AccessTime: RemovedTimestamp,
+			ChangeTime: RemovedTimestamp,
+		}
+		applyOwner(hdr, nil)
+		if err := w.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("error creating tar whiteout entry %s: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package registry
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// tokenPath is where clients get bearer tokens, when authentication is enabled
+const tokenPath = "/token"
+
+// catalogScope is the scope needed to list the repositories in the registry
+const catalogScope = "registry:catalog:*"
+
+// tokenExpiresIn is the lifetime of the tokens we issue
+const tokenExpiresIn = 5 * time.Minute
+
+// issuedToken is a bearer token we have issued, with the scopes it grants
+type issuedToken struct {
+	scopes  []string
+	expires time.Time
+}
+
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	IssuedAt    string `json:"issued_at"`
+}
+
+// serveToken issues a bearer token for the requested scopes, to clients presenting a valid username and password
+func (s *Server) serveToken(w http.ResponseWriter, req *http.Request) {
+	if s.Users == nil {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "method not allowed")
+		return
+	}
+
+	username, password, ok := req.BasicAuth()
+	expected, found := s.Users[username]
+	if !ok || !found || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "invalid username or password")
+		return
+	}
+
+	// A token request can carry several scope parameters, each of which can be space separated
+	var scopes []string
+	for _, scope := range req.URL.Query()["scope"] {
+		scopes = append(scopes, strings.Fields(scope)...)
+	}
+
+	token, err := randomHex(32)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	now := time.Now()
+	s.mutex.Lock()
+	if s.tokens == nil {
+		s.tokens = make(map[string]*issuedToken)
+	}
+	for k, t := range s.tokens {
+		if now.After(t.expires) {
+			delete(s.tokens, k)
+		}
+	}
+	s.tokens[token] = &issuedToken{scopes: scopes, expires: now.Add(tokenExpiresIn)}
+	s.mutex.Unlock()
+
+	glog.V(2).Infof("issued token to %s for %v", username, scopes)
+	writeJSON(w, http.StatusOK, &tokenResponse{
+		Token:       token,
+		AccessToken: token,
+		ExpiresIn:   int(tokenExpiresIn / time.Second),
+		IssuedAt:    now.UTC().Format(time.RFC3339),
+	})
+}
+
+// authorize checks that the request has a token granting scope, writing a challenge if not.
+// An empty scope only requires a valid token.  Everything is allowed if authentication is not enabled.
+func (s *Server) authorize(w http.ResponseWriter, req *http.Request, scope string) bool {
+	if s.isAuthorized(req, scope) {
+		return true
+	}
+
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	challenge := `Bearer realm="` + scheme + "://" + req.Host + tokenPath + `",service="` + req.Host + `"`
+	if scope != "" {
+		challenge += `,scope="` + scope + `"`
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+	return false
+}
+
+// isAuthorized returns true if authentication is disabled, or the request has a token granting scope
+func (s *Server) isAuthorized(req *http.Request, scope string) bool {
+	if s.Users == nil {
+		return true
+	}
+
+	authorization := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+
+	s.mutex.Lock()
+	token := s.tokens[strings.TrimPrefix(authorization, "Bearer ")]
+	s.mutex.Unlock()
+
+	if token == nil || time.Now().After(token.expires) {
+		return false
+	}
+	if scope == "" {
+		return true
+	}
+
+	required := parseScope(scope)
+	if required == nil {
+		return false
+	}
+	for _, action := range required.actions {
+		if !token.grants(required.resource, action) {
+			return false
+		}
+	}
+	return true
+}
+
+// grants returns true if the token grants the action on the resource
+func (t *issuedToken) grants(resource string, action string) bool {
+	for _, s := range t.scopes {
+		granted := parseScope(s)
+		if granted == nil || granted.resource != resource {
+			continue
+		}
+		for _, a := range granted.actions {
+			if a == action || a == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type parsedScope struct {
+	// resource is the type and name, e.g. repository:team/app
+	resource string
+	actions  []string
+}
+
+// parseScope parses a scope of the form type:name:actions, e.g. repository:team/app:pull,push
+func parseScope(s string) *parsedScope {
+	i := strings.LastIndex(s, ":")
+	if i == -1 || !strings.Contains(s[:i], ":") {
+		return nil
+	}
+	return &parsedScope{
+		resource: s[:i],
+		actions:  strings.Split(s[i+1:], ","),
+	}
+}
@@ -0,0 +1,325 @@
+package registry
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"kope.io/build/pkg/docker"
+	"kope.io/build/pkg/verify"
+)
+
+func (s *Server) serveBlob(w http.ResponseWriter, req *http.Request, repository string, digest string) {
+	if err := docker.ValidateDigest(digest); err != nil {
+		writeError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+
+	switch req.Method {
+	case "GET", "HEAD":
+		blob, err := s.Store.FindBlob(repository, digest)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		if blob == nil {
+			writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry: "+digest)
+			return
+		}
+
+		in, err := blob.Open()
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		defer in.Close()
+
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Header().Set("Content-Type", "application/octet-stream")
+
+		// ServeContent handles HEAD and Range requests, which clients use to resume downloads
+		if seeker, ok := in.(io.ReadSeeker); ok {
+			http.ServeContent(w, req, "", time.Time{}, seeker)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(blob.Length(), 10))
+		w.WriteHeader(http.StatusOK)
+		if req.Method == "GET" {
+			if _, err := io.Copy(w, in); err != nil {
+				glog.Warningf("error sending blob %s: %v", digest, err)
+			}
+		}
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "blobs cannot be deleted from this registry")
+	}
+}
+
+// uuidRegexp matches the upload ids we issue, so that an id can't escape the uploads directory
+var uuidRegexp = regexp.MustCompile(`^[a-f0-9]{32}$`)
+
+func (s *Server) serveUpload(w http.ResponseWriter, req *http.Request, repository string, uuid string) {
+	if uuid == "" {
+		if req.Method != "POST" {
+			writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "method not allowed")
+			return
+		}
+		s.startUpload(w, req, repository)
+		return
+	}
+
+	if !uuidRegexp.MatchString(uuid) {
+		writeError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry: "+uuid)
+		return
+	}
+	p := s.uploadPath(uuid)
+	stat, err := os.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry: "+uuid)
+			return
+		}
+		writeInternalError(w, err)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		writeUploadStatus(w, repository, uuid, stat.Size(), http.StatusNoContent)
+
+	case "PATCH":
+		size, err := appendToUpload(p, stat.Size(), req)
+		if err != nil {
+			if rangeErr, ok := err.(*rangeError); ok {
+				w.Header().Set("Range", uploadRange(stat.Size()))
+				writeError(w, http.StatusRequestedRangeNotSatisfiable, "BLOB_UPLOAD_INVALID", rangeErr.Error())
+				return
+			}
+			writeInternalError(w, err)
+			return
+		}
+		writeUploadStatus(w, repository, uuid, size, http.StatusAccepted)
+
+	case "PUT":
+		if _, err := appendToUpload(p, stat.Size(), req); err != nil {
+			if _, ok := err.(*rangeError); ok {
+				writeError(w, http.StatusRequestedRangeNotSatisfiable, "BLOB_UPLOAD_INVALID", err.Error())
+				return
+			}
+			writeInternalError(w, err)
+			return
+		}
+		s.completeUpload(w, req, repository, uuid)
+
+	case "DELETE":
+		if err := os.Remove(p); err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "method not allowed")
+	}
+}
+
+// startUpload handles the POST which begins an upload.  It supports cross-repository mounts (mount and from),
+// and monolithic uploads (digest, with the blob as the body).
+func (s *Server) startUpload(w http.ResponseWriter, req *http.Request, repository string) {
+	query := req.URL.Query()
+
+	if mount := query.Get("mount"); mount != "" {
+		mounted, err := s.mountBlob(req, repository, mount, query.Get("from"))
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		if mounted {
+			writeBlobCreated(w, repository, mount)
+			return
+		}
+		// Otherwise we fall through to a regular upload, as the spec requires
+	}
+
+	if digest := query.Get("digest"); digest != "" {
+		s.addBlob(w, repository, digest, req.Body)
+		return
+	}
+
+	uuid, err := randomHex(16)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	p := s.uploadPath(uuid)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		writeInternalError(w, fmt.Errorf("error creating uploads directory: %v", err))
+		return
+	}
+	if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+		writeInternalError(w, fmt.Errorf("error creating upload %q: %v", p, err))
+		return
+	}
+
+	writeUploadStatus(w, repository, uuid, 0, http.StatusAccepted)
+}
+
+// mountBlob copies the blob from another repository, if it exists there and the client can read it
+func (s *Server) mountBlob(req *http.Request, repository string, digest string, from string) (bool, error) {
+	if docker.ValidateDigest(digest) != nil || docker.ValidateRepository(from) != nil {
+		return false, nil
+	}
+	if !s.isAuthorized(req, "repository:"+from+":pull") {
+		glog.V(2).Infof("not mounting %s from %s: not authorized", digest, from)
+		return false, nil
+	}
+
+	blob, err := s.Store.FindBlob(from, digest)
+	if err != nil || blob == nil {
+		return false, err
+	}
+
+	in, err := blob.Open()
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+
+	if _, err := s.Store.AddBlob(repository, digest, in); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// completeUpload moves a finished upload into the store, after verifying its digest
+func (s *Server) completeUpload(w http.ResponseWriter, req *http.Request, repository string, uuid string) {
+	p := s.uploadPath(uuid)
+	defer func() {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			glog.Warningf("error removing upload %q: %v", p, err)
+		}
+	}()
+
+	f, err := os.Open(p)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	defer f.Close()
+
+	s.addBlob(w, repository, req.URL.Query().Get("digest"), f)
+}
+
+// addBlob stores the blob, responding with 201 Created, or with an error if the digest does not match
+func (s *Server) addBlob(w http.ResponseWriter, repository string, digest string, r io.Reader) {
+	if err := docker.ValidateDigest(digest); err != nil {
+		writeError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+
+	if _, err := s.Store.AddBlob(repository, digest, r); err != nil {
+		if verify.IsDigestMismatch(err) {
+			writeError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+			return
+		}
+		writeInternalError(w, err)
+		return
+	}
+
+	writeBlobCreated(w, repository, digest)
+}
+
+func writeBlobCreated(w http.ResponseWriter, repository string, digest string) {
+	w.Header().Set("Location", "/v2/"+repository+"/blobs/"+digest)
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func writeUploadStatus(w http.ResponseWriter, repository string, uuid string, size int64, status int) {
+	w.Header().Set("Location", "/v2/"+repository+"/blobs/uploads/"+uuid)
+	w.Header().Set("Range", uploadRange(size))
+	w.Header().Set("Docker-Upload-UUID", uuid)
+	if status != http.StatusNoContent {
+		w.Header().Set("Content-Length", "0")
+	}
+	w.WriteHeader(status)
+}
+
+// uploadRange is the Range header reporting the bytes received; like docker distribution, we report an
+// empty upload as 0-0
+func uploadRange(size int64) string {
+	end := size - 1
+	if end < 0 {
+		end = 0
+	}
+	return fmt.Sprintf("0-%d", end)
+}
+
+// rangeError is returned when a chunk has an invalid Content-Range, or does not start where the upload ends
+type rangeError struct {
+	message string
+}
+
+func (e *rangeError) Error() string {
+	return e.message
+}
+
+// appendToUpload appends the request body to the upload at p, which currently has size bytes.
+// If the request has a Content-Range, the chunk must start at the end of the upload.
+func appendToUpload(p string, size int64, req *http.Request) (int64, error) {
+	if contentRange := req.Header.Get("Content-Range"); contentRange != "" {
+		start, err := parseChunkStart(contentRange)
+		if err != nil {
+			return 0, err
+		}
+		if start != size {
+			return 0, &rangeError{message: fmt.Sprintf("chunk starts at offset %d, but upload has %d bytes", start, size)}
+		}
+	}
+
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("error opening upload %q: %v", p, err)
+	}
+
+	n, err := io.Copy(f, req.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error writing upload %q: %v", p, err)
+	}
+	return size + n, nil
+}
+
+// parseChunkStart parses the start offset of a Content-Range header on a chunk, of the form <start>-<end>
+func parseChunkStart(s string) (int64, error) {
+	tokens := strings.SplitN(strings.TrimPrefix(s, "bytes "), "-", 2)
+	if len(tokens) != 2 {
+		return 0, &rangeError{message: fmt.Sprintf("cannot parse Content-Range %q", s)}
+	}
+	start, err := strconv.ParseInt(tokens[0], 10, 64)
+	if err != nil || start < 0 {
+		return 0, &rangeError{message: fmt.Sprintf("cannot parse Content-Range %q", s)}
+	}
+	return start, nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating random id: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
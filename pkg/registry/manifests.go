@@ -0,0 +1,230 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"kope.io/build/pkg/docker"
+	"kope.io/build/pkg/layers"
+)
+
+// maxManifestSize is the largest manifest we accept, matching docker distribution
+const maxManifestSize = 4 * 1024 * 1024
+
+func (s *Server) serveManifest(w http.ResponseWriter, req *http.Request, repository string, reference string) {
+	if layers.IsDigest(reference) {
+		if err := docker.ValidateDigest(reference); err != nil {
+			writeError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+			return
+		}
+	} else if err := docker.ValidateTag(reference); err != nil {
+		writeError(w, http.StatusBadRequest, "TAG_INVALID", err.Error())
+		return
+	}
+
+	switch req.Method {
+	case "GET", "HEAD":
+		s.getManifest(w, req, repository, reference)
+
+	case "PUT":
+		s.putManifest(w, req, repository, reference)
+
+	case "DELETE":
+		if !s.AllowDelete {
+			writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "deletes are disabled on this registry")
+			return
+		}
+		if !layers.IsDigest(reference) {
+			writeError(w, http.StatusBadRequest, "UNSUPPORTED", "manifests can only be deleted by digest")
+			return
+		}
+		mediaType, err := s.findManifest(repository, reference)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		if mediaType == "" {
+			writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown: "+reference)
+			return
+		}
+		if err := s.deleteManifest(repository, reference); err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "method not allowed")
+	}
+}
+
+func (s *Server) getManifest(w http.ResponseWriter, req *http.Request, repository string, reference string) {
+	digest := reference
+	if !layers.IsDigest(reference) {
+		var err error
+		digest, err = s.resolveTag(repository, reference)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		if digest == "" {
+			writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown: "+reference)
+			return
+		}
+	}
+
+	mediaType, err := s.findManifest(repository, digest)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if mediaType == "" {
+		writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown: "+reference)
+		return
+	}
+
+	data, err := s.readBlob(repository, digest)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	if req.Method == "GET" {
+		w.Write(data)
+	}
+}
+
+func (s *Server) putManifest(w http.ResponseWriter, req *http.Request, repository string, reference string) {
+	data, err := ioutil.ReadAll(io.LimitReader(req.Body, maxManifestSize+1))
+	if err != nil {
+		writeInternalError(w, fmt.Errorf("error reading manifest: %v", err))
+		return
+	}
+	if len(data) > maxManifestSize {
+		writeError(w, http.StatusRequestEntityTooLarge, "MANIFEST_INVALID", "manifest is too large")
+		return
+	}
+
+	hash := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(hash[:])
+	if layers.IsDigest(reference) && reference != digest {
+		writeError(w, http.StatusBadRequest, "DIGEST_INVALID", fmt.Sprintf("manifest has digest %s, not %s", digest, reference))
+		return
+	}
+
+	manifest := &docker.ManifestV2{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		writeError(w, http.StatusBadRequest, "MANIFEST_INVALID", fmt.Sprintf("error parsing manifest: %v", err))
+		return
+	}
+	mediaType := manifest.MediaType
+	if mediaType == "" {
+		// mediaType is optional in OCI manifests
+		mediaType = strings.TrimSpace(strings.SplitN(req.Header.Get("Content-Type"), ";", 2)[0])
+	}
+	if manifest.SchemaVersion != 2 {
+		writeError(w, http.StatusBadRequest, "MANIFEST_INVALID", fmt.Sprintf("unsupported schema version %d", manifest.SchemaVersion))
+		return
+	}
+
+	// Like docker distribution, we only accept manifests whose references are already in the repository
+	switch mediaType {
+	case docker.MediaTypeDockerManifest, docker.MediaTypeOCIManifest:
+		if manifest.Config == nil {
+			writeError(w, http.StatusBadRequest, "MANIFEST_INVALID", "manifest does not specify config")
+			return
+		}
+		blobs := append([]docker.ManifestV2Layer{*manifest.Config}, manifest.Layers...)
+		for _, blob := range blobs {
+			if err := docker.ValidateDigest(blob.Digest); err != nil {
+				writeError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+				return
+			}
+		}
+		for _, blob := range blobs {
+			found, err := s.Store.FindBlob(repository, blob.Digest)
+			if err != nil {
+				writeInternalError(w, err)
+				return
+			}
+			if found == nil {
+				writeError(w, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", "blob unknown to registry: "+blob.Digest)
+				return
+			}
+		}
+
+	case docker.MediaTypeDockerManifestList, docker.MediaTypeOCIIndex:
+		for _, m := range manifest.Manifests {
+			if err := docker.ValidateDigest(m.Digest); err != nil {
+				writeError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+				return
+			}
+		}
+		for _, m := range manifest.Manifests {
+			found, err := s.findManifest(repository, m.Digest)
+			if err != nil {
+				writeInternalError(w, err)
+				return
+			}
+			if found == "" {
+				writeError(w, http.StatusBadRequest, "MANIFEST_UNKNOWN", "manifest unknown: "+m.Digest)
+				return
+			}
+		}
+
+	default:
+		writeError(w, http.StatusBadRequest, "MANIFEST_INVALID", fmt.Sprintf("unsupported manifest media type %q", mediaType))
+		return
+	}
+
+	if _, err := s.Store.AddBlob(repository, digest, bytes.NewReader(data)); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if err := writeRecord(s.revisionPath(repository, digest), mediaType); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if !layers.IsDigest(reference) {
+		if err := writeRecord(s.tagPath(repository, reference), digest); err != nil {
+			writeInternalError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Location", "/v2/"+repository+"/manifests/"+digest)
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) readBlob(repository string, digest string) ([]byte, error) {
+	blob, err := s.Store.FindBlob(repository, digest)
+	if err != nil {
+		return nil, err
+	}
+	if blob == nil {
+		return nil, fmt.Errorf("blob %s not found in %s", digest, repository)
+	}
+
+	in, err := blob.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	return ioutil.ReadAll(in)
+}
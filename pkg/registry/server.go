@@ -0,0 +1,262 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"kope.io/build/pkg/docker"
+	"kope.io/build/pkg/layers"
+)
+
+// Server implements the docker distribution v2 API, storing blobs in a layer store.
+// It is intended for tests and local workflows, not as a production registry.
+type Server struct {
+	// Store holds the blobs.  Manifests are stored as blobs too, so the content is laid out as in a layer store.
+	Store layers.Store
+
+	// Path is the directory where tags, manifest records and in-progress uploads are stored
+	Path string
+
+	// Users enables token authentication if set: clients must get a token from /token using one of these
+	// username / password pairs.  Authenticated users can pull, push and delete in every repository.
+	Users map[string]string
+
+	// AllowDelete enables deleting manifests; otherwise deletes are rejected with 405 Method Not Allowed
+	AllowDelete bool
+
+	// mutex guards tokens
+	mutex  sync.Mutex
+	tokens map[string]*issuedToken
+}
+
+// NewServer builds a Server storing everything under dir, with blobs in the same layout as a FSLayerStore at dir
+func NewServer(dir string) *Server {
+	return &Server{
+		Store: &layers.FSLayerStore{Path: dir},
+		Path:  dir,
+	}
+}
+
+var (
+	manifestPathRegexp = regexp.MustCompile(`^/v2/(.+)/manifests/([^/]+)$`)
+	uploadPathRegexp   = regexp.MustCompile(`^/v2/(.+)/blobs/uploads/([^/]*)$`)
+	blobPathRegexp     = regexp.MustCompile(`^/v2/(.+)/blobs/([^/]+)$`)
+	tagsPathRegexp     = regexp.MustCompile(`^/v2/(.+)/tags/list$`)
+)
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	glog.V(2).Infof("registry request %s %s", req.Method, req.URL)
+
+	p := req.URL.Path
+	if p == tokenPath {
+		s.serveToken(w, req)
+		return
+	}
+
+	if !strings.HasPrefix(p, "/v2/") {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+
+	if p == "/v2/" {
+		if !s.authorize(w, req, "") {
+			return
+		}
+		writeJSON(w, http.StatusOK, struct{}{})
+		return
+	}
+
+	if p == "/v2/_catalog" {
+		if !s.authorize(w, req, catalogScope) {
+			return
+		}
+		s.serveCatalog(w, req)
+		return
+	}
+
+	if m := uploadPathRegexp.FindStringSubmatch(p); m != nil {
+		if s.checkRepository(w, req, m[1], "pull,push") {
+			s.serveUpload(w, req, m[1], m[2])
+		}
+		return
+	}
+
+	if m := blobPathRegexp.FindStringSubmatch(p); m != nil {
+		if s.checkRepository(w, req, m[1], permissionFor(req.Method)) {
+			s.serveBlob(w, req, m[1], m[2])
+		}
+		return
+	}
+
+	if m := manifestPathRegexp.FindStringSubmatch(p); m != nil {
+		if s.checkRepository(w, req, m[1], permissionFor(req.Method)) {
+			s.serveManifest(w, req, m[1], m[2])
+		}
+		return
+	}
+
+	if m := tagsPathRegexp.FindStringSubmatch(p); m != nil {
+		if s.checkRepository(w, req, m[1], "pull") {
+			s.serveTags(w, req, m[1])
+		}
+		return
+	}
+
+	writeError(w, http.StatusNotFound, "UNSUPPORTED", "unknown endpoint "+p)
+}
+
+// permissionFor returns the action needed for a request with the http method
+func permissionFor(method string) string {
+	switch method {
+	case "GET", "HEAD":
+		return "pull"
+	case "DELETE":
+		return "delete"
+	default:
+		return "pull,push"
+	}
+}
+
+// checkRepository validates the repository name and checks that the request is authorized, writing the
+// error response if not
+func (s *Server) checkRepository(w http.ResponseWriter, req *http.Request, repository string, permission string) bool {
+	if err := docker.ValidateRepository(repository); err != nil {
+		writeError(w, http.StatusBadRequest, "NAME_INVALID", err.Error())
+		return false
+	}
+	return s.authorize(w, req, "repository:"+repository+":"+permission)
+}
+
+// serveTags lists the tags in a repository, paginated with n and last as in the distribution API
+func (s *Server) serveTags(w http.ResponseWriter, req *http.Request, repository string) {
+	if req.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "method not allowed")
+		return
+	}
+
+	exists, err := s.repositoryExists(repository)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository not known to registry: "+repository)
+		return
+	}
+
+	tags, err := s.listTags(repository)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	page, ok := paginate(w, req, tags, "/v2/"+repository+"/tags/list")
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, &tagList{Name: repository, Tags: page})
+}
+
+type tagList struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+// serveCatalog lists the repositories, paginated with n and last as in the distribution API
+func (s *Server) serveCatalog(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "method not allowed")
+		return
+	}
+
+	repositories, err := s.listRepositories()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	page, ok := paginate(w, req, repositories, "/v2/_catalog")
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, &catalog{Repositories: page})
+}
+
+type catalog struct {
+	Repositories []string `json:"repositories"`
+}
+
+// paginate returns the page of the sorted values selected by the n and last query parameters,
+// setting a Link header to the next page if there is one
+func paginate(w http.ResponseWriter, req *http.Request, values []string, path string) ([]string, bool) {
+	query := req.URL.Query()
+
+	if last := query.Get("last"); last != "" {
+		i := 0
+		for i < len(values) && values[i] <= last {
+			i++
+		}
+		values = values[i:]
+	}
+
+	if s := query.Get("n"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "PAGINATION_NUMBER_INVALID", fmt.Sprintf("invalid n %q", s))
+			return nil, false
+		}
+		if n < len(values) {
+			values = values[:n]
+			if n != 0 {
+				next := fmt.Sprintf("%s?n=%d&last=%s", path, n, url.QueryEscape(values[n-1]))
+				w.Header().Set("Link", "<"+next+">; rel=\"next\"")
+			}
+		}
+	}
+
+	if values == nil {
+		values = []string{}
+	}
+	return values, true
+}
+
+// registryError is an error in the format of the distribution API
+type registryError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type errorResponse struct {
+	Errors []registryError `json:"errors"`
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	glog.V(2).Infof("registry error %d %s: %s", status, code, message)
+	writeJSON(w, status, &errorResponse{Errors: []registryError{{Code: code, Message: message}}})
+}
+
+func writeInternalError(w http.ResponseWriter, err error) {
+	glog.Warningf("registry internal error: %v", err)
+	writeError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		glog.Warningf("error serializing response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(status)
+	w.Write(b)
+}
@@ -0,0 +1,248 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestServer(t *testing.T) (*Server, func()) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	return NewServer(dir), func() {
+		os.RemoveAll(dir)
+	}
+}
+
+// request sends a request straight to the server, returning the response
+func request(s *Server, method string, path string, body []byte, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	return w
+}
+
+func errorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	response := &errorResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), response); err != nil || len(response.Errors) == 0 {
+		t.Fatalf("expected error response, got %d %q", w.Code, w.Body.String())
+	}
+	return response.Errors[0].Code
+}
+
+func TestUploadChunkRanges(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	w := request(s, "POST", "/v2/app/blobs/uploads/", nil, nil)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("unexpected response starting upload: %d", w.Code)
+	}
+	location := w.Header().Get("Location")
+	if w.Header().Get("Range") != "0-0" {
+		t.Errorf("unexpected range for empty upload: %q", w.Header().Get("Range"))
+	}
+
+	w = request(s, "PATCH", location, []byte("hello "), http.Header{"Content-Range": {"0-5"}})
+	if w.Code != http.StatusAccepted || w.Header().Get("Range") != "0-5" {
+		t.Fatalf("unexpected response to first chunk: %d range=%q", w.Code, w.Header().Get("Range"))
+	}
+
+	// A chunk which doesn't follow on is rejected, reporting what we have
+	w = request(s, "PATCH", location, []byte("world"), http.Header{"Content-Range": {"3-7"}})
+	if w.Code != http.StatusRequestedRangeNotSatisfiable || w.Header().Get("Range") != "0-5" {
+		t.Errorf("unexpected response to out of order chunk: %d range=%q", w.Code, w.Header().Get("Range"))
+	}
+
+	w = request(s, "GET", location, nil, nil)
+	if w.Code != http.StatusNoContent || w.Header().Get("Range") != "0-5" {
+		t.Errorf("unexpected upload status: %d range=%q", w.Code, w.Header().Get("Range"))
+	}
+
+	digest := "sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	w = request(s, "PUT", location+"?digest="+digest, []byte("world"), nil)
+	if w.Code != http.StatusCreated || w.Header().Get("Docker-Content-Digest") != digest {
+		t.Fatalf("unexpected response completing upload: %d %q", w.Code, w.Body.String())
+	}
+
+	w = request(s, "GET", "/v2/app/blobs/"+digest, nil, http.Header{"Range": {"bytes=6-"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "world" {
+		t.Errorf("unexpected response to range request: %d %q", w.Code, w.Body.String())
+	}
+
+	// The upload is finished
+	w = request(s, "GET", location, nil, nil)
+	if w.Code != http.StatusNotFound || errorCode(t, w) != "BLOB_UPLOAD_UNKNOWN" {
+		t.Errorf("expected finished upload to be unknown, got %d", w.Code)
+	}
+}
+
+func TestUploadDigestMismatch(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	digest := "sha256:" + strings.Repeat("0", 64)
+	w := request(s, "POST", "/v2/app/blobs/uploads/?digest="+digest, []byte("data"), nil)
+	if w.Code != http.StatusBadRequest || errorCode(t, w) != "DIGEST_INVALID" {
+		t.Errorf("expected DIGEST_INVALID for monolithic upload with the wrong digest, got %d", w.Code)
+	}
+
+	w = request(s, "HEAD", "/v2/app/blobs/"+digest, nil, nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("blob with bad digest should not be stored, got %d", w.Code)
+	}
+}
+
+func TestPutManifestInvalidDigests(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	valid := "sha256:" + strings.Repeat("0", 64)
+	escaping := "sha256:../../../" + strings.Repeat("0", 55)
+
+	grid := []struct {
+		Name     string
+		Manifest string
+	}{
+		{
+			Name:     "config",
+			Manifest: `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json", "config": {"digest": "` + escaping + `", "size": 1}, "layers": []}`,
+		},
+		{
+			Name:     "layer",
+			Manifest: `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json", "config": {"digest": "` + valid + `", "size": 1}, "layers": [{"digest": "` + escaping + `", "size": 1}]}`,
+		},
+		{
+			Name:     "manifest list entry",
+			Manifest: `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.index.v1+json", "manifests": [{"digest": "` + escaping + `", "size": 1}]}`,
+		},
+	}
+
+	for _, g := range grid {
+		w := request(s, "PUT", "/v2/app/manifests/latest", []byte(g.Manifest), nil)
+		if w.Code != http.StatusBadRequest || errorCode(t, w) != "DIGEST_INVALID" {
+			t.Errorf("%s: expected DIGEST_INVALID, got %d %q", g.Name, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestInvalidNames(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	grid := []struct {
+		Method string
+		Path   string
+		Status int
+		Code   string
+	}{
+		{Method: "GET", Path: "/v2/App/tags/list", Status: http.StatusBadRequest, Code: "NAME_INVALID"},
+		{Method: "GET", Path: "/v2/a/../b/tags/list", Status: http.StatusBadRequest, Code: "NAME_INVALID"},
+		{Method: "GET", Path: "/v2/app/tags/list", Status: http.StatusNotFound, Code: "NAME_UNKNOWN"},
+		{Method: "GET", Path: "/v2/app/manifests/-bad", Status: http.StatusBadRequest, Code: "TAG_INVALID"},
+		{Method: "GET", Path: "/v2/app/manifests/latest", Status: http.StatusNotFound, Code: "MANIFEST_UNKNOWN"},
+		{Method: "GET", Path: "/v2/app/blobs/sha256:abc", Status: http.StatusBadRequest, Code: "DIGEST_INVALID"},
+		{Method: "PATCH", Path: "/v2/app/blobs/uploads/../../etc", Status: http.StatusNotFound, Code: "UNSUPPORTED"},
+		{Method: "PATCH", Path: "/v2/app/blobs/uploads/0123", Status: http.StatusNotFound, Code: "BLOB_UPLOAD_UNKNOWN"},
+		{Method: "DELETE", Path: "/v2/app/manifests/sha256:" + strings.Repeat("0", 64), Status: http.StatusMethodNotAllowed, Code: "UNSUPPORTED"},
+	}
+
+	for _, g := range grid {
+		w := request(s, g.Method, g.Path, nil, nil)
+		if w.Code != g.Status || errorCode(t, w) != g.Code {
+			t.Errorf("unexpected response to %s %s: %d %q", g.Method, g.Path, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestPagination(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	for _, tag := range []string{"c", "a", "b"} {
+		if err := writeRecord(s.tagPath("team/app", tag), "sha256:"+strings.Repeat("0", 64)); err != nil {
+			t.Fatalf("error writing tag: %v", err)
+		}
+	}
+
+	w := request(s, "GET", "/v2/team/app/tags/list?n=2", nil, nil)
+	list := &tagList{}
+	if err := json.Unmarshal(w.Body.Bytes(), list); err != nil {
+		t.Fatalf("error parsing tags: %v", err)
+	}
+	if !reflect.DeepEqual(list.Tags, []string{"a", "b"}) {
+		t.Errorf("unexpected first page %v", list.Tags)
+	}
+	link := w.Header().Get("Link")
+	if link != `</v2/team/app/tags/list?n=2&last=b>; rel="next"` {
+		t.Fatalf("unexpected Link header %q", link)
+	}
+
+	w = request(s, "GET", "/v2/team/app/tags/list?n=2&last=b", nil, nil)
+	list = &tagList{}
+	if err := json.Unmarshal(w.Body.Bytes(), list); err != nil {
+		t.Fatalf("error parsing tags: %v", err)
+	}
+	if !reflect.DeepEqual(list.Tags, []string{"c"}) || w.Header().Get("Link") != "" {
+		t.Errorf("unexpected last page %v, Link %q", list.Tags, w.Header().Get("Link"))
+	}
+
+	w = request(s, "GET", "/v2/_catalog?n=1", nil, nil)
+	if !strings.Contains(w.Body.String(), `"team/app"`) {
+		t.Errorf("unexpected catalog %q", w.Body.String())
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	s.Users = map[string]string{"ci": "secret"}
+
+	w := request(s, "GET", "/v2/app/tags/list", nil, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected challenge without a token, got %d", w.Code)
+	}
+	expected := `Bearer realm="http://example.com/token",service="example.com",scope="repository:app:pull"`
+	if challenge := w.Header().Get("WWW-Authenticate"); challenge != expected {
+		t.Errorf("unexpected challenge %q", challenge)
+	}
+
+	req := httptest.NewRequest("GET", "/token?scope=repository:app:pull", nil)
+	req.SetBasicAuth("ci", "wrong")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected bad password to be rejected, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/token?scope=repository:app:pull", nil)
+	req.SetBasicAuth("ci", "secret")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	token := &tokenResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), token); err != nil || token.Token == "" {
+		t.Fatalf("expected token, got %d %q", w.Code, w.Body.String())
+	}
+
+	bearer := http.Header{"Authorization": {"Bearer " + token.Token}}
+	if w := request(s, "GET", "/v2/app/tags/list", nil, bearer); w.Code != http.StatusNotFound {
+		t.Errorf("expected token to grant pull, got %d", w.Code)
+	}
+	if w := request(s, "POST", "/v2/app/blobs/uploads/", nil, bearer); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected token not to grant push, got %d", w.Code)
+	}
+	if w := request(s, "GET", "/v2/other/tags/list", nil, bearer); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected token not to grant access to other repositories, got %d", w.Code)
+	}
+}
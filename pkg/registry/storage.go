@@ -0,0 +1,183 @@
+package registry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Tags and manifest records are kept under repositories/<repository>/_manifests/, following the layout of
+// docker distribution.  The leading underscore can't start a repository path component, so nested
+// repositories (a and a/b) don't collide.
+const (
+	repositoriesDir = "repositories"
+	manifestsDir    = "_manifests"
+	uploadsDir      = "uploads"
+)
+
+func (s *Server) manifestsPath(repository string) string {
+	return filepath.Join(s.Path, repositoriesDir, filepath.FromSlash(repository), manifestsDir)
+}
+
+// revisionPath is the record of a manifest in a repository; it holds the media type of the manifest
+func (s *Server) revisionPath(repository string, digest string) string {
+	return filepath.Join(s.manifestsPath(repository), "revisions", digest)
+}
+
+// tagPath is the record of a tag in a repository; it holds the digest of the tagged manifest
+func (s *Server) tagPath(repository string, tag string) string {
+	return filepath.Join(s.manifestsPath(repository), "tags", tag)
+}
+
+func (s *Server) uploadPath(uuid string) string {
+	return filepath.Join(s.Path, uploadsDir, uuid)
+}
+
+// readRecord reads a tag or revision record, returning "" if it does not exist
+func readRecord(p string) (string, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("error reading %q: %v", p, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// writeRecord writes a tag or revision record, replacing it atomically so readers never see a partial record
+func writeRecord(p string, value string) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("error creating directory for %q: %v", p, err)
+	}
+
+	tmpfile, err := ioutil.TempFile(filepath.Dir(p), ".tmp")
+	if err != nil {
+		return fmt.Errorf("error creating temp file for %q: %v", p, err)
+	}
+	tmpPath := tmpfile.Name()
+
+	_, err = tmpfile.WriteString(value + "\n")
+	if closeErr := tmpfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error writing %q: %v", tmpPath, err)
+	}
+
+	if err := os.Rename(tmpPath, p); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error moving %q into place: %v", p, err)
+	}
+	return nil
+}
+
+// listRecords returns the sorted names of the records in dir, ignoring temp files
+func listRecords(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading directory %q: %v", dir, err)
+	}
+
+	var names []string
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		names = append(names, f.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *Server) repositoryExists(repository string) (bool, error) {
+	p := s.manifestsPath(repository)
+	_, err := os.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("error reading %q: %v", p, err)
+	}
+	return true, nil
+}
+
+func (s *Server) listTags(repository string) ([]string, error) {
+	return listRecords(filepath.Join(s.manifestsPath(repository), "tags"))
+}
+
+// resolveTag returns the digest of the manifest with the tag, or "" if the tag does not exist
+func (s *Server) resolveTag(repository string, tag string) (string, error) {
+	return readRecord(s.tagPath(repository, tag))
+}
+
+// findManifest returns the media type of the manifest in the repository, or "" if there is no such manifest
+func (s *Server) findManifest(repository string, digest string) (string, error) {
+	return readRecord(s.revisionPath(repository, digest))
+}
+
+// deleteManifest removes the record of the manifest, and any tags pointing to it.  The blob holding
+// the manifest is left in the store.
+func (s *Server) deleteManifest(repository string, digest string) error {
+	tags, err := s.listTags(repository)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		target, err := s.resolveTag(repository, tag)
+		if err != nil {
+			return err
+		}
+		if target != digest {
+			continue
+		}
+		p := s.tagPath(repository, tag)
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing tag %q: %v", p, err)
+		}
+	}
+
+	p := s.revisionPath(repository, digest)
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing manifest %q: %v", p, err)
+	}
+	return nil
+}
+
+// listRepositories returns the sorted names of all the repositories which have manifests
+func (s *Server) listRepositories() ([]string, error) {
+	root := filepath.Join(s.Path, repositoriesDir)
+
+	var repositories []string
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == root {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() || info.Name() != manifestsDir {
+			return nil
+		}
+
+		relative, err := filepath.Rel(root, filepath.Dir(p))
+		if err != nil {
+			return err
+		}
+		repositories = append(repositories, filepath.ToSlash(relative))
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing repositories in %q: %v", root, err)
+	}
+
+	sort.Strings(repositories)
+	return repositories, nil
+}
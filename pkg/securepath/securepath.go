@@ -0,0 +1,103 @@
+// Package securepath resolves paths inside a root directory, as if the root directory were a chroot.
+package securepath
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinks is the number of symlinks we will follow resolving a path, so that loops are an error
+const maxSymlinks = 255
+
+// EscapeError is returned when a path, or a symlink it passes through, refers to a path outside the root
+type EscapeError struct {
+	Path string
+}
+
+func (e *EscapeError) Error() string {
+	return fmt.Sprintf("path %q is outside the root directory", e.Path)
+}
+
+// IsEscape returns true if err is an EscapeError
+func IsEscape(err error) bool {
+	_, ok := err.(*EscapeError)
+	return ok
+}
+
+// Resolve returns the path on the host for p inside root, following symlinks as if root were the filesystem root.
+// Absolute symlink targets are relative to root; paths which would leave root are rejected with an EscapeError.
+// p need not exist, nor its parent directories.
+func Resolve(root string, p string) (string, error) {
+	return resolve(root, p, true)
+}
+
+// ResolveParent is like Resolve, but does not follow the last component of p,
+// so that it can be used to replace or remove p when it is itself a symlink.
+func ResolveParent(root string, p string) (string, error) {
+	return resolve(root, p, false)
+}
+
+func resolve(root string, p string, followLast bool) (string, error) {
+	// resolved holds the components we have resolved, none of which are symlinks
+	var resolved []string
+	pending := strings.Split(filepath.ToSlash(p), "/")
+	links := 0
+
+	for len(pending) != 0 {
+		c := pending[0]
+		pending = pending[1:]
+
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return "", &EscapeError{Path: p}
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		next := append(resolved, c)
+		if len(pending) == 0 && !followLast {
+			resolved = next
+			break
+		}
+
+		host := hostPath(root, next)
+		stat, err := os.Lstat(host)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Nothing to follow; we will create it
+				resolved = next
+				continue
+			}
+			return "", fmt.Errorf("error reading %q: %v", host, err)
+		}
+		if stat.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symlinks resolving %q", p)
+		}
+		target, err := os.Readlink(host)
+		if err != nil {
+			return "", fmt.Errorf("error reading symlink %q: %v", host, err)
+		}
+		if strings.HasPrefix(target, "/") {
+			resolved = nil
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+
+	return hostPath(root, resolved), nil
+}
+
+func hostPath(root string, components []string) string {
+	return filepath.Join(root, filepath.FromSlash(strings.Join(components, "/")))
+}
@@ -0,0 +1,149 @@
+package securepath
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestRoot builds a root directory with some well-behaved and some hostile symlinks
+func newTestRoot(t testing.TB) string {
+	root, err := ioutil.TempDir("", "securepath")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+
+	for _, dir := range []string{"etc", "usr/lib", "var"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatalf("error creating dir: %v", err)
+		}
+	}
+	links := map[string]string{
+		"lib":          "usr/lib",
+		"usr/lib64":    "/usr/lib",
+		"var/run":      "../run",
+		"etc/passwd":   "/etc/shadow",
+		"host":         "/etc",
+		"escape":       "../../../etc",
+		"var/escape":   "../../etc",
+		"loop":         "loop",
+		"usr/lib/self": ".",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatalf("error creating symlink: %v", err)
+		}
+	}
+	return root
+}
+
+func TestResolve(t *testing.T) {
+	root := newTestRoot(t)
+	defer os.RemoveAll(root)
+
+	grid := []struct {
+		Path       string
+		FollowLast bool
+		Expected   string
+		Error      string
+	}{
+		{Path: "/etc/motd", FollowLast: true, Expected: "etc/motd"},
+		{Path: "etc/motd", FollowLast: true, Expected: "etc/motd"},
+		{Path: "/", FollowLast: true, Expected: ""},
+		{Path: "/a/b/../c", FollowLast: true, Expected: "a/c"},
+		{Path: "/lib/libc.so", FollowLast: true, Expected: "usr/lib/libc.so"},
+		{Path: "/usr/lib64/libc.so", FollowLast: true, Expected: "usr/lib/libc.so"},
+		{Path: "/usr/lib/self/self/x", FollowLast: true, Expected: "usr/lib/x"},
+		{Path: "/var/run/app.pid", FollowLast: true, Expected: "run/app.pid"},
+		{Path: "/host/passwd", FollowLast: true, Expected: "etc/shadow"},
+		{Path: "/etc/passwd", FollowLast: true, Expected: "etc/shadow"},
+		{Path: "/etc/passwd", FollowLast: false, Expected: "etc/passwd"},
+		{Path: "/lib", FollowLast: false, Expected: "lib"},
+		{Path: "/lib/x", FollowLast: false, Expected: "usr/lib/x"},
+		{Path: "/missing/../etc", FollowLast: true, Expected: "etc"},
+
+		{Path: "../etc/passwd", FollowLast: true, Error: "outside the root directory"},
+		{Path: "/../../../../etc/passwd", FollowLast: false, Error: "outside the root directory"},
+		{Path: "/a/../../b", FollowLast: true, Error: "outside the root directory"},
+		{Path: "/escape/passwd", FollowLast: true, Error: "outside the root directory"},
+		{Path: "/escape", FollowLast: true, Error: "outside the root directory"},
+		{Path: "/var/escape/passwd", FollowLast: false, Error: "outside the root directory"},
+		{Path: "/loop/x", FollowLast: true, Error: "too many levels of symlinks"},
+	}
+
+	for _, g := range grid {
+		var actual string
+		var err error
+		if g.FollowLast {
+			actual, err = Resolve(root, g.Path)
+		} else {
+			actual, err = ResolveParent(root, g.Path)
+		}
+
+		if g.Error != "" {
+			if err == nil || !strings.Contains(err.Error(), g.Error) {
+				t.Errorf("resolving %q: expected error %q, got %q, %v", g.Path, g.Error, actual, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error resolving %q: %v", g.Path, err)
+			continue
+		}
+		expected := filepath.Join(root, filepath.FromSlash(g.Expected))
+		if actual != expected {
+			t.Errorf("resolving %q: expected %q, got %q", g.Path, expected, actual)
+		}
+	}
+
+	if _, err := Resolve(root, "../x"); !IsEscape(err) {
+		t.Errorf("expected EscapeError, got %v", err)
+	}
+}
+
+func FuzzResolve(f *testing.F) {
+	root := newTestRoot(f)
+	defer os.RemoveAll(root)
+
+	for _, seed := range []string{"/etc/motd", "../x", "/escape/x", "/var/run/../../..", "lib/./../host", "loop"} {
+		f.Add(seed, true)
+		f.Add(seed, false)
+	}
+
+	f.Fuzz(func(t *testing.T, p string, followLast bool) {
+		var actual string
+		var err error
+		if followLast {
+			actual, err = Resolve(root, p)
+		} else {
+			actual, err = ResolveParent(root, p)
+		}
+		if err != nil {
+			return
+		}
+
+		if actual != root && !strings.HasPrefix(actual, root+string(filepath.Separator)) {
+			t.Fatalf("%q resolved to %q, outside %q", p, actual, root)
+		}
+
+		// Nothing we resolved through may be a symlink, so the host can't take us anywhere else
+		rel, _ := filepath.Rel(root, actual)
+		parts := strings.Split(rel, string(filepath.Separator))
+		if !followLast {
+			parts = parts[:len(parts)-1]
+		}
+		dir := root
+		for _, part := range parts {
+			dir = filepath.Join(dir, part)
+			stat, err := os.Lstat(dir)
+			if err != nil {
+				break
+			}
+			if stat.Mode()&os.ModeSymlink != 0 {
+				t.Fatalf("%q resolved to %q, through symlink %q", p, actual, dir)
+			}
+		}
+	})
+}
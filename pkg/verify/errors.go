@@ -0,0 +1,37 @@
+// Package verify has the errors returned when data does not match its expected digest or size,
+// shared by the registry client and the layer store.
+package verify
+
+import "fmt"
+
+// DigestMismatchError is returned when the data we received or stored does not match its expected digest
+type DigestMismatchError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("digest does not match: expected %q, was %q", e.Expected, e.Actual)
+}
+
+// IsDigestMismatch returns true if err is a DigestMismatchError
+func IsDigestMismatch(err error) bool {
+	_, ok := err.(*DigestMismatchError)
+	return ok
+}
+
+// SizeMismatchError is returned when the data we received or stored does not have the expected size
+type SizeMismatchError struct {
+	Expected int64
+	Actual   int64
+}
+
+func (e *SizeMismatchError) Error() string {
+	return fmt.Sprintf("size does not match: expected %d bytes, got %d", e.Expected, e.Actual)
+}
+
+// IsSizeMismatch returns true if err is a SizeMismatchError
+func IsSizeMismatch(err error) bool {
+	_, ok := err.(*SizeMismatchError)
+	return ok
+}